@@ -0,0 +1,130 @@
+package DAO
+
+import (
+	"TCC/pkg"
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"time"
+)
+
+// 分支不存在, 通常是旧版本以json储存组件状态的事务
+var ErrBranchNotFound = errors.New("tx branch not found")
+
+// 分支的二阶段状态, 为空表示尚未完成二阶段
+const (
+	BranchPhase2Confirmed = "Confirmed"
+	BranchPhase2Cancelled = "Cancelled"
+)
+
+// 事务分支: 一个事务中一个组件的执行状态, 每个分支一行, 状态变更只更新单行
+type TXBranchPO struct {
+	ID          uint   `gorm:"primarykey"`
+	TXId        string `gorm:"column:tx_id;size:64;not null;uniqueIndex:idx_tx_branch_tx_component,priority:1"`
+	ComponentID string `gorm:"column:component_id;size:128;not null;uniqueIndex:idx_tx_branch_tx_component,priority:2;index:idx_tx_branch_component"`
+	TryStatus   string `gorm:"column:try_status;size:16;not null;index:idx_tx_branch_try_status"`
+	//二阶段状态, 为空表示尚未完成二阶段
+	Phase2Status string `gorm:"column:phase2_status;size:16;not null;default:''"`
+	//try与二阶段的累计执行次数
+	Attempts int `gorm:"column:attempts;not null;default:0"`
+	//最近一次失败执行的原因, 之后执行成功时保留
+	LastError string `gorm:"column:last_error;size:1024"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (t TXBranchPO) TableName() string {
+	return "tx_branch"
+}
+
+// last_error列的最大长度
+const maxBranchErrorLength = 1024
+
+// 查询事务的所有分支
+func (dao *TXRecordDAO) GetTXBranches(ctx context.Context, txIds ...string) ([]*TXBranchPO, error) {
+	var branches []*TXBranchPO
+	if len(txIds) == 0 {
+		return branches, nil
+	}
+	return branches, dao.db.WithContext(ctx).Where("tx_id IN ?", txIds).Order("id ASC").Find(&branches).Error
+}
+
+// 更新分支的try状态, 只有状态仍为TryHanging时才会更新.
+// 重复更新为相同状态时直接返回; 分支已是其他状态时返回错误.
+// 成功的try累加执行次数, 失败的执行由RecordBranchFailure累加
+func (dao *TXRecordDAO) UpdateBranchTryStatus(ctx context.Context, txId string, componentID string, status string) error {
+	updates := map[string]interface{}{"try_status": status}
+	if status == pkg.TrySuccess.String() {
+		updates["attempts"] = gorm.Expr("attempts + 1")
+	}
+	result := dao.db.WithContext(ctx).Model(&TXBranchPO{}).
+		Where("tx_id = ? AND component_id = ? AND try_status = ?", txId, componentID, pkg.TryHanging.String()).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	branch, err := dao.getTXBranch(ctx, txId, componentID)
+	if err != nil {
+		return err
+	}
+	if branch.TryStatus == status { //重复执行则直接跳过
+		return nil
+	}
+	return fmt.Errorf("invalid status: %s of component: %s, txid: %s", branch.TryStatus, componentID, txId)
+}
+
+// 记录分支的二阶段结果, 只有尚未完成二阶段或重复更新为相同状态时才会更新
+func (dao *TXRecordDAO) UpdateBranchPhase2Status(ctx context.Context, txId string, componentID string, status string) error {
+	result := dao.db.WithContext(ctx).Model(&TXBranchPO{}).
+		Where("tx_id = ? AND component_id = ? AND phase2_status IN ?", txId, componentID, []string{"", status}).
+		Updates(map[string]interface{}{
+			"phase2_status": status,
+			"attempts":      gorm.Expr("attempts + 1"),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	branch, err := dao.getTXBranch(ctx, txId, componentID)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("invalid phase2 status: %s of component: %s, txid: %s", branch.Phase2Status, componentID, txId)
+}
+
+// 记录分支的一次失败执行, 累加执行次数并保存错误信息
+func (dao *TXRecordDAO) RecordBranchFailure(ctx context.Context, txId string, componentID string, lastError string) error {
+	if len(lastError) > maxBranchErrorLength {
+		lastError = lastError[:maxBranchErrorLength]
+	}
+	result := dao.db.WithContext(ctx).Model(&TXBranchPO{}).
+		Where("tx_id = ? AND component_id = ?", txId, componentID).
+		Updates(map[string]interface{}{
+			"attempts":   gorm.Expr("attempts + 1"),
+			"last_error": lastError,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("component %s in TX%s: %w", componentID, txId, ErrBranchNotFound)
+	}
+	return nil
+}
+
+func (dao *TXRecordDAO) getTXBranch(ctx context.Context, txId string, componentID string) (*TXBranchPO, error) {
+	branch := &TXBranchPO{}
+	err := dao.db.WithContext(ctx).Where("tx_id = ? AND component_id = ?", txId, componentID).First(branch).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("component %s in TX%s: %w", componentID, txId, ErrBranchNotFound)
+	}
+	return branch, err
+}
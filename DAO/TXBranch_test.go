@@ -0,0 +1,105 @@
+package DAO
+
+import (
+	"TCC/pkg"
+	"TCC/testutil"
+	"context"
+	"errors"
+	"testing"
+)
+
+func newTestDAO(t *testing.T) *TXRecordDAO {
+	return NewTXRecordDAO(testutil.NewDB(t, &TXRecordPO{}, &TXBranchPO{}))
+}
+
+func Test_branch_status_update(t *testing.T) {
+	dao := newTestDAO(t)
+	ctx := context.Background()
+
+	_, err := dao.CreateTXRecord(ctx, &TXRecordPO{
+		TXId:   "tx1",
+		Status: pkg.TryHanging.String(),
+		Branches: []*TXBranchPO{
+			{TXId: "tx1", ComponentID: "a", TryStatus: pkg.TryHanging.String()},
+			{TXId: "tx1", ComponentID: "b", TryStatus: pkg.TryHanging.String()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = dao.UpdateBranchTryStatus(ctx, "tx1", "a", pkg.TrySuccess.String()); err != nil {
+		t.Fatal(err)
+	}
+	//重复更新为相同状态直接返回, 更新为其他状态报错
+	if err = dao.UpdateBranchTryStatus(ctx, "tx1", "a", pkg.TrySuccess.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err = dao.UpdateBranchTryStatus(ctx, "tx1", "a", pkg.TryFailure.String()); err == nil {
+		t.Fatal("update a finished branch to another status should fail")
+	}
+	if err = dao.UpdateBranchTryStatus(ctx, "tx1", "c", pkg.TrySuccess.String()); !errors.Is(err, ErrBranchNotFound) {
+		t.Fatal("expect ErrBranchNotFound, got: ", err)
+	}
+
+	if err = dao.RecordBranchFailure(ctx, "tx1", "b", "timeout"); err != nil {
+		t.Fatal(err)
+	}
+	if err = dao.UpdateBranchPhase2Status(ctx, "tx1", "a", BranchPhase2Confirmed); err != nil {
+		t.Fatal(err)
+	}
+	if err = dao.UpdateBranchPhase2Status(ctx, "tx1", "a", BranchPhase2Cancelled); err == nil {
+		t.Fatal("update phase2 status to another status should fail")
+	}
+
+	records, err := dao.GetTXRecords(ctx, WithTXId("tx1"), WithBranches())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0].Branches) != 2 {
+		t.Fatalf("expect 1 record with 2 branches, got: %+v", records)
+	}
+	a, b := records[0].Branches[0], records[0].Branches[1]
+	if a.TryStatus != pkg.TrySuccess.String() || a.Phase2Status != BranchPhase2Confirmed || a.Attempts != 2 {
+		t.Fatalf("unexpected branch a: %+v", a)
+	}
+	if b.TryStatus != pkg.TryHanging.String() || b.LastError != "timeout" || b.Attempts != 1 {
+		t.Fatalf("unexpected branch b: %+v", b)
+	}
+}
+
+func Test_query_by_component_id(t *testing.T) {
+	dao := newTestDAO(t)
+	ctx := context.Background()
+
+	if _, err := dao.CreateTXRecord(ctx, &TXRecordPO{
+		TXId:     "tx1",
+		Status:   pkg.TryHanging.String(),
+		Branches: []*TXBranchPO{{TXId: "tx1", ComponentID: "a_1", TryStatus: pkg.TryHanging.String()}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	//旧版本以json储存组件状态的事务
+	if _, err := dao.CreateTXRecord(ctx, &TXRecordPO{
+		TXId:                 "tx2",
+		Status:               pkg.TryHanging.String(),
+		ComponentTryStatuses: `{"a_1":{"component_id":"a_1","try_status":"Hanging"}}`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dao.CreateTXRecord(ctx, &TXRecordPO{
+		TXId:     "tx3",
+		Status:   pkg.TryHanging.String(),
+		Branches: []*TXBranchPO{{TXId: "tx3", ComponentID: "ax1", TryStatus: pkg.TryHanging.String()}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := dao.CountTXRecords(ctx, WithComponentID("a_1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expect 2 records, got: %d", count)
+	}
+}
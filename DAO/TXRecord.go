@@ -4,29 +4,91 @@ import (
 	"TCC/pkg"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"math/rand/v2"
+	"strconv"
+	"time"
 )
 
+// 记录在读取后被其他调用方修改, 乐观更新未生效
+var ErrVersionConflict = errors.New("tx record version conflict")
+
+// OptimisticDo的默认重试次数
+const DefaultOptimisticRetries = 3
+
+// OptimisticDo重试前的随机等待基数, 第n次重试前等待[0, OptimisticBackoff*2^(n-1))
+const OptimisticBackoff = 5 * time.Millisecond
+
 type TXRecordDAOInterface interface {
 	GetTXRecords(ctx context.Context, opts ...QueryOption) ([]*TXRecordPO, error)
+	CountTXRecords(ctx context.Context, opts ...QueryOption) (int64, error)
 	CreateTXRecord(ctx context.Context, record *TXRecordPO) (uint, error)
+	//以record.Version做CAS更新: 只有库中的版本号与record一致时才会更新, 否则返回ErrVersionConflict.
+	//record应是在同一次LockAndDo或OptimisticDo中刚读取的记录, 传入自行构造或较早读取的记录会因版本不一致而失败
 	UpdateTXRecord(ctx context.Context, record *TXRecordPO) error
-	UpdateComponentStatus(ctx context.Context, id uint, componentID string, Status string) error
-	LockAndDo(ctx context.Context, id uint, do func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error) error
+	UpdateTXStatusFenced(ctx context.Context, record *TXRecordPO, token int64) error
+	UpdateComponentStatus(ctx context.Context, txId string, componentID string, Status string) error
+	LockAndDo(ctx context.Context, txId string, do func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error) error
+	OptimisticDo(ctx context.Context, txId string, maxRetries int, do func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error) error
+	ReleaseIdempotencyKey(ctx context.Context, txId string) error
+	ReleaseIdempotencyKeysBefore(ctx context.Context, before time.Time, limit int) (int64, error)
+	GetTXBranches(ctx context.Context, txIds ...string) ([]*TXBranchPO, error)
+	UpdateBranchTryStatus(ctx context.Context, txId string, componentID string, status string) error
+	UpdateBranchPhase2Status(ctx context.Context, txId string, componentID string, status string) error
+	RecordBranchFailure(ctx context.Context, txId string, componentID string, lastError string) error
+	ArchiveTXRecords(ctx context.Context, records []*TXRecordPO) (int64, error)
+	PurgeTXRecords(ctx context.Context, records []*TXRecordPO) (int64, error)
 }
 
 type TXRecordPO struct {
-	gorm.Model
-	Status               string `gorm:"status"`
+	//展开gorm.Model, 以便updated_at参与(status, updated_at)索引
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	//归档时按status与updated_at查询已结束的事务
+	UpdatedAt time.Time      `gorm:"index:idx_tx_record_status_updated,priority:2"`
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	//事务id, 由id生成器在持久化之前生成
+	TXId   string `gorm:"column:tx_id;uniqueIndex;size:64"`
+	Status string `gorm:"column:status;index:idx_tx_record_status_bucket,priority:1;index:idx_tx_record_status_updated,priority:1"`
+	//旧版本以json储存的组件状态, 新创建的事务将组件状态储存在tx_branch中
 	ComponentTryStatuses string `gorm:"component_try_statuses"`
+	//事务id所属的哈希桶, 见pkg.ShardBucketOf; 恢复悬挂事务时按桶分片查询.
+	//增加该列之前创建的事务均为0号桶, 由包含0号桶的分片恢复
+	ShardBucket int `gorm:"column:shard_bucket;not null;default:0;index:idx_tx_record_status_bucket,priority:2"`
+	//调用方提供的幂等键, 为空表示未设置
+	IdempotencyKey *string `gorm:"column:idempotency_key;uniqueIndex;size:128"`
+	//乐观锁版本号, 每次通过UpdateTXRecord更新时加一
+	Version uint `gorm:"column:version;not null;default:0"`
+	//恢复悬挂事务的副本提交事务状态时携带的最大fencing token, 见UpdateTXStatusFenced
+	FencingToken int64 `gorm:"column:fencing_token;not null;default:0"`
+	//事务的分支, 创建记录时一同写入, 查询时需通过WithBranches加载
+	Branches []*TXBranchPO `gorm:"foreignKey:TXId;references:TXId"`
 }
 
 func (t TXRecordPO) TableName() string {
 	return "TXRecordPO"
 }
 
+// 事务id: 引入tx_id之前创建的记录tx_id为空, 当时以自增主键的十进制表示作为事务id
+func (t *TXRecordPO) GetTXId() string {
+	if t.TXId == "" {
+		return strconv.FormatUint(uint64(t.ID), 10)
+	}
+	return t.TXId
+}
+
+// 按事务id过滤记录, 可以匹配tx_id为空的旧记录, 见GetTXId
+func whereTXId(db *gorm.DB, txId string) *gorm.DB {
+	id, err := strconv.ParseUint(txId, 10, 64)
+	if err != nil {
+		return db.Where("tx_id = ?", txId)
+	}
+	return db.Where("(tx_id = ? OR ((tx_id IS NULL OR tx_id = '') AND id = ?))", txId, id)
+}
+
 type ComponentTryStatus struct {
 	ComponentID string `json:"component_id"`
 	TryStatus   string `json:"try_status"`
@@ -44,7 +106,7 @@ func NewTXRecordDAO(db *gorm.DB) *TXRecordDAO {
 
 func (dao *TXRecordDAO) GetTXRecords(ctx context.Context, opts ...QueryOption) ([]*TXRecordPO, error) {
 	var records []*TXRecordPO
-	db := dao.db.WithContext(context.Background()).Model(&TXRecordPO{})
+	db := dao.db.WithContext(ctx).Model(&TXRecordPO{})
 
 	for _, opt := range opts {
 		db = opt(db)
@@ -53,25 +115,100 @@ func (dao *TXRecordDAO) GetTXRecords(ctx context.Context, opts ...QueryOption) (
 	return records, db.Find(&records).Error
 }
 
+// 统计满足条件的记录数, 只应传入过滤条件, 排序与分页选项对统计无意义
+func (dao *TXRecordDAO) CountTXRecords(ctx context.Context, opts ...QueryOption) (int64, error) {
+	var count int64
+	db := dao.db.WithContext(ctx).Model(&TXRecordPO{})
+
+	for _, opt := range opts {
+		db = opt(db)
+	}
+
+	return count, db.Count(&count).Error
+}
+
 func (dao *TXRecordDAO) CreateTXRecord(ctx context.Context, record *TXRecordPO) (uint, error) {
-	return record.ID, dao.db.WithContext(ctx).Create(record).Error
+	if err := dao.db.WithContext(ctx).Create(record).Error; err != nil {
+		return 0, err
+	}
+	return record.ID, nil
 }
 
+// 按主键更新记录的非零字段并将版本号加一, 分支不随记录更新.
+// 只有版本号与读取时一致才会更新, 否则返回ErrVersionConflict
 func (dao *TXRecordDAO) UpdateTXRecord(ctx context.Context, record *TXRecordPO) error {
-	return dao.db.WithContext(ctx).Model(&TXRecordPO{}).Updates(record).Error
+	version := record.Version
+	record.Version++
+	result := dao.db.WithContext(ctx).Model(record).Where("version = ?", version).Omit(clause.Associations).Updates(record)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result.Error = fmt.Errorf("TX%s at version %d: %w", record.GetTXId(), version, ErrVersionConflict)
+	}
+	if result.Error != nil {
+		record.Version = version
+	}
+	return result.Error
+}
+
+// 携带fencing token更新事务状态并将版本号加一: 记录上的token大于本次token时返回ErrStaleFencingToken,
+// 版本号与读取时不一致时返回ErrVersionConflict, 可在LockAndDo与OptimisticDo中使用
+func (dao *TXRecordDAO) UpdateTXStatusFenced(ctx context.Context, record *TXRecordPO, token int64) error {
+	if record.FencingToken > token {
+		return fmt.Errorf("TX%s token:%d err: %w", record.GetTXId(), token, ErrStaleFencingToken)
+	}
+	db := dao.db.WithContext(ctx).Model(&TXRecordPO{}).Where("id = ? AND version = ?", record.ID, record.Version)
+	err := FencedUpdates(db, "fencing_token", token, map[string]interface{}{
+		"status":  record.Status,
+		"version": record.Version + 1,
+	})
+	if errors.Is(err, ErrStaleFencingToken) {
+		//读取时token未过期, 没有更新说明记录已被修改
+		return fmt.Errorf("TX%s at version %d: %w", record.GetTXId(), record.Version, ErrVersionConflict)
+	}
+	if err != nil {
+		return err
+	}
+	record.Version++
+	record.FencingToken = token
+	return nil
+}
+
+// 释放事务的幂等键, 使该键可以被新的事务使用
+func (dao *TXRecordDAO) ReleaseIdempotencyKey(ctx context.Context, txId string) error {
+	return whereTXId(dao.db.WithContext(ctx).Model(&TXRecordPO{}), txId).Updates(map[string]interface{}{
+		"idempotency_key": nil,
+		"version":         gorm.Expr("version + 1"),
+	}).Error
+}
+
+// 释放创建时间早于before的事务的幂等键, 每次最多释放limit个, 返回释放的数量
+func (dao *TXRecordDAO) ReleaseIdempotencyKeysBefore(ctx context.Context, before time.Time, limit int) (int64, error) {
+	var ids []uint
+	err := dao.db.WithContext(ctx).Model(&TXRecordPO{}).
+		Where("idempotency_key IS NOT NULL AND created_at < ?", before).
+		Order("id ASC").Limit(limit).Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	result := dao.db.WithContext(ctx).Model(&TXRecordPO{}).
+		Where("id IN ? AND idempotency_key IS NOT NULL", ids).
+		Updates(map[string]interface{}{
+			"idempotency_key": nil,
+			"version":         gorm.Expr("version + 1"),
+		})
+	return result.RowsAffected, result.Error
 }
 
-// 更新组件的状态
+// 更新旧版本以json储存的组件状态, 新创建的事务使用UpdateBranchTryStatus
 // 如果状态已更新，则直接返回；如果状态不是tryHanging,则返回错误
-func (dao *TXRecordDAO) UpdateComponentStatus(ctx context.Context, id uint, componentID string, status string) error {
-	return dao.LockAndDo(ctx, id, func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error {
+func (dao *TXRecordDAO) UpdateComponentStatus(ctx context.Context, txId string, componentID string, status string) error {
+	return dao.LockAndDo(ctx, txId, func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error {
 		var statuses map[string]*ComponentTryStatus
 		if err := json.Unmarshal([]byte(record.ComponentTryStatuses), &statuses); err != nil {
 			return err
 		}
 		componentStatus, ok := statuses[componentID]
 		if !ok {
-			return fmt.Errorf("component %s not exist in TX%d", componentID, id)
+			return fmt.Errorf("component %s not exist in TX%s", componentID, txId)
 		}
 
 		if componentStatus.TryStatus == status { //重复执行则直接跳过
@@ -79,22 +216,22 @@ func (dao *TXRecordDAO) UpdateComponentStatus(ctx context.Context, id uint, comp
 		}
 
 		if componentStatus.TryStatus != pkg.TryHanging.String() {
-			return fmt.Errorf("invalid status: %s of component: %s, txid: %d", componentStatus.TryStatus, componentID, id)
+			return fmt.Errorf("invalid status: %s of component: %s, txid: %s", componentStatus.TryStatus, componentID, txId)
 		}
 
 		componentStatus.TryStatus = status
-		body, _ := json.Marshal(componentStatus)
+		body, _ := json.Marshal(statuses)
 		record.ComponentTryStatuses = string(body)
 		return dao.UpdateTXRecord(ctx, record)
 	})
 }
 
-// 开启事务，并根据id查询对应的记录，然后根据记录执行do函数操作
-func (dao *TXRecordDAO) LockAndDo(ctx context.Context, id uint, do func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error) error {
+// 开启事务，并根据事务id查询对应的记录，然后根据记录执行do函数操作
+func (dao *TXRecordDAO) LockAndDo(ctx context.Context, txId string, do func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error) error {
 	return dao.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		record := &TXRecordPO{}
 
-		if err := dao.db.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).First(record, id).Error; err != nil {
+		if err := whereTXId(tx.Clauses(clause.Locking{Strength: "UPDATE"}), txId).First(record).Error; err != nil {
 			return err
 		}
 
@@ -102,3 +239,32 @@ func (dao *TXRecordDAO) LockAndDo(ctx context.Context, id uint, do func(ctx cont
 		return do(ctx, Dao, record)
 	})
 }
+
+// 不加锁读取记录后执行do, do中通过UpdateTXRecord写回时若版本冲突则重新读取并重试, 最多重试maxRetries次, 不大于0时使用DefaultOptimisticRetries.
+// 重试前随机等待一段时间, 避免冲突的调用方同时重试再次冲突, 见OptimisticBackoff.
+// 适合冲突较少的场景, 避免行锁使并发更新排队; do可能被执行多次, 不应有记录更新之外的副作用
+func (dao *TXRecordDAO) OptimisticDo(ctx context.Context, txId string, maxRetries int, do func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error) error {
+	if maxRetries <= 0 {
+		maxRetries = DefaultOptimisticRetries
+	}
+	var err error
+	for i := 0; i <= maxRetries; i++ {
+		if i > 0 {
+			timer := time.NewTimer(rand.N(OptimisticBackoff << (i - 1)))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		record := &TXRecordPO{}
+		if err = whereTXId(dao.db.WithContext(ctx), txId).First(record).Error; err != nil {
+			return err
+		}
+		if err = do(ctx, dao, record); !errors.Is(err, ErrVersionConflict) {
+			return err
+		}
+	}
+	return fmt.Errorf("retried %d times: %w", maxRetries, err)
+}
@@ -0,0 +1,115 @@
+package DAO
+
+import (
+	"TCC/pkg"
+	"context"
+	"encoding/json"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// 已归档的事务记录, 既是归档表的行, 也是导出为JSONL时每行的内容
+type TXRecordArchivePO struct {
+	//原事务记录的主键
+	ID                   uint    `gorm:"primarykey;autoIncrement:false" json:"id"`
+	TXId                 string  `gorm:"column:tx_id;uniqueIndex;size:64" json:"tx_id"`
+	Status               string  `gorm:"column:status;size:16" json:"status"`
+	ComponentTryStatuses string  `gorm:"column:component_try_statuses" json:"component_try_statuses,omitempty"`
+	IdempotencyKey       *string `gorm:"column:idempotency_key;size:128" json:"idempotency_key,omitempty"`
+	Version              uint    `gorm:"column:version" json:"version"`
+	//事务所有分支的json数组
+	Branches   json.RawMessage `gorm:"column:branches;type:text" json:"branches"`
+	CreatedAt  time.Time       `gorm:"autoCreateTime:false" json:"created_at"`
+	UpdatedAt  time.Time       `gorm:"autoUpdateTime:false" json:"updated_at"`
+	ArchivedAt time.Time       `gorm:"column:archived_at;index" json:"archived_at"`
+}
+
+func (t TXRecordArchivePO) TableName() string {
+	return "tx_record_archive"
+}
+
+// 由事务记录及其分支构造归档记录, record需通过WithBranches加载分支
+func NewTXRecordArchive(record *TXRecordPO, archivedAt time.Time) *TXRecordArchivePO {
+	branches := record.Branches
+	if branches == nil {
+		branches = []*TXBranchPO{}
+	}
+	body, _ := json.Marshal(branches)
+	return &TXRecordArchivePO{
+		ID:                   record.ID,
+		TXId:                 record.GetTXId(),
+		Status:               record.Status,
+		ComponentTryStatuses: record.ComponentTryStatuses,
+		IdempotencyKey:       record.IdempotencyKey,
+		Version:              record.Version,
+		Branches:             body,
+		CreatedAt:            record.CreatedAt,
+		UpdatedAt:            record.UpdatedAt,
+		ArchivedAt:           archivedAt,
+	}
+}
+
+// 只有已结束的事务可以归档或清除
+var finishedStatuses = []string{pkg.TrySuccess.String(), pkg.TryFailure.String()}
+
+// 将事务记录写入归档表并物理删除原记录及其分支, 两者在同一个数据库事务中完成.
+// 已归档的记录会被跳过, 多个副本同时归档同一批记录是安全的; 返回删除的记录数
+func (dao *TXRecordDAO) ArchiveTXRecords(ctx context.Context, records []*TXRecordPO) (int64, error) {
+	if len(records) == 0 {
+		return 0, nil
+	}
+	archivedAt := time.Now()
+	archives := make([]*TXRecordArchivePO, 0, len(records))
+	for _, record := range records {
+		archives = append(archives, NewTXRecordArchive(record, archivedAt))
+	}
+
+	var purged int64
+	err := dao.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(archives).Error; err != nil {
+			return err
+		}
+		var err error
+		purged, err = NewTXRecordDAO(tx).PurgeTXRecords(ctx, records)
+		return err
+	})
+	return purged, err
+}
+
+// 物理删除已结束的事务记录及其分支, 未结束的记录不会被删除; 返回删除的记录数
+func (dao *TXRecordDAO) PurgeTXRecords(ctx context.Context, records []*TXRecordPO) (int64, error) {
+	if len(records) == 0 {
+		return 0, nil
+	}
+	ids := make([]uint, 0, len(records))
+	for _, record := range records {
+		ids = append(ids, record.ID)
+	}
+
+	var purged int64
+	err := dao.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var finished []*TXRecordPO
+		if err := tx.Unscoped().Select("id", "tx_id").Where("id IN ? AND status IN ?", ids, finishedStatuses).
+			Find(&finished).Error; err != nil || len(finished) == 0 {
+			return err
+		}
+		//tx_id为空的旧记录没有分支, 记录按主键删除
+		finishedIds, txIds := make([]uint, 0, len(finished)), make([]string, 0, len(finished))
+		for _, record := range finished {
+			finishedIds = append(finishedIds, record.ID)
+			if record.TXId != "" {
+				txIds = append(txIds, record.TXId)
+			}
+		}
+		if len(txIds) > 0 {
+			if err := tx.Where("tx_id IN ?", txIds).Delete(&TXBranchPO{}).Error; err != nil {
+				return err
+			}
+		}
+		result := tx.Unscoped().Where("id IN ?", finishedIds).Delete(&TXRecordPO{})
+		purged = result.RowsAffected
+		return result.Error
+	})
+	return purged, err
+}
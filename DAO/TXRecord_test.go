@@ -0,0 +1,127 @@
+package DAO
+
+import (
+	"TCC/pkg"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_update_tx_record_version_conflict(t *testing.T) {
+	dao := newTestDAO(t)
+	ctx := context.Background()
+
+	if _, err := dao.CreateTXRecord(ctx, &TXRecordPO{TXId: "tx1", Status: pkg.TryHanging.String()}); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := dao.GetTXRecords(ctx, WithTXId("tx1"))
+	second, _ := dao.GetTXRecords(ctx, WithTXId("tx1"))
+
+	first[0].Status = pkg.TrySuccess.String()
+	if err := dao.UpdateTXRecord(ctx, first[0]); err != nil {
+		t.Fatal(err)
+	}
+	if first[0].Version != 1 {
+		t.Fatalf("version should be increased, got: %d", first[0].Version)
+	}
+
+	//以过期的版本号更新失败, 版本号保持不变
+	second[0].Status = pkg.TryFailure.String()
+	if err := dao.UpdateTXRecord(ctx, second[0]); !errors.Is(err, ErrVersionConflict) {
+		t.Fatal("expect ErrVersionConflict, got: ", err)
+	}
+	if second[0].Version != 0 {
+		t.Fatalf("version should be restored, got: %d", second[0].Version)
+	}
+}
+
+func Test_optimistic_do_retry(t *testing.T) {
+	dao := newTestDAO(t)
+	ctx := context.Background()
+
+	if _, err := dao.CreateTXRecord(ctx, &TXRecordPO{TXId: "tx1", Status: pkg.TryHanging.String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	//第一次执行时模拟并发更新, 重试后成功
+	calls := 0
+	err := dao.OptimisticDo(ctx, "tx1", 2, func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error {
+		calls++
+		if calls == 1 {
+			if err := dao.ReleaseIdempotencyKey(ctx, "tx1"); err != nil {
+				return err
+			}
+		}
+		record.Status = pkg.TrySuccess.String()
+		return dao.UpdateTXRecord(ctx, record)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _ := dao.GetTXRecords(ctx, WithTXId("tx1"))
+	if calls != 2 || records[0].Status != pkg.TrySuccess.String() || records[0].Version != 2 {
+		t.Fatalf("unexpected result: calls %d, record %+v", calls, records[0])
+	}
+
+	//冲突次数超过上限时返回ErrVersionConflict
+	calls = 0
+	err = dao.OptimisticDo(ctx, "tx1", 2, func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error {
+		calls++
+		_ = dao.ReleaseIdempotencyKey(ctx, "tx1")
+		return dao.UpdateTXRecord(ctx, record)
+	})
+	if !errors.Is(err, ErrVersionConflict) || calls != 3 {
+		t.Fatalf("expect ErrVersionConflict after 3 calls, got: %v, calls %d", err, calls)
+	}
+
+	//等待重试期间ctx结束时直接返回
+	cctx, cancel := context.WithCancel(ctx)
+	calls = 0
+	err = dao.OptimisticDo(cctx, "tx1", 2, func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error {
+		calls++
+		cancel()
+		return ErrVersionConflict
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("expect context.Canceled after 1 call, got: %v, calls %d", err, calls)
+	}
+}
+
+// 引入tx_id之前创建的记录以主键作为事务id, 可以查询、更新与清除
+func Test_legacy_record_without_tx_id(t *testing.T) {
+	dao := newTestDAO(t)
+	ctx := context.Background()
+
+	if err := dao.db.Exec("INSERT INTO TXRecordPO (created_at, updated_at, status) VALUES (?, ?, ?)",
+		time.Now(), time.Now(), pkg.TryHanging.String()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dao.CreateTXRecord(ctx, &TXRecordPO{TXId: "tx1", Status: pkg.TryHanging.String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := dao.GetTXRecords(ctx, WithTXId("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].GetTXId() != "1" {
+		t.Fatalf("legacy record should be found by its id: %+v", records)
+	}
+	err = dao.OptimisticDo(ctx, "1", 0, func(ctx context.Context, dao *TXRecordDAO, record *TXRecordPO) error {
+		record.Status = pkg.TrySuccess.String()
+		return dao.UpdateTXRecord(ctx, record)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, _ = dao.GetTXRecords(ctx, WithTXId("1"))
+	purged, err := dao.PurgeTXRecords(ctx, records)
+	if err != nil || purged != 1 {
+		t.Fatalf("legacy record should be purged, purged: %d, err: %v", purged, err)
+	}
+	if count, _ := dao.CountTXRecords(ctx); count != 1 {
+		t.Fatalf("only the new record should remain, got: %d", count)
+	}
+}
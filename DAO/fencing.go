@@ -0,0 +1,34 @@
+package DAO
+
+import (
+	"TCC/pkg"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrStaleFencingToken = pkg.ErrStaleFencingToken
+
+// 携带fencing token更新记录: 只有记录上token列的值不大于本次token时才会更新, 同时将token列更新为本次token.
+// column按列名引用, 不会拼接进sql; db需要已指定Model和定位记录的条件; 没有记录被更新时说明token已过期, 返回ErrStaleFencingToken
+func FencedUpdates(db *gorm.DB, column string, token int64, values map[string]interface{}) error {
+	if column == "" {
+		return errors.New("fencing column can't be empty")
+	}
+	updates := make(map[string]interface{}, len(values)+1)
+	for k, v := range values {
+		updates[k] = v
+	}
+	updates[column] = token
+
+	col := clause.Column{Name: column}
+	result := db.Where(clause.Or(clause.Eq{Column: col, Value: nil}, clause.Lte{Column: col, Value: token})).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("column:%s token:%d err: %w", column, token, ErrStaleFencingToken)
+	}
+	return nil
+}
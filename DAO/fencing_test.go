@@ -0,0 +1,90 @@
+package DAO
+
+import (
+	"TCC/pkg"
+	"context"
+	"errors"
+	"testing"
+)
+
+func Test_fenced_updates(t *testing.T) {
+	dao := newTestDAO(t)
+	ctx := context.Background()
+
+	if _, err := dao.CreateTXRecord(ctx, &TXRecordPO{TXId: "tx1", Status: pkg.TryHanging.String()}); err != nil {
+		t.Fatal(err)
+	}
+	record := func() *TXRecordPO {
+		records, err := dao.GetTXRecords(ctx, WithTXId("tx1"))
+		if err != nil || len(records) != 1 {
+			t.Fatal("get record: ", err)
+		}
+		return records[0]
+	}
+	update := func(column string, token int64, status pkg.ComponentTryStatus) error {
+		db := dao.db.WithContext(ctx).Model(&TXRecordPO{}).Where("tx_id = ?", "tx1")
+		return FencedUpdates(db, column, token, map[string]interface{}{"status": status.String()})
+	}
+
+	if err := update("fencing_token", 5, pkg.TrySuccess); err != nil {
+		t.Fatal(err)
+	}
+	if got := record(); got.FencingToken != 5 || got.Status != pkg.TrySuccess.String() {
+		t.Fatalf("record should be updated with token 5, got: %d %s", got.FencingToken, got.Status)
+	}
+
+	//更小的token被拒绝, 相同的token可以重复写入
+	if err := update("fencing_token", 4, pkg.TryFailure); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatal("expect ErrStaleFencingToken, got: ", err)
+	}
+	if err := update("fencing_token", 5, pkg.TrySuccess); err != nil {
+		t.Fatal(err)
+	}
+
+	//列名按标识符引用, 不会被当作sql执行
+	if err := update("fencing_token <= 100 OR 1=1 OR fencing_token", 1, pkg.TryFailure); err == nil {
+		t.Fatal("malformed column should fail")
+	}
+	if err := update("", 6, pkg.TryFailure); err == nil {
+		t.Fatal("empty column should fail")
+	}
+	if got := record(); got.FencingToken != 5 || got.Status != pkg.TrySuccess.String() {
+		t.Fatalf("record should not be changed, got: %d %s", got.FencingToken, got.Status)
+	}
+}
+
+func Test_update_tx_status_fenced(t *testing.T) {
+	dao := newTestDAO(t)
+	ctx := context.Background()
+
+	if _, err := dao.CreateTXRecord(ctx, &TXRecordPO{TXId: "tx1", Status: pkg.TryHanging.String()}); err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := dao.GetTXRecords(ctx, WithTXId("tx1"))
+	current, _ := dao.GetTXRecords(ctx, WithTXId("tx1"))
+
+	current[0].Status = pkg.TrySuccess.String()
+	if err := dao.UpdateTXStatusFenced(ctx, current[0], 10); err != nil {
+		t.Fatal(err)
+	}
+	if current[0].Version != 1 || current[0].FencingToken != 10 {
+		t.Fatalf("version and token should be updated, got: %d %d", current[0].Version, current[0].FencingToken)
+	}
+
+	//读取后记录已被修改, 返回版本冲突以便重新读取
+	stale[0].Status = pkg.TryFailure.String()
+	if err := dao.UpdateTXStatusFenced(ctx, stale[0], 20); !errors.Is(err, ErrVersionConflict) {
+		t.Fatal("expect ErrVersionConflict, got: ", err)
+	}
+
+	//重新读取后更小的token被拒绝
+	reread, _ := dao.GetTXRecords(ctx, WithTXId("tx1"))
+	reread[0].Status = pkg.TryFailure.String()
+	if err := dao.UpdateTXStatusFenced(ctx, reread[0], 9); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatal("expect ErrStaleFencingToken, got: ", err)
+	}
+	got, _ := dao.GetTXRecords(ctx, WithTXId("tx1"))
+	if got[0].Status != pkg.TrySuccess.String() {
+		t.Fatalf("stale submit should not change status, got: %s", got[0].Status)
+	}
+}
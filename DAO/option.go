@@ -2,7 +2,11 @@ package DAO
 
 import (
 	"TCC/pkg"
+	"encoding/json"
+	"fmt"
 	"gorm.io/gorm"
+	"strings"
+	"time"
 )
 
 type QueryOption func(db *gorm.DB) *gorm.DB
@@ -13,8 +17,163 @@ func WithID(id uint) QueryOption {
 	}
 }
 
+// 按事务id查询, 同时匹配tx_id为空的旧记录, 见TXRecordPO.GetTXId
+func WithTXId(txId string) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return whereTXId(db, txId)
+	}
+}
+
 func WithStatus(status pkg.ComponentTryStatus) QueryOption {
 	return func(db *gorm.DB) *gorm.DB {
 		return db.Where("status = ?", status.String())
 	}
 }
+
+// 查询状态为其中之一的记录
+func WithStatusIn(statuses ...pkg.ComponentTryStatus) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		values := make([]string, 0, len(statuses))
+		for _, status := range statuses {
+			values = append(values, status.String())
+		}
+		return db.Where("status IN ?", values)
+	}
+}
+
+// 查询属于给定哈希桶的记录, 与WithStatus一同使用时可命中(status, shard_bucket)索引
+func WithShardBuckets(buckets []int) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("shard_bucket IN ?", buckets)
+	}
+}
+
+// 游标分页: 只查询id大于给定值的记录
+func WithIDAfter(id uint) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("id > ?", id)
+	}
+}
+
+func WithCreatedAfter(t time.Time) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("created_at >= ?", t)
+	}
+}
+
+func WithCreatedBefore(t time.Time) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("created_at < ?", t)
+	}
+}
+
+// 游标分页(倒序): 只查询id小于给定值的记录
+func WithIDBefore(id uint) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("id < ?", id)
+	}
+}
+
+func WithUpdatedAfter(t time.Time) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("updated_at >= ?", t)
+	}
+}
+
+func WithUpdatedBefore(t time.Time) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("updated_at < ?", t)
+	}
+}
+
+// 按时间列做游标分页: 只查询(column, id)大于给定游标的记录, 需与WithOrderBy(column, false)配合使用.
+// column只支持created_at与updated_at
+func WithKeysetAfter(column string, t time.Time, id uint) QueryOption {
+	return withKeyset(column, ">", t, id)
+}
+
+// 按时间列倒序做游标分页: 只查询(column, id)小于给定游标的记录, 需与WithOrderBy(column, true)配合使用.
+// column只支持created_at与updated_at
+func WithKeysetBefore(column string, t time.Time, id uint) QueryOption {
+	return withKeyset(column, "<", t, id)
+}
+
+func withKeyset(column, op string, t time.Time, id uint) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		if column != "created_at" && column != "updated_at" {
+			_ = db.AddError(fmt.Errorf("unsupported keyset column: %s", column))
+			return db
+		}
+		return db.Where(fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", column, op, column, op), t, t, id)
+	}
+}
+
+// 可用于排序的列
+var orderableColumns = map[string]bool{
+	"id":         true,
+	"tx_id":      true,
+	"status":     true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// 按给定列排序, 以id作为次级排序保证结果稳定; 不支持的列会使查询返回错误
+func WithOrderBy(column string, desc bool) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		if !orderableColumns[column] {
+			_ = db.AddError(fmt.Errorf("unsupported order column: %s", column))
+			return db
+		}
+		direction := "ASC"
+		if desc {
+			direction = "DESC"
+		}
+		db = db.Order(column + " " + direction)
+		if column != "id" {
+			db = db.Order("id " + direction)
+		}
+		return db
+	}
+}
+
+func WithOrderByID() QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Order("id ASC")
+	}
+}
+
+func WithLimit(limit int) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Limit(limit)
+	}
+}
+
+func WithIdempotencyKey(key string) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("idempotency_key = ?", key)
+	}
+}
+
+// 查询包含指定组件的事务: 在tx_branch中匹配组件id, 旧版本的事务在ComponentTryStatuses的json中匹配
+func WithComponentID(componentID string) QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		id, _ := json.Marshal(componentID)
+		pattern := "%" + likeEscaper.Replace(`"component_id":`+string(id)) + "%"
+		branches := db.Session(&gorm.Session{NewDB: true}).Model(&TXBranchPO{}).Select("tx_id").Where("component_id = ?", componentID)
+		return db.Where(db.Session(&gorm.Session{NewDB: true}).
+			Where("tx_id IN (?)", branches).
+			Or("component_try_statuses LIKE ? ESCAPE '!'", pattern))
+	}
+}
+
+// 同时加载事务的分支
+func WithBranches() QueryOption {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Branches", func(db *gorm.DB) *gorm.DB {
+			return db.Order("id ASC")
+		})
+	}
+}
+
+// 转义LIKE的通配符, 以!作为转义符: 反斜杠在不同数据库的字符串字面量中含义不同
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
@@ -0,0 +1,139 @@
+package DAO
+
+import (
+	"TCC/pkg"
+	"context"
+	"testing"
+	"time"
+)
+
+// 按updated_at创建记录, 返回记录的id
+func createRecordsAt(t *testing.T, dao *TXRecordDAO, times ...time.Time) []uint {
+	ids := make([]uint, 0, len(times))
+	for i, at := range times {
+		record := &TXRecordPO{TXId: "tx" + string(rune('a'+i)), Status: pkg.TryHanging.String()}
+		record.CreatedAt, record.UpdatedAt = at, at
+		id, err := dao.CreateTXRecord(context.Background(), record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func recordIDs(records []*TXRecordPO) []uint {
+	ids := make([]uint, 0, len(records))
+	for _, record := range records {
+		ids = append(ids, record.ID)
+	}
+	return ids
+}
+
+func equalIDs(a, b []uint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 逐页读取, 每页以上一页最后一条记录作为游标
+func pageAll(t *testing.T, dao *TXRecordDAO, desc bool) []uint {
+	ctx := context.Background()
+	var (
+		all    []uint
+		cursor *TXRecordPO
+	)
+	for {
+		opts := []QueryOption{WithOrderBy("updated_at", desc), WithLimit(2)}
+		if cursor != nil {
+			keyset := WithKeysetAfter
+			if desc {
+				keyset = WithKeysetBefore
+			}
+			opts = append(opts, keyset("updated_at", cursor.UpdatedAt, cursor.ID))
+		}
+		records, err := dao.GetTXRecords(ctx, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 0 {
+			return all
+		}
+		all = append(all, recordIDs(records)...)
+		cursor = records[len(records)-1]
+	}
+}
+
+// 时间相同的记录按id排序, 跨页时既不重复也不遗漏
+func Test_keyset_paging_equal_timestamps(t *testing.T) {
+	dao := newTestDAO(t)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := createRecordsAt(t, dao, base.Add(time.Second), base, base, base, base.Add(time.Second))
+
+	asc := []uint{ids[1], ids[2], ids[3], ids[0], ids[4]}
+	if got := pageAll(t, dao, false); !equalIDs(got, asc) {
+		t.Fatalf("unexpected ascending pages, want: %v, got: %v", asc, got)
+	}
+	desc := []uint{ids[4], ids[0], ids[3], ids[2], ids[1]}
+	if got := pageAll(t, dao, true); !equalIDs(got, desc) {
+		t.Fatalf("unexpected descending pages, want: %v, got: %v", desc, got)
+	}
+}
+
+// 不支持的排序列与游标列使查询返回错误, 而不是拼接到SQL中
+func Test_invalid_order_column(t *testing.T) {
+	dao := newTestDAO(t)
+	ctx := context.Background()
+	createRecordsAt(t, dao, time.Now())
+
+	if _, err := dao.GetTXRecords(ctx, WithOrderBy("id; DROP TABLE TXRecordPO", false)); err == nil {
+		t.Fatal("unsupported order column should fail")
+	}
+	if _, err := dao.GetTXRecords(ctx, WithKeysetAfter("status", time.Now(), 0)); err == nil {
+		t.Fatal("unsupported keyset column should fail")
+	}
+	if _, err := dao.GetTXRecords(ctx, WithKeysetBefore("status", time.Now(), 0)); err == nil {
+		t.Fatal("unsupported descending keyset column should fail")
+	}
+	if records, err := dao.GetTXRecords(ctx, WithOrderBy("status", true)); err != nil || len(records) != 1 {
+		t.Fatalf("supported order column should work, records: %d, err: %v", len(records), err)
+	}
+}
+
+// 时间范围为左闭右开区间, id游标分页可倒序进行
+func Test_time_range_and_id_before(t *testing.T) {
+	dao := newTestDAO(t)
+	ctx := context.Background()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := createRecordsAt(t, dao, base, base.Add(time.Minute), base.Add(2*time.Minute))
+
+	records, err := dao.GetTXRecords(ctx, WithUpdatedAfter(base.Add(time.Minute)), WithUpdatedBefore(base.Add(2*time.Minute)), WithOrderByID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recordIDs(records); !equalIDs(got, ids[1:2]) {
+		t.Fatalf("unexpected updated range, want: %v, got: %v", ids[1:2], got)
+	}
+
+	records, err = dao.GetTXRecords(ctx, WithCreatedAfter(base), WithCreatedBefore(base.Add(2*time.Minute)), WithOrderByID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recordIDs(records); !equalIDs(got, ids[:2]) {
+		t.Fatalf("unexpected created range, want: %v, got: %v", ids[:2], got)
+	}
+
+	records, err = dao.GetTXRecords(ctx, WithIDBefore(ids[2]), WithOrderBy("id", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint{ids[1], ids[0]}; !equalIDs(recordIDs(records), want) {
+		t.Fatalf("unexpected id before page, want: %v, got: %v", want, recordIDs(records))
+	}
+}
@@ -0,0 +1,254 @@
+package TCC
+
+import (
+	"TCC/model"
+	"TCC/pkg"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 组件二阶段的执行结果
+type Phase2Outcome string
+
+const (
+	//二阶段尚未执行
+	Phase2Pending   Phase2Outcome = ""
+	Phase2Confirmed Phase2Outcome = "Confirmed"
+	Phase2Cancelled Phase2Outcome = "Cancelled"
+	//二阶段执行失败, 会由轮询继续推进
+	Phase2Failed Phase2Outcome = "Failed"
+)
+
+// 单个组件在事务中的执行结果
+type ComponentResult struct {
+	ComponentId string
+	//try是否被组件确认
+	TryACK bool
+	//try的响应, try报错时为空
+	TryResp *model.TCCResp
+	//try失败的原因, 为*ComponentError; 包装了ErrTryRejected或ErrTryTimeout以及组件返回的原始错误,
+	//try成功但记录组件状态失败时包装储存中心的错误
+	TryErr error
+	//try的耗时
+	TryLatency time.Duration
+
+	//二阶段(confirm/cancel)的结果
+	Phase2        Phase2Outcome
+	Phase2Resp    *model.TCCResp
+	Phase2Err     error
+	Phase2Latency time.Duration
+}
+
+// 分布式事务的执行结果
+type TransactionResult struct {
+	TXId string
+	//所有组件的try是否都成功
+	Successful bool
+	//各个组件的执行结果
+	Components []*ComponentResult
+	//二阶段(confirm/cancel)是否已执行完毕且事务的最终状态已提交.
+	//Done关闭时为false表示本次未能推进到最终状态, 事务会由轮询继续推进, 此时Phase2Err包装ErrTXPending
+	Finished bool
+	//Done关闭时事务在储存中心的状态, 未能查询时为空
+	Status pkg.TXStatus
+	//二阶段推进失败的原因, 失败的事务会由轮询继续推进
+	Phase2Err error
+	//是否为幂等键命中的已有事务, 此时结果来自储存中心
+	Duplicated bool
+}
+
+// 汇总所有组件try失败的原因, 可配合errors.Is/errors.As使用
+func (r *TransactionResult) Err() error {
+	var errs []error
+	for _, component := range r.Components {
+		if component.TryErr != nil {
+			errs = append(errs, component.TryErr)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 根据组件id获取组件的执行结果
+func (r *TransactionResult) Component(componentId string) (*ComponentResult, bool) {
+	for _, component := range r.Components {
+		if component.ComponentId == componentId {
+			return component, true
+		}
+	}
+	return nil, false
+}
+
+func (r *TransactionResult) clone() *TransactionResult {
+	cp := *r
+	cp.Components = make([]*ComponentResult, len(r.Components))
+	for i, component := range r.Components {
+		c := *component
+		cp.Components[i] = &c
+	}
+	return &cp
+}
+
+// 异步事务的句柄, 可以获取try阶段和二阶段的执行结果
+type TXFuture struct {
+	txId string
+
+	//try阶段结束时关闭
+	tryDone chan struct{}
+	//任一组件try失败时关闭
+	tryFailed chan struct{}
+	//幂等命中的句柄会多次刷新状态, 保证channel只关闭一次
+	failOnce sync.Once
+	tryOnce  sync.Once
+	doneOnce sync.Once
+	//二阶段结束时关闭
+	done chan struct{}
+
+	mux    sync.RWMutex
+	result *TransactionResult
+}
+
+func newTXFuture(TXId string) *TXFuture {
+	return &TXFuture{
+		txId:      TXId,
+		tryDone:   make(chan struct{}),
+		tryFailed: make(chan struct{}),
+		done:      make(chan struct{}),
+		result:    &TransactionResult{TXId: TXId},
+	}
+}
+
+// 根据储存中心的事务状态构造幂等命中的句柄, 尚未结束的事务需通过refresh更新
+func newDuplicatedTXFuture(tx pkg.Transaction) *TXFuture {
+	f := newTXFuture(tx.TXid)
+	f.result.Duplicated = true
+	f.refresh(tx)
+	return f
+}
+
+// 以储存中心的事务状态更新句柄: 所有组件try结束时关闭TryDone, 事务结束时关闭Done; 返回事务是否已结束
+func (f *TXFuture) refresh(tx pkg.Transaction) bool {
+	f.mux.Lock()
+	tryFinished, failed := true, false
+	f.result.Components = f.result.Components[:0]
+	for _, component := range tx.ComponentsStatus {
+		result := &ComponentResult{
+			ComponentId: component.ComponentId,
+			TryACK:      component.ComponentStatus == pkg.TrySuccess,
+		}
+		switch component.ComponentStatus {
+		case pkg.TryFailure:
+			result.TryErr = &ComponentError{ComponentId: component.ComponentId, Phase: PhaseTry, Err: ErrTryRejected}
+			failed = true
+		case pkg.TryHanging:
+			tryFinished = false
+		}
+		f.result.Components = append(f.result.Components, result)
+	}
+	finished := tx.TxStatus != pkg.TXHanging
+	f.result.Successful = !failed && (tryFinished || tx.TxStatus == pkg.TXSuccess)
+	f.result.Status = tx.TxStatus
+	f.result.Finished = finished
+	f.mux.Unlock()
+
+	if failed {
+		f.failOnce.Do(func() {
+			close(f.tryFailed)
+		})
+	}
+	if tryFinished || finished {
+		f.tryOnce.Do(func() {
+			close(f.tryDone)
+		})
+	}
+	if finished {
+		f.doneOnce.Do(func() {
+			close(f.done)
+		})
+	}
+	return finished
+}
+
+func (f *TXFuture) TXId() string {
+	return f.txId
+}
+
+func (f *TXFuture) TryDone() <-chan struct{} {
+	return f.tryDone
+}
+
+func (f *TXFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// 获取当前的执行结果快照, 未执行完毕时结果只包含已完成的部分
+func (f *TXFuture) Result() *TransactionResult {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	return f.result.clone()
+}
+
+// 阻塞等待事务的二阶段执行完毕, 结果的Finished为false时事务仍由轮询继续推进
+func (f *TXFuture) Wait(ctx context.Context) (*TransactionResult, error) {
+	select {
+	case <-ctx.Done():
+		return f.Result(), ctx.Err()
+	case <-f.done:
+		return f.Result(), nil
+	}
+}
+
+// try开始前记录参与事务的组件, 各组件的结果在try结束时逐个填入
+func (f *TXFuture) startTry(componentIds []string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.result.Components = make([]*ComponentResult, len(componentIds))
+	for i, componentId := range componentIds {
+		f.result.Components[i] = &ComponentResult{ComponentId: componentId}
+	}
+}
+
+// 记录第i个组件的try结果, try失败时通知等待者事务已失败
+func (f *TXFuture) completeComponentTry(i int, result ComponentResult) {
+	f.mux.Lock()
+	*f.result.Components[i] = result
+	f.mux.Unlock()
+	if result.TryErr != nil {
+		f.failOnce.Do(func() {
+			close(f.tryFailed)
+		})
+	}
+}
+
+func (f *TXFuture) completeTry(successful bool) {
+	f.mux.Lock()
+	f.result.Successful = successful
+	f.mux.Unlock()
+	f.tryOnce.Do(func() {
+		close(f.tryDone)
+	})
+}
+
+func (f *TXFuture) completePhase2(componentId string, outcome Phase2Outcome, resp *model.TCCResp, err error, latency time.Duration) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if component, ok := f.result.Component(componentId); ok {
+		component.Phase2 = outcome
+		component.Phase2Resp = resp
+		component.Phase2Err = err
+		component.Phase2Latency = latency
+	}
+}
+
+// err为空表示事务已到达最终状态
+func (f *TXFuture) complete(status pkg.TXStatus, err error) {
+	f.mux.Lock()
+	f.result.Finished = err == nil
+	f.result.Status = status
+	f.result.Phase2Err = err
+	f.mux.Unlock()
+	f.doneOnce.Do(func() {
+		close(f.done)
+	})
+}
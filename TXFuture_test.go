@@ -0,0 +1,159 @@
+package TCC
+
+import (
+	"TCC/internel"
+	"TCC/model"
+	"TCC/pkg"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_transaction_async_future(t *testing.T) {
+	env := newTestEnv(t)
+	cp1, cp2 := &fakeComponent{id: "cp1", tryDelay: 50 * time.Millisecond}, &fakeComponent{id: "cp2"}
+	tm := env.newManager(t, []model.TCCComponent{cp1, cp2})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	future, err := tm.TransactionAsync(ctx, requests("cp1", "cp2")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//ctx只用于创建事务, 返回后取消不影响事务
+	cancel()
+
+	if got, ok := tm.Future(future.TXId()); !ok || got != future {
+		t.Fatal("in-flight future should be found by TXId")
+	}
+	select {
+	case <-future.TryDone():
+		t.Fatal("try should still be running")
+	default:
+	}
+
+	result, err := future.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Successful || !result.Finished || result.Status != pkg.TXSuccess || result.Err() != nil {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	for _, component := range result.Components {
+		if !component.TryACK || component.Phase2 != Phase2Confirmed {
+			t.Fatalf("unexpected component result: %+v", component)
+		}
+	}
+	select {
+	case <-future.TryDone():
+	default:
+		t.Fatal("try done should be closed after done")
+	}
+
+	//事务结束后句柄被移除
+	eventually(t, func() bool {
+		_, ok := tm.Future(future.TXId())
+		return !ok
+	}, "finished future should be removed")
+}
+
+func Test_transaction_returns_on_first_failure(t *testing.T) {
+	env := newTestEnv(t)
+	block := make(chan struct{})
+	rejecter, slow := &fakeComponent{id: "cp1", tryReject: true}, &fakeComponent{id: "cp2", block: block}
+	tm := env.newManager(t, []model.TCCComponent{rejecter, slow})
+
+	//慢组件忽略ctx, Transaction仍在第一个try失败时返回
+	result, err := tm.Transaction(context.Background(), requests("cp1", "cp2")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Successful || !errors.Is(result.Err(), ErrTryRejected) {
+		t.Fatalf("transaction should fail with rejection: %+v", result)
+	}
+	if component, _ := result.Component("cp2"); component.TryACK || component.TryErr != nil {
+		t.Fatalf("slow component should still be pending: %+v", component)
+	}
+
+	future, ok := tm.Future(result.TXId)
+	if !ok {
+		t.Fatal("future should be tracked until phase2 finished")
+	}
+	close(block)
+	final, err := future.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final.Status != pkg.TXFailure || len(rejecter.cancelled) != 1 || len(slow.cancelled) != 1 {
+		t.Fatalf("TX should be cancelled on all components: %+v", final)
+	}
+}
+
+func Test_transaction_ctx_cancels_tries(t *testing.T) {
+	env := newTestEnv(t)
+	cp := &fakeComponent{id: "cp1", tryDelay: time.Minute}
+	tm := env.newManager(t, []model.TCCComponent{cp})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result, err := tm.Transaction(ctx, requests("cp1")...)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expect DeadlineExceeded, got: ", err)
+	}
+
+	//调用方的ctx结束后try被取消, 事务被回滚
+	eventually(t, func() bool {
+		return env.txStatus(t, result.TXId) == pkg.TXFailure
+	}, "TX should be cancelled after caller ctx ended")
+}
+
+// 记录组件状态或提交事务失败的储存中心
+type failingStore struct {
+	*internel.MockTXStore
+	updateErr error
+	submitErr error
+}
+
+func (s *failingStore) TXUpdate(ctx context.Context, TXId string, componentId string, successful bool) error {
+	if successful && s.updateErr != nil {
+		return s.updateErr
+	}
+	return s.MockTXStore.TXUpdate(ctx, TXId, componentId, successful)
+}
+
+func (s *failingStore) TXSubmit(ctx context.Context, TXId string, successful bool) error {
+	if s.submitErr != nil {
+		return s.submitErr
+	}
+	return s.MockTXStore.TXSubmit(ctx, TXId, successful)
+}
+
+// 未能推进到最终状态时句柄的结果不是已结束, 事务仍处于悬挂状态
+func Test_future_pending_when_store_fails(t *testing.T) {
+	storeErr := errors.New("store unavailable")
+	for name, store := range map[string]*failingStore{
+		"update": {updateErr: storeErr},
+		"submit": {submitErr: storeErr},
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := newTestEnv(t)
+			store.MockTXStore = env.store
+			tm := newManagerWithStore(t, store, []model.TCCComponent{&fakeComponent{id: "cp1"}})
+
+			future, err := tm.TransactionAsync(context.Background(), requests("cp1")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := future.Wait(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Finished || !errors.Is(result.Phase2Err, ErrTXPending) {
+				t.Fatalf("TX should be reported as pending: %+v", result)
+			}
+			if got := env.txStatus(t, future.TXId()); got != pkg.TXHanging {
+				t.Fatalf("TX should still be hanging, got: %s", got)
+			}
+		})
+	}
+}
@@ -4,16 +4,35 @@ import (
 	"TCC/internel"
 	"TCC/model"
 	"TCC/pkg"
+	"TCC/redis_lock"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Options struct {
 	Timeout     time.Duration
 	MonitorTick time.Duration
+	//悬挂事务的分片数, <=1 表示不分片, 由持有全局锁的副本处理所有事务; 最大为pkg.ShardBucketCount
+	ShardCount int
+	//恢复悬挂事务时每批次的最大事务数
+	RecoverBatchSize int
+	//幂等键的保留期, 超过保留期后相同的幂等键会创建新的事务, 过期的幂等键由轮询定期释放
+	IdempotencyRetention time.Duration
+	//幂等命中其他副本上进行中的事务时, 轮询储存中心获取事务进展的间隔
+	ResultPollInterval time.Duration
+	//事务id生成器, 为空时由储存中心生成事务id
+	IDGenerator pkg.IDGenerator
+	//组件的并发限制, 限制所有副本对同一组件同时进行中的try数量
+	ComponentSemaphores map[string]*redis_lock.Semaphore
+	//就绪检查依赖的外部服务, 名称 -> 健康检查
+	HealthCheckers map[string]HealthChecker
+	//后台执行就绪检查的间隔, 检查结果缓存后供metrics读取
+	ReadyCheckInterval time.Duration
 }
 
 type TXManager struct {
@@ -22,6 +41,8 @@ type TXManager struct {
 	opts           *Options                 //额外参数
 	txStore        model.TXStore            //事务储存中心
 	registryCenter *internel.RegistryCenter //注册中心
+	futures        sync.Map                 //进行中的异步事务, TXId -> *TXFuture
+	ready          atomic.Bool              //最近一次后台就绪检查的结果
 }
 
 // 组件的实体
@@ -32,6 +53,78 @@ type ComponentEntity struct {
 
 type Option func(opts *Options)
 
+func WithShardCount(shardCount int) Option {
+	return func(opts *Options) {
+		opts.ShardCount = shardCount
+	}
+}
+
+func WithRecoverBatchSize(batchSize int) Option {
+	return func(opts *Options) {
+		opts.RecoverBatchSize = batchSize
+	}
+}
+
+func WithIdempotencyRetention(retention time.Duration) Option {
+	return func(opts *Options) {
+		opts.IdempotencyRetention = retention
+	}
+}
+
+func WithIDGenerator(generator pkg.IDGenerator) Option {
+	return func(opts *Options) {
+		opts.IDGenerator = generator
+	}
+}
+
+func WithComponentSemaphore(componentId string, semaphore *redis_lock.Semaphore) Option {
+	return func(opts *Options) {
+		if opts.ComponentSemaphores == nil {
+			opts.ComponentSemaphores = make(map[string]*redis_lock.Semaphore)
+		}
+		opts.ComponentSemaphores[componentId] = semaphore
+	}
+}
+
+// 注册就绪检查依赖的外部服务, 如储存中心与组件使用的RedisClient
+func WithHealthChecker(name string, checker HealthChecker) Option {
+	return func(opts *Options) {
+		if opts.HealthCheckers == nil {
+			opts.HealthCheckers = make(map[string]HealthChecker)
+		}
+		opts.HealthCheckers[name] = checker
+	}
+}
+
+// 后台执行就绪检查的间隔, 检查结果缓存后发布到metrics
+func WithReadyCheckInterval(interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.ReadyCheckInterval = interval
+	}
+}
+
+// 幂等命中进行中的事务时轮询储存中心的间隔
+func WithResultPollInterval(interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.ResultPollInterval = interval
+	}
+}
+
+// 单个事务的参数
+type TXOptions struct {
+	//调用方提供的幂等键, 为空表示不设置
+	IdempotencyKey string
+}
+
+type TXOption func(opts *TXOptions)
+
+// 为事务设置调用方提供的幂等键, 保留期内相同幂等键的重复调用会返回已有事务而不会再次执行try
+func WithIdempotencyKey(key string) TXOption {
+	return func(opts *TXOptions) {
+		opts.IdempotencyKey = key
+	}
+}
+
 func NewTXManager(txStore model.TXStore, opts ...Option) *TXManager {
 	ctx, cancel := context.WithCancel(context.Background())
 	tm := &TXManager{
@@ -47,117 +140,332 @@ func NewTXManager(txStore model.TXStore, opts ...Option) *TXManager {
 
 	checkOpt(tm.opts)
 
+	tm.publishMetrics()
+
 	go tm.polling()
+	go tm.checkReadiness()
 
 	return tm
 }
 
-func (tm *TXManager) Transaction(ctx context.Context, reqs ...*model.RequestEntity) (bool, error) {
-	//1.限制分布式事务的执行时长
-	ctx, cancel := context.WithTimeout(tm.ctx, tm.opts.Timeout)
-	defer cancel()
-	//2.获取所有的TCC组件
+// 执行分布式事务, 所有组件try成功或任一组件try失败时立即返回, 二阶段在后台推进.
+// try在ctx下执行, ctx结束时取消尚未完成的try; 提前返回时结果只包含已完成try的组件.
+// try失败不会返回error, 失败原因可通过TransactionResult.Err获取
+func (tm *TXManager) Transaction(ctx context.Context, reqs ...*model.RequestEntity) (*TransactionResult, error) {
+	return tm.TransactionWithOptions(ctx, reqs)
+}
+
+// 携带事务参数执行分布式事务, 语义同Transaction.
+// 幂等命中已有事务时, 已有事务的try结束后返回, 结果来自储存中心
+func (tm *TXManager) TransactionWithOptions(ctx context.Context, reqs []*model.RequestEntity, opts ...TXOption) (*TransactionResult, error) {
+	future, err := tm.transactionAsync(ctx, ctx, reqs, opts...)
+	if err != nil {
+		return nil, err
+	}
+	//只等待try阶段结束, 二阶段在后台推进
+	select {
+	case <-ctx.Done():
+		return future.Result(), ctx.Err()
+	case <-future.tryFailed:
+		return future.Result(), nil
+	case <-future.TryDone():
+		return future.Result(), nil
+	}
+}
+
+// 异步执行分布式事务: 创建事务后立即返回句柄, try和二阶段在后台执行.
+// ctx只用于创建事务, 返回后ctx结束不会影响事务; try的时长由Options.Timeout限制
+func (tm *TXManager) TransactionAsync(ctx context.Context, reqs ...*model.RequestEntity) (*TXFuture, error) {
+	return tm.TransactionAsyncWithOptions(ctx, reqs)
+}
+
+// 携带事务参数异步执行分布式事务, 语义同TransactionAsync
+func (tm *TXManager) TransactionAsyncWithOptions(ctx context.Context, reqs []*model.RequestEntity, opts ...TXOption) (*TXFuture, error) {
+	return tm.transactionAsync(ctx, nil, reqs, opts...)
+}
+
+// tryCtx不为空时, try在tryCtx结束时被取消
+func (tm *TXManager) transactionAsync(ctx context.Context, tryCtx context.Context, reqs []*model.RequestEntity, opts ...TXOption) (*TXFuture, error) {
+	txOpts := &TXOptions{}
+	for _, opt := range opts {
+		opt(txOpts)
+	}
+
+	//1.获取所有的TCC组件
 	componententities, err := tm.getcomponents(ctx, reqs...)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	//2.生成事务id, 未配置生成器时由储存中心生成
+	var TXId string
+	if tm.opts.IDGenerator != nil {
+		if TXId, err = tm.opts.IDGenerator.NextID(); err != nil {
+			return nil, err
+		}
 	}
-	//3.创建事务
-	TXId, err := tm.txStore.CreateTX(ctx, toTCCComponents(componententities)...)
+	//3.创建事务, 携带幂等键时重复调用直接返回已有事务
+	if key := txOpts.IdempotencyKey; key != "" {
+		var created bool
+		TXId, created, err = tm.txStore.CreateTXWithKey(ctx, TXId, key, tm.opts.IdempotencyRetention, toTCCComponents(componententities)...)
+		if err != nil {
+			return nil, err
+		}
+		if !created {
+			return tm.existingFuture(ctx, TXId)
+		}
+	} else {
+		TXId, err = tm.txStore.CreateTX(ctx, TXId, toTCCComponents(componententities)...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	future := newTXFuture(TXId)
+	tm.futures.Store(TXId, future)
+	go func() {
+		defer tm.futures.Delete(TXId)
+		//4.限制分布式事务的执行时长
+		tctx, cancel := context.WithTimeout(tm.ctx, tm.opts.Timeout)
+		defer cancel()
+		if tryCtx != nil {
+			//调用方ctx结束的原因(如超时)作为try被取消的原因, 见tryErr
+			var cancelCause context.CancelCauseFunc
+			tctx, cancelCause = context.WithCancelCause(tctx)
+			defer cancelCause(nil)
+			stop := context.AfterFunc(tryCtx, func() {
+				cancelCause(context.Cause(tryCtx))
+			})
+			defer stop()
+		}
+		//5.开启两阶段
+		tm.twoPhaseCommit(tctx, future, componententities)
+	}()
+	return future, nil
+}
+
+// 获取进行中的异步事务句柄, 事务结束后句柄会被移除
+func (tm *TXManager) Future(TXId string) (*TXFuture, bool) {
+	future, ok := tm.futures.Load(TXId)
+	if !ok {
+		return nil, false
+	}
+	return future.(*TXFuture), true
+}
+
+// 获取已存在事务的句柄: 本副本上进行中的事务直接返回其句柄, 否则根据储存中心的状态构造句柄.
+// 事务尚未结束时(如在其他副本上执行), 句柄在后台轮询储存中心直到事务结束
+func (tm *TXManager) existingFuture(ctx context.Context, TXId string) (*TXFuture, error) {
+	if future, ok := tm.Future(TXId); ok {
+		return future, nil
+	}
+	tx, err := tm.txStore.GetTX(ctx, TXId)
+	if err != nil {
+		return nil, err
+	}
+	future := newDuplicatedTXFuture(tx)
+	if tx.TxStatus == pkg.TXHanging {
+		go tm.trackDuplicatedTX(future)
+	}
+	return future, nil
+}
+
+// 轮询储存中心更新幂等命中的句柄, 直到事务结束或TXManager停止
+func (tm *TXManager) trackDuplicatedTX(future *TXFuture) {
+	ticker := time.NewTicker(tm.opts.ResultPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tm.ctx.Done():
+			return
+		case <-ticker.C:
+			tx, err := tm.txStore.GetTX(tm.ctx, future.TXId())
+			if err != nil {
+				continue
+			}
+			if future.refresh(tx) {
+				return
+			}
+		}
+	}
+}
+
+// 从储存中心查询事务的状态
+func (tm *TXManager) GetTransaction(ctx context.Context, TXId string) (pkg.Transaction, error) {
+	return tm.txStore.GetTX(ctx, TXId)
+}
+
+// 完成事务的第一阶段提交: try, 并在后台推进二阶段; 任一组件try失败时立即返回
+func (tm *TXManager) TwoPhaseCommit(ctx context.Context, TXId string, componentEnities []ComponentEntity) (*TransactionResult, error) {
+	future := newTXFuture(TXId)
+	go tm.twoPhaseCommit(ctx, future, componentEnities)
+	select {
+	case <-future.tryFailed:
+	case <-future.TryDone():
+	}
+	return future.Result(), nil
+}
+
+func (tm *TXManager) twoPhaseCommit(ctx context.Context, future *TXFuture, componentEnities []ComponentEntity) {
+	successful := tm.tryAll(ctx, future, componentEnities)
+	future.completeTry(successful)
+
+	err := tm.advanceProgressByTXId(future.TXId(), future.completePhase2)
 	if err != nil {
-		return false, err
+		log.Println("advanceProgressByTXId:", err)
+	}
+	var status pkg.TXStatus
+	tx, getErr := tm.txStore.GetTX(tm.ctx, future.TXId())
+	if getErr == nil {
+		status = tx.TxStatus
 	}
-	//开启两阶段
-	return tm.TwoPhaseCommit(ctx, TXId, componententities)
+	//记录组件状态或提交事务失败时事务仍处于悬挂状态, 不能视为已结束
+	switch {
+	case err != nil:
+		err = fmt.Errorf("%w: %w", ErrTXPending, err)
+	case getErr != nil:
+		err = fmt.Errorf("%w: get tx: %w", ErrTXPending, getErr)
+	case status == pkg.TXHanging:
+		err = ErrTXPending
+	}
+	future.complete(status, err)
 }
 
-// 完成事务的第一阶段提交: try
-func (tm *TXManager) TwoPhaseCommit(ctx context.Context, TXId string, componentEnities []ComponentEntity) (bool, error) {
+// 向所有组件发送try请求, 任一try失败时取消其余的try
+func (tm *TXManager) tryAll(ctx context.Context, future *TXFuture, componentEnities []ComponentEntity) bool {
 	//对两阶段提交的上下文控制
-	cctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	cctx, cancelCause := context.WithCancelCause(ctx)
+	defer cancelCause(nil)
+	//任一try失败时以errTryAborted取消其余的try, 与超时区分
+	cancel := func() {
+		cancelCause(errTryAborted)
+	}
 
-	//创建一个error channel能够在任何try失败时即使取得消息
-	errchan := make(chan error)
+	//try被取消后仍需记录组件的状态, 状态更新不随try取消
+	sctx := context.WithoutCancel(ctx)
+	TXId := future.TXId()
+	componentIds := make([]string, len(componentEnities))
+	for i, componentEntity := range componentEnities {
+		componentIds[i] = componentEntity.Component.ID()
+	}
+	future.startTry(componentIds)
 
-	//向所有组件发送try请求
-	go func() {
-		wg := sync.WaitGroup{}
-		for _, componentEntity := range componentEnities {
-			wg.Add(1)
-			go func() {
-				defer wg.Done() //defer保证了即使某些try请求发生错误也能执行Done(),保证waitgroup不会阻塞
-				resp, err := componentEntity.Component.Try(cctx, &model.TCCReq{
-					TXId:        TXId,
-					Componentid: componentEntity.Component.ID(),
-					RequestArg:  componentEntity.Request,
-				})
-				if err != nil && !resp.ACK {
-					_ = tm.txStore.TXUpdate(cctx, TXId, componentEntity.Component.ID(), false) //try失败,更新component的状态
-					errchan <- fmt.Errorf("component:%v update failed: %v", componentEntity.Component.ID(), err)
+	results := make([]*ComponentResult, len(componentEnities))
+	wg := sync.WaitGroup{}
+	for i, componentEntity := range componentEnities {
+		results[i] = &ComponentResult{ComponentId: componentIds[i]}
+		wg.Add(1)
+		go func() {
+			defer wg.Done() //defer保证了即使某些try请求发生错误也能执行Done(),保证waitgroup不会阻塞
+			result := results[i]
+			defer func() {
+				future.completeComponentTry(i, *result)
+			}()
+			start := time.Now()
+			//受并发限制的组件需要先取得许可
+			if semaphore, ok := tm.opts.ComponentSemaphores[result.ComponentId]; ok {
+				permit, err := semaphore.Acquire(cctx)
+				if err != nil {
+					cancel()
+					_ = tm.txStore.TXUpdate(sctx, TXId, result.ComponentId, false)
+					result.TryErr = &ComponentError{ComponentId: result.ComponentId, Phase: PhaseTry, Err: tryErr(cctx, err)}
+					_ = tm.txStore.TXRecordFailure(sctx, TXId, result.ComponentId, result.TryErr)
 					return
 				}
-				//try成功，更新component的状态
-				if err := tm.txStore.TXUpdate(cctx, TXId, componentEntity.Component.ID(), true); err != nil {
-					errchan <- fmt.Errorf("component:%v update failed: %v", componentEntity.Component.ID(), err)
-				}
-			}()
-		}
-		wg.Wait()
-		close(errchan)
-	}()
+				defer func() {
+					_ = semaphore.Release(context.WithoutCancel(cctx), permit)
+				}()
+			}
+			resp, err := componentEntity.Component.Try(cctx, &model.TCCReq{
+				TXId:        TXId,
+				Componentid: componentEntity.Component.ID(),
+				RequestArg:  componentEntity.Request,
+			})
+			result.TryLatency = time.Since(start)
+			result.TryResp = resp
+			if err != nil || resp == nil || !resp.ACK {
+				cancel()                                                       //不能直接返回，因为还需要推进事务，对所有try逐渐进行cancel
+				_ = tm.txStore.TXUpdate(sctx, TXId, result.ComponentId, false) //try失败,更新component的状态
+				result.TryErr = &ComponentError{ComponentId: result.ComponentId, Phase: PhaseTry, Err: tryErr(cctx, err)}
+				_ = tm.txStore.TXRecordFailure(sctx, TXId, result.ComponentId, result.TryErr)
+				return
+			}
+			//try成功，更新component的状态
+			if err := tm.txStore.TXUpdate(sctx, TXId, result.ComponentId, true); err != nil {
+				cancel()
+				result.TryErr = &ComponentError{ComponentId: result.ComponentId, Phase: PhaseTry, Err: fmt.Errorf("update status: %w", err)}
+				return
+			}
+			result.TryACK = true
+		}()
+	}
+	wg.Wait()
 
 	successful := true
-	if err := <-errchan; err != nil {
-		cancel()
-		successful = false //不能直接返回，因为还需要推进事务，对所有try逐渐进行cancel
+	for _, result := range results {
+		successful = successful && result.TryErr == nil
 	}
+	return successful
+}
 
-	go func() {
-		err := tm.advanceProgressByTXId(TXId)
-		if err != nil {
-			log.Println("advanceProgressByTXId:", err)
-		}
-	}()
-	return successful, nil
+// 其他组件的try失败, 其余的try被取消
+var errTryAborted = errors.New("try aborted by another component")
+
+// 将try的失败原因归类为ErrTryTimeout或ErrTryRejected, 原始错误同样可通过errors.Is/errors.As取出.
+// try的ctx被取消时以取消的原因归类: 事务超时或调用方ctx超时归为ErrTryTimeout, 其他组件失败或调用方主动取消归为ErrTryRejected
+func tryErr(ctx context.Context, err error) error {
+	if err == nil {
+		return ErrTryRejected
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTryTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", ErrTryRejected, err)
 }
 
+// 组件二阶段执行结果的观察者
+type phase2Observer func(componentId string, outcome Phase2Outcome, resp *model.TCCResp, err error, latency time.Duration)
+
 // 根据事务id取出当前事务
-func (tm *TXManager) advanceProgressByTXId(TXId string) error {
+func (tm *TXManager) advanceProgressByTXId(TXId string, observers ...phase2Observer) error {
 	tx, err := tm.txStore.GetTX(tm.ctx, TXId)
 	if err != nil {
 		return err
 	}
-	return tm.advanceProgress(tx)
+	return tm.advanceProgress(tm.ctx, tx, 0, observers...)
 }
 
-// 根据事务完成所有组件的第二次提交和事务的最终提交
-func (tm *TXManager) advanceProgress(tx pkg.Transaction) error {
+// 根据事务完成所有组件的第二次提交和事务的最终提交, fencingToken大于0时携带该token提交事务状态
+func (tm *TXManager) advanceProgress(ctx context.Context, tx pkg.Transaction, fencingToken int64, observers ...phase2Observer) error {
 	txstatus := tx.GetStatus(time.Now().Add(-tm.opts.MonitorTick))
 	if txstatus == pkg.TXHanging {
 		return nil //事务悬挂则不处理
 	}
 
 	success := txstatus == pkg.TXSuccess
+	phase, phase2Outcome := PhaseCancel, Phase2Cancelled
+	if success {
+		phase, phase2Outcome = PhaseConfirm, Phase2Confirmed
+	}
 	var cancelOrCommit func(ctx context.Context, component model.TCCComponent) (*model.TCCResp, error)
 	var TXcommit func(ctx context.Context) error
 	if success {
 		//组件的第二次commit: confirm
 		cancelOrCommit = func(ctx context.Context, component model.TCCComponent) (*model.TCCResp, error) {
-			return component.Confirm(ctx, component.ID())
+			return component.Confirm(ctx, tx.TXid)
 		}
 
 		//事务的最终提交: 成功
 		TXcommit = func(ctx context.Context) error {
-			return tm.txStore.TXSubmit(ctx, tx.TXid, true)
+			return tm.submitTX(ctx, tx.TXid, true, fencingToken)
 		}
 	} else {
 		//组件的第二次 commit: cancel
 		cancelOrCommit = func(ctx context.Context, component model.TCCComponent) (*model.TCCResp, error) {
-			return component.Cancel(ctx, component.ID())
+			return component.Cancel(ctx, tx.TXid)
 		}
 
 		TXcommit = func(ctx context.Context) error {
-			return tm.txStore.TXSubmit(ctx, tx.TXid, false)
+			return tm.submitTX(ctx, tx.TXid, false, fencingToken)
 		}
 	}
 
@@ -167,16 +475,37 @@ func (tm *TXManager) advanceProgress(tx pkg.Transaction) error {
 		if err != nil {
 			return err
 		}
-		Resp, err := cancelOrCommit(tm.ctx, component[0])
+		start := time.Now()
+		Resp, err := cancelOrCommit(ctx, component[0])
+		if err == nil && (Resp == nil || !Resp.ACK) {
+			err = fmt.Errorf("component:%v has not ACK", entity.ComponentId)
+		}
+		outcome := phase2Outcome
+		if err != nil {
+			outcome = Phase2Failed
+			err = &ComponentError{ComponentId: entity.ComponentId, Phase: phase, Err: err}
+		}
+		for _, observe := range observers {
+			observe(entity.ComponentId, outcome, Resp, err, time.Since(start))
+		}
 		if err != nil {
+			_ = tm.txStore.TXRecordFailure(ctx, tx.TXid, entity.ComponentId, err)
 			return err
 		}
-		if Resp.ACK == false {
-			return fmt.Errorf("component:%v has not ACK", entity.ComponentId)
+		//记录失败时返回错误, 之后的轮询会再次执行幂等的二阶段并重新记录
+		if err := tm.txStore.TXPhase2Update(ctx, tx.TXid, entity.ComponentId, success); err != nil {
+			return fmt.Errorf("update phase2 status of component:%v: %w", entity.ComponentId, err)
 		}
 	}
 
-	return TXcommit(tm.ctx)
+	return TXcommit(ctx)
+}
+
+func (tm *TXManager) submitTX(ctx context.Context, TXId string, success bool, fencingToken int64) error {
+	if fencingToken > 0 {
+		return tm.txStore.TXSubmitFenced(ctx, TXId, success, fencingToken)
+	}
+	return tm.txStore.TXSubmit(ctx, TXId, success)
 }
 
 // 轮询: try成功后会不断轮询进行二阶段提交，保证各个组件的cancelOrCommit行为能够有效执行，不会因为网络波动而影响最终执行结果
@@ -194,23 +523,104 @@ func (tm *TXManager) polling() {
 		case <-tm.ctx.Done():
 			return
 		case <-time.After(tick):
-			if err := tm.txStore.Lock(tm.ctx, tm.opts.MonitorTick); err != nil {
-				continue
-			}
-			var txs []*pkg.Transaction
-			txs, err = tm.txStore.GetHangingTXs(tm.ctx)
-			if err != nil {
-				_ = tm.txStore.Unlock(tm.ctx)
-				continue
-			}
-			err = tm.ReCommitAllTransaction(txs)
+			err = tm.recoverHangingTXs()
+			tm.releaseExpiredIdempotencyKeys()
+		}
+	}
+}
+
+// 释放超过保留期的幂等键, 幂等键在创建事务时也会按保留期检查, 这里只是及时回收
+func (tm *TXManager) releaseExpiredIdempotencyKeys() {
+	if _, err := tm.txStore.ReleaseExpiredIdempotencyKeys(tm.ctx, time.Now().Add(-tm.opts.IdempotencyRetention)); err != nil {
+		log.Println("releaseExpiredIdempotencyKeys:", err)
+	}
+}
+
+// 恢复悬挂事务: 分片模式下逐个认领分片的租约, 未认领到的分片由其他副本负责
+func (tm *TXManager) recoverHangingTXs() error {
+	if tm.opts.ShardCount <= 1 {
+		lease, err := tm.txStore.Lock(tm.ctx, tm.opts.MonitorTick)
+		if err != nil {
+			return nil //锁被其他副本持有
+		}
+		defer func() {
 			_ = tm.txStore.Unlock(tm.ctx)
+		}()
+		ctx, cancel := tm.lockedContext(lease.Lost)
+		defer cancel()
+		return tm.recoverShard(ctx, lease.FencingToken)
+	}
+
+	var firstErr error
+	for shard := 0; shard < tm.opts.ShardCount; shard++ {
+		lease, err := tm.txStore.LockShard(tm.ctx, shard, tm.opts.MonitorTick)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := tm.lockedContext(lease.Lost)
+		err = tm.recoverShard(ctx, lease.FencingToken, pkg.WithShard(shard, tm.opts.ShardCount))
+		cancel()
+		_ = tm.txStore.UnlockShard(tm.ctx, shard)
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
+	return firstErr
+}
+
+// 锁丢失时取消返回的ctx, 中止当前的恢复批次, 避免与取得锁的其他副本同时推进事务
+func (tm *TXManager) lockedContext(lost <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(tm.ctx)
+	go func() {
+		select {
+		case <-lost:
+			log.Println("recover: lock lost, abort current batch")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// 分页取出悬挂事务并逐批推进, 保证内存占用有上限; 事务状态携带租约的fencing token提交
+func (tm *TXManager) recoverShard(ctx context.Context, fencingToken int64, opts ...pkg.HangingTXOption) error {
+	//只处理本轮开始前创建的事务, 避免新事务使遍历无法结束
+	createdBefore := time.Now()
+	var cursor string
+	var firstErr error
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		queryOpts := make([]pkg.HangingTXOption, 0, len(opts)+3)
+		queryOpts = append(queryOpts, opts...)
+		queryOpts = append(queryOpts,
+			pkg.WithPageLimit(tm.opts.RecoverBatchSize),
+			pkg.WithPageCursor(cursor),
+			pkg.WithCreatedBefore(createdBefore),
+		)
+
+		txs, nextCursor, err := tm.txStore.GetHangingTXs(ctx, queryOpts...)
+		if err != nil {
+			return err
+		}
+		if err := tm.reCommitTransactions(ctx, txs, fencingToken); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if nextCursor == "" {
+			return firstErr
+		}
+		cursor = nextCursor
+	}
 }
 
 // 对选中的所有事务进行二阶段提交
-func (tm *TXManager) ReCommitAllTransaction(txs []*pkg.Transaction) error {
+func (tm *TXManager) ReCommitAllTransaction(ctx context.Context, txs []*pkg.Transaction) error {
+	return tm.reCommitTransactions(ctx, txs, 0)
+}
+
+// fencingToken大于0时携带该token提交事务状态
+func (tm *TXManager) reCommitTransactions(ctx context.Context, txs []*pkg.Transaction, fencingToken int64) error {
 	errchan := make(chan error)
 	go func() {
 		wg := sync.WaitGroup{}
@@ -218,7 +628,7 @@ func (tm *TXManager) ReCommitAllTransaction(txs []*pkg.Transaction) error {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				if err := tm.advanceProgress(*tx); err != nil {
+				if err := tm.advanceProgress(ctx, *tx, fencingToken); err != nil {
 					errchan <- err
 				}
 			}()
@@ -255,7 +665,7 @@ func (tm *TXManager) getcomponents(ctx context.Context, reqs ...*model.RequestEn
 	return componententities, nil
 }
 
-func (tm TXManager) backOffTick(tick time.Duration) time.Duration {
+func (tm *TXManager) backOffTick(tick time.Duration) time.Duration {
 	maxTick := tm.opts.MonitorTick << 3
 	tick <<= 1
 	if tick > maxTick {
@@ -281,4 +691,19 @@ func checkOpt(opts *Options) {
 	if opts.MonitorTick <= 0 {
 		opts.MonitorTick = 10 * time.Second
 	}
+	if opts.ShardCount > pkg.ShardBucketCount {
+		opts.ShardCount = pkg.ShardBucketCount
+	}
+	if opts.RecoverBatchSize <= 0 {
+		opts.RecoverBatchSize = 100
+	}
+	if opts.IdempotencyRetention <= 0 {
+		opts.IdempotencyRetention = 24 * time.Hour
+	}
+	if opts.ResultPollInterval <= 0 {
+		opts.ResultPollInterval = time.Second
+	}
+	if opts.ReadyCheckInterval <= 0 {
+		opts.ReadyCheckInterval = 10 * time.Second
+	}
 }
@@ -0,0 +1,490 @@
+package TCC
+
+import (
+	"TCC/DAO"
+	"TCC/internel"
+	"TCC/model"
+	"TCC/pkg"
+	"TCC/redis_lock"
+	"TCC/testutil"
+	"TCC/testutil/memlock"
+	"TCC/third_party"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 行为可控的组件
+type fakeComponent struct {
+	id string
+
+	mux sync.Mutex
+	//try的返回值, tryErr为空且tryReject为false时确认try
+	tryErr    error
+	tryReject bool
+	//try的阻塞时间, 期间ctx结束则返回ctx的错误
+	tryDelay time.Duration
+	//不为空时try忽略ctx, 阻塞到block关闭
+	block chan struct{}
+	//confirm的阻塞时间, 期间ctx结束则返回ctx的错误
+	confirmDelay time.Duration
+	//二阶段的返回错误
+	confirmErr error
+	cancelErr  error
+	confirmed  []string
+	cancelled  []string
+	//同时进行中的try数量及其最大值
+	inflight    int
+	maxInflight int
+}
+
+func (c *fakeComponent) ID() string {
+	return c.id
+}
+
+func (c *fakeComponent) Try(ctx context.Context, req *model.TCCReq) (*model.TCCResp, error) {
+	c.mux.Lock()
+	tryErr, reject, delay, block := c.tryErr, c.tryReject, c.tryDelay, c.block
+	c.inflight++
+	c.maxInflight = max(c.maxInflight, c.inflight)
+	c.mux.Unlock()
+	defer func() {
+		c.mux.Lock()
+		c.inflight--
+		c.mux.Unlock()
+	}()
+
+	if block != nil {
+		<-block
+	}
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	if tryErr != nil {
+		return nil, tryErr
+	}
+	return &model.TCCResp{TXId: req.TXId, Componentid: c.id, ACK: !reject}, nil
+}
+
+func (c *fakeComponent) Confirm(ctx context.Context, txId string) (*model.TCCResp, error) {
+	c.mux.Lock()
+	c.confirmed = append(c.confirmed, txId)
+	delay, confirmErr := c.confirmDelay, c.confirmErr
+	c.mux.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	if confirmErr != nil {
+		return nil, confirmErr
+	}
+	return &model.TCCResp{TXId: txId, Componentid: c.id, ACK: true}, nil
+}
+
+func (c *fakeComponent) Cancel(ctx context.Context, txId string) (*model.TCCResp, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.cancelled = append(c.cancelled, txId)
+	if c.cancelErr != nil {
+		return nil, c.cancelErr
+	}
+	return &model.TCCResp{TXId: txId, Componentid: c.id, ACK: true}, nil
+}
+
+type testEnv struct {
+	db     *gorm.DB
+	client *memlock.Client
+	clock  *memlock.FakeClock
+	store  *internel.MockTXStore
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	db := testutil.NewDB(t, &DAO.TXRecordPO{}, &DAO.TXBranchPO{})
+	clock := memlock.NewFakeClock(time.Now())
+	client := memlock.NewClient(clock)
+	return &testEnv{
+		db:     db,
+		client: client,
+		clock:  clock,
+		store:  internel.NewMockTXStore(DAO.NewTXRecordDAO(db), client),
+	}
+}
+
+// 共用数据库与redis的另一个储存中心, 模拟其他副本
+func (e *testEnv) newReplicaStore() *internel.MockTXStore {
+	return internel.NewMockTXStore(DAO.NewTXRecordDAO(e.db), e.client)
+}
+
+func (e *testEnv) newManager(t *testing.T, components []model.TCCComponent, opts ...Option) *TXManager {
+	return newManagerWithStore(t, e.store, components, opts...)
+}
+
+func newManagerWithStore(t *testing.T, store model.TXStore, components []model.TCCComponent, opts ...Option) *TXManager {
+	tm := NewTXManager(store, opts...)
+	t.Cleanup(tm.stop)
+	for _, component := range components {
+		if err := tm.registryCenter.Register(component); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tm
+}
+
+// 创建try均已成功、尚未推进二阶段的悬挂事务
+func (e *testEnv) createTriedTX(t *testing.T, txId string, components ...model.TCCComponent) {
+	ctx := context.Background()
+	if _, err := e.store.CreateTX(ctx, txId, components...); err != nil {
+		t.Fatal(err)
+	}
+	for _, component := range components {
+		if err := e.store.TXUpdate(ctx, txId, component.ID(), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (e *testEnv) txStatus(t *testing.T, txId string) pkg.TXStatus {
+	tx, err := e.store.GetTX(context.Background(), txId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx.TxStatus
+}
+
+func Test_recover_hanging_txs_by_shard(t *testing.T) {
+	env := newTestEnv(t)
+	cp := &fakeComponent{id: "cp1"}
+	tm := env.newManager(t, []model.TCCComponent{cp}, WithShardCount(4), WithRecoverBatchSize(1))
+
+	//每个分片至少两个事务, 批次大小为1时需要翻页
+	shards := make(map[string]int)
+	count := make(map[int]int)
+	for i := 0; len(count) < 4 || minCount(count) < 2; i++ {
+		txId := fmt.Sprintf("tx-%d", i)
+		shard := pkg.ShardOf(txId, 4)
+		shards[txId] = shard
+		count[shard]++
+		env.createTriedTX(t, txId, cp)
+	}
+
+	//其他副本持有分片1的租约, 本副本跳过该分片
+	replica := env.newReplicaStore()
+	if _, err := replica.LockShard(context.Background(), 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.recoverHangingTXs(); err != nil {
+		t.Fatal(err)
+	}
+	for txId, shard := range shards {
+		expect := pkg.TXSuccess
+		if shard == 1 {
+			expect = pkg.TXHanging
+		}
+		if status := env.txStatus(t, txId); status != expect {
+			t.Fatalf("TX %s of shard %d: expect %s, got %s", txId, shard, expect, status)
+		}
+	}
+
+	//租约过期后分片可以被本副本认领
+	env.clock.Advance(2 * time.Second)
+	if err := tm.recoverHangingTXs(); err != nil {
+		t.Fatal(err)
+	}
+	for txId := range shards {
+		if status := env.txStatus(t, txId); status != pkg.TXSuccess {
+			t.Fatalf("TX %s should be recovered after lease expired, got %s", txId, status)
+		}
+	}
+	if len(cp.confirmed) != len(shards) {
+		t.Fatalf("each TX should be confirmed once, got %d confirms for %d TXs", len(cp.confirmed), len(shards))
+	}
+
+	//本副本释放了所有租约, 其他副本可以认领
+	for shard := 0; shard < 4; shard++ {
+		if _, err := replica.LockShard(context.Background(), shard, time.Second); err != nil && shard != 1 {
+			t.Fatalf("shard %d should be released: %v", shard, err)
+		}
+	}
+}
+
+func Test_recover_hanging_txs_global_lock(t *testing.T) {
+	env := newTestEnv(t)
+	cp := &fakeComponent{id: "cp1"}
+	tm := env.newManager(t, []model.TCCComponent{cp}, WithRecoverBatchSize(2))
+	for i := 0; i < 5; i++ {
+		env.createTriedTX(t, fmt.Sprintf("tx-%d", i), cp)
+	}
+
+	//其他副本持有全局锁时不处理任何事务
+	replica := env.newReplicaStore()
+	if _, err := replica.Lock(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.recoverHangingTXs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.confirmed) != 0 {
+		t.Fatalf("no TX should be recovered without the lock, got %v", cp.confirmed)
+	}
+
+	if err := replica.Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.recoverHangingTXs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.confirmed) != 5 {
+		t.Fatalf("all TXs should be recovered, got %v", cp.confirmed)
+	}
+}
+
+func requests(componentIds ...string) []*model.RequestEntity {
+	reqs := make([]*model.RequestEntity, 0, len(componentIds))
+	for _, componentId := range componentIds {
+		reqs = append(reqs, &model.RequestEntity{ComponentId: componentId, Request: map[string]interface{}{}})
+	}
+	return reqs
+}
+
+// 等待条件成立, 超时则失败
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func minCount(count map[int]int) int {
+	m := -1
+	for _, c := range count {
+		if m < 0 || c < m {
+			m = c
+		}
+	}
+	return m
+}
+
+func Test_phase2_receives_tx_id(t *testing.T) {
+	env := newTestEnv(t)
+	confirmer, canceller := &fakeComponent{id: "cp1"}, &fakeComponent{id: "cp2", tryReject: true}
+	tm := env.newManager(t, []model.TCCComponent{confirmer, canceller})
+
+	for _, componentId := range []string{"cp1", "cp2"} {
+		future, err := tm.TransactionAsync(context.Background(), requests(componentId)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = future.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		component := confirmer
+		calls := &confirmer.confirmed
+		if componentId == "cp2" {
+			component, calls = canceller, &canceller.cancelled
+		}
+		component.mux.Lock()
+		got := *calls
+		component.mux.Unlock()
+		if len(got) != 1 || got[0] != future.TXId() {
+			t.Fatalf("%s phase2 should receive TX id %s, got: %v", componentId, future.TXId(), got)
+		}
+	}
+}
+
+// 分支记录二阶段结果与失败执行的原因
+func Test_branch_records_phase2_and_failures(t *testing.T) {
+	env := newTestEnv(t)
+	confirmer, failer := &fakeComponent{id: "cp1"}, &fakeComponent{id: "cp2", tryErr: errors.New("boom")}
+	tm := env.newManager(t, []model.TCCComponent{confirmer, failer})
+	dao := DAO.NewTXRecordDAO(env.db)
+
+	branches := func(reqs ...*model.RequestEntity) map[string]*DAO.TXBranchPO {
+		future, err := tm.TransactionAsync(context.Background(), reqs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = future.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		pos, err := dao.GetTXBranches(context.Background(), future.TXId())
+		if err != nil {
+			t.Fatal(err)
+		}
+		branches := make(map[string]*DAO.TXBranchPO)
+		for _, po := range pos {
+			branches[po.ComponentID] = po
+		}
+		return branches
+	}
+
+	confirmed := branches(requests("cp1")...)["cp1"]
+	if confirmed.Phase2Status != DAO.BranchPhase2Confirmed || confirmed.Attempts != 2 {
+		t.Fatalf("unexpected confirmed branch: %+v", confirmed)
+	}
+
+	cancelled := branches(requests("cp1", "cp2")...)
+	if cancelled["cp1"].Phase2Status != DAO.BranchPhase2Cancelled {
+		t.Fatalf("unexpected cancelled branch: %+v", cancelled["cp1"])
+	}
+	//失败的try与之后的cancel各计一次执行, cancel成功后保留try失败的原因
+	failed := cancelled["cp2"]
+	if failed.TryStatus != pkg.TryFailure.String() || !strings.Contains(failed.LastError, "boom") || failed.Attempts != 2 {
+		t.Fatalf("failed try should be recorded on the branch: %+v", failed)
+	}
+}
+
+// 引入tx_id之前创建的悬挂事务没有tx_id, 以主键作为事务id恢复
+func Test_recover_legacy_tx_without_tx_id(t *testing.T) {
+	env := newTestEnv(t)
+	cp := &fakeComponent{id: "cp1"}
+	tm := env.newManager(t, []model.TCCComponent{cp})
+
+	createdAt := time.Now().Add(-time.Minute)
+	if err := env.db.Exec("INSERT INTO TXRecordPO (created_at, updated_at, status, component_try_statuses) VALUES (?, ?, ?, ?)",
+		createdAt, createdAt, pkg.TryHanging.String(), `{"cp1":{"component_id":"cp1","try_status":"Success"}}`).Error; err != nil {
+		t.Fatal(err)
+	}
+	var id uint
+	if err := env.db.Raw("SELECT id FROM TXRecordPO WHERE tx_id IS NULL").Scan(&id).Error; err != nil || id == 0 {
+		t.Fatalf("legacy row should have no tx_id, id: %d, err: %v", id, err)
+	}
+	txId := fmt.Sprint(id)
+
+	if err := tm.recoverHangingTXs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.confirmed) != 1 || cp.confirmed[0] != txId {
+		t.Fatalf("legacy TX should be confirmed by its id, got: %v", cp.confirmed)
+	}
+	if got := env.txStatus(t, txId); got != pkg.TXSuccess {
+		t.Fatalf("legacy TX should be submitted, got: %s", got)
+	}
+}
+
+// 租约时长与恢复的时间间隔
+func withMonitorTick(tick time.Duration) Option {
+	return func(opts *Options) {
+		opts.MonitorTick = tick
+	}
+}
+
+// 健康的持有者由看门狗续期分片租约, 耗时超过租约时长的批次仍能完成
+func Test_recover_long_batch_keeps_lease(t *testing.T) {
+	env := newTestEnv(t)
+	cp := &fakeComponent{id: "cp1", confirmDelay: 1500 * time.Millisecond}
+	tm := env.newManager(t, []model.TCCComponent{cp}, WithShardCount(2), withMonitorTick(time.Second))
+	env.createTriedTX(t, "tx1", cp)
+
+	if err := tm.recoverHangingTXs(); err != nil {
+		t.Fatal(err)
+	}
+	if status := env.txStatus(t, "tx1"); status != pkg.TXSuccess {
+		t.Fatalf("long batch should complete while the lease is renewed, got: %s", status)
+	}
+}
+
+// 租约真正丢失时中止进行中的批次, 事务留给取得租约的副本
+func Test_recover_lost_lease_aborts_batch(t *testing.T) {
+	env := newTestEnv(t)
+	cp := &fakeComponent{id: "cp1", confirmDelay: time.Minute}
+	tm := env.newManager(t, []model.TCCComponent{cp}, WithShardCount(2), withMonitorTick(time.Second))
+	env.createTriedTX(t, "tx1", cp)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tm.recoverHangingTXs()
+	}()
+
+	//confirm开始后租约过期, 看门狗续期失败
+	eventually(t, func() bool {
+		cp.mux.Lock()
+		defer cp.mux.Unlock()
+		return len(cp.confirmed) > 0
+	}, "confirm should start")
+	env.clock.Advance(2 * time.Second)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lost lease should abort the in-progress batch")
+	}
+	if status := env.txStatus(t, "tx1"); status != pkg.TXHanging {
+		t.Fatalf("aborted TX should stay hanging, got: %s", status)
+	}
+}
+
+// 组件的并发限制: 同时进行中的try不超过许可数, try结束后归还许可, 许可用完时try等待到事务超时
+func Test_component_semaphore(t *testing.T) {
+	env := newTestEnv(t)
+	server := testutil.NewRedisServer(t)
+	client, err := third_party.NewClient("tcp", server.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	sem := redis_lock.NewSemaphore("cp1", 1, client, redis_lock.WithExpireSeconds(5))
+	cp := &fakeComponent{id: "cp1", tryDelay: 50 * time.Millisecond}
+	tm := env.newManager(t, []model.TCCComponent{cp}, WithComponentSemaphore("cp1", sem))
+
+	futures := make([]*TXFuture, 3)
+	for i := range futures {
+		if futures[i], err = tm.TransactionAsync(ctx, requests("cp1")...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, future := range futures {
+		result, err := future.Wait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Successful || result.Status != pkg.TXSuccess {
+			t.Fatalf("TX should succeed after waiting for the permit: %+v", result)
+		}
+	}
+	if cp.maxInflight != 1 {
+		t.Fatalf("tries should be limited to 1, got: %d", cp.maxInflight)
+	}
+
+	//try结束后许可已归还
+	permit, err := sem.TryAcquire(ctx)
+	if err != nil {
+		t.Fatal("permit should be released after try: ", err)
+	}
+	defer func() {
+		_ = sem.Release(ctx, permit)
+	}()
+
+	//许可用完时try等待到事务超时, 失败的原因记录在分支上
+	tm.opts.Timeout = 200 * time.Millisecond
+	result, err := tm.Transaction(ctx, requests("cp1")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Successful || !errors.Is(result.Err(), ErrTryTimeout) {
+		t.Fatalf("try should time out waiting for the permit: %+v", result)
+	}
+	branches, err := DAO.NewTXRecordDAO(env.db).GetTXBranches(ctx, result.TXId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(branches) != 1 || !strings.Contains(branches[0].LastError, ErrTryTimeout.Error()) {
+		t.Fatalf("semaphore timeout should be recorded on the branch: %+v", branches)
+	}
+}
@@ -0,0 +1,35 @@
+package TCC
+
+import (
+	"TCC/pkg"
+	"fmt"
+)
+
+var (
+	ErrTryRejected       = pkg.ErrTryRejected
+	ErrTryTimeout        = pkg.ErrTryTimeout
+	ErrComponentNotFound = pkg.ErrComponentNotFound
+	ErrTXPending         = pkg.ErrTXPending
+)
+
+// 事务阶段
+const (
+	PhaseTry     = "try"
+	PhaseConfirm = "confirm"
+	PhaseCancel  = "cancel"
+)
+
+// 组件在某一阶段执行失败的错误, 可通过errors.As取出组件信息
+type ComponentError struct {
+	ComponentId string
+	Phase       string
+	Err         error
+}
+
+func (e *ComponentError) Error() string {
+	return fmt.Sprintf("component:%v %s failed: %v", e.ComponentId, e.Phase, e.Err)
+}
+
+func (e *ComponentError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,142 @@
+package TCC
+
+import (
+	"TCC/model"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// 断言err包装了指定组件在指定阶段的*ComponentError以及targets
+func assertComponentErr(t *testing.T, err error, componentId, phase string, targets ...error) {
+	t.Helper()
+	var componentErr *ComponentError
+	if !errors.As(err, &componentErr) {
+		t.Fatalf("expect *ComponentError, got: %v", err)
+	}
+	if componentErr.ComponentId != componentId || componentErr.Phase != phase {
+		t.Fatalf("expect component %s phase %s, got: %+v", componentId, phase, componentErr)
+	}
+	for _, target := range targets {
+		if !errors.Is(err, target) {
+			t.Fatalf("expect %v to wrap %v", err, target)
+		}
+	}
+}
+
+func Test_try_errors(t *testing.T) {
+	componentErr := errors.New("insufficient balance")
+	cases := []struct {
+		name      string
+		component *fakeComponent
+		targets   []error
+	}{
+		{name: "rejected", component: &fakeComponent{id: "cp1", tryReject: true}, targets: []error{ErrTryRejected}},
+		{name: "error", component: &fakeComponent{id: "cp1", tryErr: componentErr}, targets: []error{ErrTryRejected, componentErr}},
+		{name: "timeout", component: &fakeComponent{id: "cp1", tryDelay: time.Minute}, targets: []error{ErrTryTimeout, context.DeadlineExceeded}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			tm := env.newManager(t, []model.TCCComponent{c.component})
+			tm.opts.Timeout = 50 * time.Millisecond
+
+			result, err := tm.Transaction(context.Background(), requests("cp1")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Successful {
+				t.Fatal("transaction should fail")
+			}
+			assertComponentErr(t, result.Err(), "cp1", PhaseTry, c.targets...)
+			component, _ := result.Component("cp1")
+			assertComponentErr(t, component.TryErr, "cp1", PhaseTry, c.targets...)
+		})
+	}
+}
+
+func Test_phase2_errors(t *testing.T) {
+	phase2Err := errors.New("downstream unavailable")
+	cases := []struct {
+		name      string
+		component *fakeComponent
+		phase     string
+	}{
+		{name: "confirm", component: &fakeComponent{id: "cp1", confirmErr: phase2Err}, phase: PhaseConfirm},
+		{name: "cancel", component: &fakeComponent{id: "cp1", tryReject: true, cancelErr: phase2Err}, phase: PhaseCancel},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			tm := env.newManager(t, []model.TCCComponent{c.component})
+
+			future, err := tm.TransactionAsync(context.Background(), requests("cp1")...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := future.Wait(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertComponentErr(t, result.Phase2Err, "cp1", c.phase, phase2Err)
+			component, _ := result.Component("cp1")
+			if component.Phase2 != Phase2Failed {
+				t.Fatalf("expect phase2 failed, got: %s", component.Phase2)
+			}
+			assertComponentErr(t, component.Phase2Err, "cp1", c.phase, phase2Err)
+		})
+	}
+}
+
+func Test_component_not_found(t *testing.T) {
+	env := newTestEnv(t)
+	tm := env.newManager(t, nil)
+	if _, err := tm.Transaction(context.Background(), requests("missing")...); !errors.Is(err, ErrComponentNotFound) {
+		t.Fatal("expect ErrComponentNotFound, got: ", err)
+	}
+}
+
+// 调用方的ctx在try期间超时, try被取消后仍归类为ErrTryTimeout
+func Test_try_caller_deadline_is_timeout(t *testing.T) {
+	env := newTestEnv(t)
+	slow, fast := &fakeComponent{id: "cp1", tryDelay: time.Minute}, &fakeComponent{id: "cp2"}
+	tm := env.newManager(t, []model.TCCComponent{slow, fast})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	future, err := tm.transactionAsync(ctx, ctx, requests("cp1", "cp2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := future.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, _ := result.Component("cp1")
+	assertComponentErr(t, component.TryErr, "cp1", PhaseTry, ErrTryTimeout)
+	if !errors.Is(result.Err(), ErrTryTimeout) || errors.Is(result.Err(), ErrTryRejected) {
+		t.Fatalf("caller deadline should be reported as timeout, got: %v", result.Err())
+	}
+}
+
+// 其他组件try失败而被取消的try归类为ErrTryRejected
+func Test_try_aborted_by_sibling_is_rejected(t *testing.T) {
+	env := newTestEnv(t)
+	rejecter, slow := &fakeComponent{id: "cp1", tryReject: true}, &fakeComponent{id: "cp2", tryDelay: time.Minute}
+	tm := env.newManager(t, []model.TCCComponent{rejecter, slow})
+
+	future, err := tm.TransactionAsync(context.Background(), requests("cp1", "cp2")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := future.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	component, _ := result.Component("cp2")
+	assertComponentErr(t, component.TryErr, "cp2", PhaseTry, ErrTryRejected, context.Canceled)
+	if errors.Is(component.TryErr, ErrTryTimeout) {
+		t.Fatalf("aborted try should not be reported as timeout: %v", component.TryErr)
+	}
+}
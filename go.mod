@@ -3,14 +3,27 @@ module TCC
 go 1.22
 
 require (
+	github.com/alicebob/miniredis/v2 v2.39.0
 	github.com/demdxx/gocast v1.2.0
+	github.com/glebarez/sqlite v1.11.0
 	github.com/gomodule/redigo v1.9.2
 	gorm.io/gorm v1.25.12
 )
 
 require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/glebarez/go-sqlite v1.21.2 // indirect
+	github.com/google/uuid v1.3.0 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/mattn/go-isatty v0.0.17 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/sys v0.7.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
+	modernc.org/libc v1.22.5 // indirect
+	modernc.org/mathutil v1.5.0 // indirect
+	modernc.org/memory v1.5.0 // indirect
+	modernc.org/sqlite v1.23.1 // indirect
 )
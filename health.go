@@ -0,0 +1,76 @@
+package TCC
+
+import (
+	"TCC/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// 就绪检查未设置超时时间时的默认超时
+const DefaultReadyTimeout = 3 * time.Second
+
+// 外部服务的健康检查, third_party.RedisClient实现了该接口
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// 检查协调者依赖的外部服务是否可用, 任一服务不可用时返回error
+func (tm *TXManager) Ready(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultReadyTimeout)
+		defer cancel()
+	}
+
+	names := make([]string, 0, len(tm.opts.HealthCheckers))
+	for name := range tm.opts.HealthCheckers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if err := tm.opts.HealthCheckers[name].HealthCheck(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 就绪探针: 依赖的外部服务均可用时返回200, 否则返回503及不可用的原因
+func (tm *TXManager) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := tm.Ready(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+// 每隔Options.ReadyCheckInterval执行一次就绪检查并缓存结果, 直到TXManager停止
+func (tm *TXManager) checkReadiness() {
+	ticker := time.NewTicker(tm.opts.ReadyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		tm.ready.Store(tm.Ready(tm.ctx) == nil)
+		select {
+		case <-tm.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 将就绪状态发布到metrics, 指标名为"coordinator.ready".
+// 读取的是后台检查缓存的结果, 采集指标时不会访问外部服务; 首次检查完成前为false
+func (tm *TXManager) publishMetrics() {
+	metrics.Publish("coordinator.ready", func() interface{} {
+		return tm.ready.Load()
+	})
+}
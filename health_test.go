@@ -0,0 +1,85 @@
+package TCC
+
+import (
+	"TCC/metrics"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 可切换结果并统计调用次数的健康检查
+type fakeChecker struct {
+	mux   sync.Mutex
+	err   error
+	calls int64
+}
+
+func (c *fakeChecker) HealthCheck(ctx context.Context) error {
+	atomic.AddInt64(&c.calls, 1)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.err
+}
+
+func (c *fakeChecker) setErr(err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.err = err
+}
+
+func Test_ready_and_readiness_handler(t *testing.T) {
+	env := newTestEnv(t)
+	store, redis := &fakeChecker{}, &fakeChecker{}
+	tm := env.newManager(t, nil, WithHealthChecker("store", store), WithHealthChecker("redis", redis))
+
+	if err := tm.Ready(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	tm.ReadinessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ready coordinator should return 200, got: %d", recorder.Code)
+	}
+
+	errDown := errors.New("connection refused")
+	redis.setErr(errDown)
+	err := tm.Ready(context.Background())
+	if !errors.Is(err, errDown) || !strings.Contains(err.Error(), "redis") || strings.Contains(err.Error(), "store") {
+		t.Fatalf("error should name the unavailable service, got: %v", err)
+	}
+	recorder = httptest.NewRecorder()
+	tm.ReadinessHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "redis") {
+		t.Fatalf("unready coordinator should return 503 with the reason, got: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// 指标读取后台检查缓存的结果, 采集指标不会触发健康检查
+func Test_ready_metric_is_cached(t *testing.T) {
+	env := newTestEnv(t)
+	checker := &fakeChecker{}
+	env.newManager(t, nil, WithHealthChecker("redis", checker), WithReadyCheckInterval(50*time.Millisecond))
+
+	eventually(t, func() bool {
+		return metrics.Get("coordinator.ready").String() == "true"
+	}, "ready metric should become true after the first check")
+
+	calls := atomic.LoadInt64(&checker.calls)
+	for i := 0; i < 10; i++ {
+		_ = metrics.Get("coordinator.ready").String()
+	}
+	if got := atomic.LoadInt64(&checker.calls); got > calls+1 {
+		t.Fatalf("reading the metric should not run health checks, calls: %d -> %d", calls, got)
+	}
+
+	checker.setErr(errors.New("connection refused"))
+	eventually(t, func() bool {
+		return metrics.Get("coordinator.ready").String() == "false"
+	}, "ready metric should turn false after the next periodic check")
+}
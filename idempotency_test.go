@@ -0,0 +1,130 @@
+package TCC
+
+import (
+	"TCC/model"
+	"TCC/pkg"
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_idempotency_key_returns_finished_tx(t *testing.T) {
+	env := newTestEnv(t)
+	cp := &fakeComponent{id: "cp1"}
+	tm := env.newManager(t, []model.TCCComponent{cp})
+	ctx := context.Background()
+
+	first, err := tm.TransactionAsyncWithOptions(ctx, requests("cp1"), WithIdempotencyKey("order-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = first.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		_, ok := tm.Future(first.TXId())
+		return !ok
+	}, "finished future should be removed")
+
+	//重复调用返回已有事务的结果, 不会再次执行try
+	result, err := tm.TransactionWithOptions(ctx, requests("cp1"), WithIdempotencyKey("order-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TXId != first.TXId() || !result.Duplicated || !result.Finished || !result.Successful || result.Status != pkg.TXSuccess {
+		t.Fatalf("unexpected duplicated result: %+v", result)
+	}
+	if len(cp.confirmed) != 1 {
+		t.Fatalf("duplicated call should not run the TX again, confirms: %v", cp.confirmed)
+	}
+
+	//不同的幂等键创建新的事务
+	other, err := tm.TransactionWithOptions(ctx, requests("cp1"), WithIdempotencyKey("order-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.TXId == first.TXId() || other.Duplicated {
+		t.Fatalf("different key should create a new TX: %+v", other)
+	}
+}
+
+func Test_idempotency_key_tracks_tx_on_other_replica(t *testing.T) {
+	env := newTestEnv(t)
+	block := make(chan struct{})
+	cp := &fakeComponent{id: "cp1", block: block}
+	replica := env.newManager(t, []model.TCCComponent{cp})
+	tm := env.newManager(t, []model.TCCComponent{cp}, WithResultPollInterval(10*time.Millisecond))
+	ctx := context.Background()
+
+	running, err := replica.TransactionAsyncWithOptions(ctx, requests("cp1"), WithIdempotencyKey("order-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//事务在其他副本上进行中, 句柄未结束
+	future, err := tm.TransactionAsyncWithOptions(ctx, requests("cp1"), WithIdempotencyKey("order-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if future.TXId() != running.TXId() || !future.Result().Duplicated {
+		t.Fatalf("should hit the running TX: %+v", future.Result())
+	}
+	select {
+	case <-future.Done():
+		t.Fatal("duplicated future should not be done while TX is running")
+	default:
+	}
+
+	close(block)
+	waitCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result, err := future.Wait(waitCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Finished || !result.Successful || result.Status != pkg.TXSuccess {
+		t.Fatalf("duplicated future should follow the TX to the end: %+v", result)
+	}
+}
+
+func Test_idempotency_key_retention(t *testing.T) {
+	env := newTestEnv(t)
+	cp := &fakeComponent{id: "cp1"}
+	tm := env.newManager(t, []model.TCCComponent{cp}, WithIdempotencyRetention(time.Hour))
+	ctx := context.Background()
+
+	first, err := tm.TransactionWithOptions(ctx, requests("cp1"), WithIdempotencyKey("order-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tm.TransactionWithOptions(ctx, requests("cp1"), WithIdempotencyKey("order-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//order-1超过保留期后重复调用创建新的事务
+	env.db.Exec("UPDATE TXRecordPO SET created_at = ? WHERE tx_id = ?", time.Now().Add(-2*time.Hour), first.TXId)
+	again, err := tm.TransactionWithOptions(ctx, requests("cp1"), WithIdempotencyKey("order-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.TXId == first.TXId || again.Duplicated {
+		t.Fatalf("expired key should create a new TX: %+v", again)
+	}
+
+	//轮询释放过期的幂等键, 保留期内的幂等键不受影响
+	env.db.Exec("UPDATE TXRecordPO SET created_at = ? WHERE tx_id = ?", time.Now().Add(-2*time.Hour), again.TXId)
+	tm.releaseExpiredIdempotencyKeys()
+	var held int64
+	env.db.Table("TXRecordPO").Where("idempotency_key = ?", "order-1").Count(&held)
+	if held != 0 {
+		t.Fatal("expired key should be released")
+	}
+	dup, err := tm.TransactionWithOptions(ctx, requests("cp1"), WithIdempotencyKey("order-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dup.TXId != second.TXId || !dup.Duplicated {
+		t.Fatalf("key within retention should still hit: %+v", dup)
+	}
+}
@@ -40,10 +40,26 @@ type MockComponent struct {
 
 	//分布式锁,保证组件数据访问一致性
 	client *third_party.RedisClient
+
+	//构造组件数据与锁的key
+	keys *pkg.KeyBuilder
 }
 
-func NewMockComponent(id string, client *third_party.RedisClient) *MockComponent {
-	return &MockComponent{id: id, client: client}
+type MockComponentOption func(mc *MockComponent)
+
+// 设置构造组件数据与锁key的KeyBuilder, 默认为pkg.DefaultKeyBuilder
+func WithComponentKeyBuilder(keys *pkg.KeyBuilder) MockComponentOption {
+	return func(mc *MockComponent) {
+		mc.keys = keys
+	}
+}
+
+func NewMockComponent(id string, client *third_party.RedisClient, opts ...MockComponentOption) *MockComponent {
+	mc := &MockComponent{id: id, client: client, keys: pkg.DefaultKeyBuilder}
+	for _, opt := range opts {
+		opt(mc)
+	}
+	return mc
 }
 
 func (mc *MockComponent) ID() string {
@@ -52,7 +68,7 @@ func (mc *MockComponent) ID() string {
 
 func (mc *MockComponent) Try(ctx context.Context, req *model.TCCReq) (*model.TCCResp, error) {
 	//获取分布式锁
-	lock := redis_lock.NewRedisLock(pkg.BuildRedisLockKey(mc.id, req.TXId), mc.client)
+	lock := mc.newLock(req.TXId)
 	err := lock.Lock(ctx)
 	if err != nil {
 		return nil, err
@@ -61,49 +77,61 @@ func (mc *MockComponent) Try(ctx context.Context, req *model.TCCReq) (*model.TCC
 		_ = lock.Unlock(ctx)
 	}()
 
-	//幂等性获取事务
-	CpStatus, err := mc.client.Get(ctx, pkg.BuildTXKey(mc.id, req.TXId))
-	if err != nil && !errors.Is(err, redis_lock.ErrNil) {
-		return nil, err
-	}
-
 	resp := &model.TCCResp{
 		TXId:        req.TXId,
 		Componentid: mc.id,
 	}
 
-	switch CpStatus {
-	case TryStatus.String(), ConfirmStatus.String():
-		resp.ACK = true
-		return resp, nil
-	case CancelStatus.String():
-		return resp, nil
-	default:
-	}
-
 	BizId := gocast.ToString(req.RequestArg["biz_id"])
-	if _, err := mc.client.Set(ctx, pkg.BuildTXKeyWithDetail(mc.id, req.TXId), BizId); err != nil {
-		return nil, err
+	if BizId == "" {
+		return nil, fmt.Errorf("biz_id can't be empty, cid: %s, txid: %s", mc.id, req.TXId)
 	}
-
-	reply, err := mc.client.SetNX(ctx, pkg.BuildDataKey(mc.id, req.TXId, BizId), DataFrozen.String())
+	txKey, dataKey := mc.keys.TX(mc.id, req.TXId), mc.keys.Data(mc.id, req.TXId, BizId)
+	fencingKey := mc.keys.TXFencing(mc.id, req.TXId)
+
+	//明细、冻结数据与组件状态在同一个事务中写入, WATCH与fencing token避免锁意外过期后覆盖其他持有者的写入
+	_, err = mc.client.Transaction(ctx, func(tx *third_party.Tx) error {
+		//幂等性获取事务
+		CpStatus, err := tx.Do("GET", txKey).String()
+		if err != nil && !errors.Is(err, redis_lock.ErrNil) {
+			return err
+		}
+
+		switch CpStatus {
+		case TryStatus.String(), ConfirmStatus.String():
+			resp.ACK = true
+			return nil
+		case CancelStatus.String():
+			return nil
+		default:
+		}
+
+		exists, err := tx.Do("EXISTS", dataKey).Bool()
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil //重复设置数据状态则直接返回
+		}
+
+		if err := checkFencingToken(tx, fencingKey, lock.FencingToken()); err != nil {
+			return err
+		}
+		tx.Queue("SET", mc.keys.TXDetail(mc.id, req.TXId), BizId)
+		tx.Queue("SET", dataKey, DataFrozen.String())
+		tx.Queue("SET", txKey, TryStatus.String())
+		resp.ACK = true
+		return nil
+	}, txKey, dataKey, fencingKey)
 	if err != nil {
 		return nil, err
 	}
-	if reply != 1 {
-		return resp, nil //重复设置数据状态则直接返回
-	}
-
-	if _, err := mc.client.Set(ctx, pkg.BuildTXKey(mc.id, req.TXId), TryStatus.String()); err != nil {
-		return nil, err
-	}
 
-	resp.ACK = true
 	return resp, nil
 }
 
 func (mc *MockComponent) Confirm(ctx context.Context, txid string) (*model.TCCResp, error) {
-	lock := redis_lock.NewRedisLock(pkg.BuildRedisLockKey(mc.id, txid), mc.client)
+	lock := mc.newLock(txid)
 	err := lock.Lock(ctx)
 	if err != nil {
 		return nil, err
@@ -117,46 +145,58 @@ func (mc *MockComponent) Confirm(ctx context.Context, txid string) (*model.TCCRe
 		Componentid: mc.id,
 	}
 
-	cpStatus, err := mc.client.Get(ctx, pkg.BuildTXKey(mc.id, txid))
-	if err != nil {
-		return nil, err
-	}
-
-	switch cpStatus {
-	case ConfirmStatus.String():
+	txKey, detailKey := mc.keys.TX(mc.id, txid), mc.keys.TXDetail(mc.id, txid)
+	fencingKey := mc.keys.TXFencing(mc.id, txid)
+	_, err = mc.client.Transaction(ctx, func(tx *third_party.Tx) error {
+		cpStatus, err := tx.Do("GET", txKey).String()
+		if err != nil {
+			return err
+		}
+
+		switch cpStatus {
+		case ConfirmStatus.String():
+			resp.ACK = true
+			return nil
+		case CancelStatus.String():
+			return nil
+		default:
+		}
+
+		bizId, err := tx.Do("GET", detailKey).String()
+		if err != nil {
+			return err
+		}
+
+		dataKey := mc.keys.Data(mc.id, txid, bizId)
+		if err := tx.Watch(dataKey); err != nil {
+			return err
+		}
+		dataStatus, err := tx.Do("GET", dataKey).String()
+		if err != nil {
+			return err
+		}
+
+		if dataStatus != DataFrozen.String() {
+			return nil
+		}
+
+		if err := checkFencingToken(tx, fencingKey, lock.FencingToken()); err != nil {
+			return err
+		}
+		tx.Queue("SET", dataKey, DataSuccess.String())
+		tx.Queue("SET", txKey, ConfirmStatus.String())
 		resp.ACK = true
-		return resp, nil
-	case CancelStatus.String():
-		return resp, nil
-	default:
-	}
-
-	bizId, err := mc.client.Get(ctx, pkg.BuildTXKeyWithDetail(mc.id, txid))
+		return nil
+	}, txKey, detailKey, fencingKey)
 	if err != nil {
 		return nil, err
 	}
 
-	dataStatus, err := mc.client.Get(ctx, pkg.BuildDataKey(mc.id, txid, bizId))
-	if err != nil {
-		return nil, err
-	}
-
-	if dataStatus != DataFrozen.String() {
-		return resp, nil
-	}
-
-	if _, err := mc.client.Set(ctx, pkg.BuildDataKey(mc.id, txid, bizId), DataSuccess.String()); err != nil {
-		return nil, err
-	}
-
-	_, _ = mc.client.Set(ctx, pkg.BuildTXKey(mc.id, txid), CancelStatus.String())
-
-	resp.ACK = true
 	return resp, nil
 }
 
 func (mc *MockComponent) Cancel(ctx context.Context, txid string) (*model.TCCResp, error) {
-	lock := redis_lock.NewRedisLock(pkg.BuildRedisLockKey(mc.id, txid), mc.client)
+	lock := mc.newLock(txid)
 	if err := lock.Lock(ctx); err != nil {
 		return nil, err
 	}
@@ -164,25 +204,33 @@ func (mc *MockComponent) Cancel(ctx context.Context, txid string) (*model.TCCRes
 		_ = lock.Unlock(ctx)
 	}()
 
-	cpStatus, err := mc.client.Get(ctx, pkg.BuildTXKey(mc.id, txid))
-	if err != nil {
-		return nil, err
-	}
-
-	if cpStatus == ConfirmStatus.String() {
-		return nil, fmt.Errorf("invalid component status, cid: %s, txid: %s", mc.id, txid)
-	}
-
-	bizId, err := mc.client.Get(ctx, pkg.BuildTXKeyWithDetail(mc.id, txid))
+	txKey, detailKey := mc.keys.TX(mc.id, txid), mc.keys.TXDetail(mc.id, txid)
+	fencingKey := mc.keys.TXFencing(mc.id, txid)
+	_, err := mc.client.Transaction(ctx, func(tx *third_party.Tx) error {
+		cpStatus, err := tx.Do("GET", txKey).String()
+		if err != nil {
+			return err
+		}
+
+		if cpStatus == ConfirmStatus.String() {
+			return fmt.Errorf("invalid component status, cid: %s, txid: %s", mc.id, txid)
+		}
+
+		bizId, err := tx.Do("GET", detailKey).String()
+		if err != nil {
+			return err
+		}
+
+		if err := checkFencingToken(tx, fencingKey, lock.FencingToken()); err != nil {
+			return err
+		}
+		tx.Queue("DEL", mc.keys.Data(mc.id, txid, bizId))
+		tx.Queue("SET", txKey, CancelStatus.String())
+		return nil
+	}, txKey, detailKey, fencingKey)
 	if err != nil {
 		return nil, err
 	}
-	
-	if err := mc.client.Del(ctx, pkg.BuildDataKey(mc.id, txid, bizId)); err != nil {
-		return nil, err
-	}
-
-	_, _ = mc.client.Set(ctx, pkg.BuildTXKey(mc.id, txid), CancelStatus.String())
 
 	return &model.TCCResp{
 		TXId:        txid,
@@ -190,3 +238,23 @@ func (mc *MockComponent) Cancel(ctx context.Context, txid string) (*model.TCCRes
 		ACK:         true,
 	}, nil
 }
+
+// 组件处理事务时使用的分布式锁, 写入时携带其fencing token
+func (mc *MockComponent) newLock(txId string) *redis_lock.RedisLock {
+	return redis_lock.NewRedisLock(pkg.ComponentLockName(mc.id, txId), mc.client,
+		redis_lock.WithFencingToken(), redis_lock.WithKeyBuilder(mc.keys))
+}
+
+// 校验fencing token: 事务已被持有更大token的锁写入过时返回ErrStaleFencingToken, 否则随本次写入记录token.
+// fencingKey需已被WATCH
+func checkFencingToken(tx *third_party.Tx, fencingKey string, token int64) error {
+	last, err := tx.Do("GET", fencingKey).Int64()
+	if err != nil && !errors.Is(err, redis_lock.ErrNil) {
+		return err
+	}
+	if last > token {
+		return fmt.Errorf("key:%s token:%d err: %w", fencingKey, token, redis_lock.ErrStaleFencingToken)
+	}
+	tx.Queue("SET", fencingKey, token)
+	return nil
+}
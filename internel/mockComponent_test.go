@@ -0,0 +1,121 @@
+package internel
+
+import (
+	"TCC/model"
+	"TCC/pkg"
+	"TCC/redis_lock"
+	"TCC/testutil"
+	"TCC/third_party"
+	"context"
+	"errors"
+	"testing"
+)
+
+func newTestComponent(t *testing.T) (*MockComponent, *testutil.RedisServer) {
+	server := testutil.NewRedisServer(t)
+	client, err := third_party.NewClient("tcp", server.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := pkg.NewKeyBuilder(pkg.WithKeyNamespace("app1"), pkg.WithHashTag())
+	return NewMockComponent("cp1", client, WithComponentKeyBuilder(keys)), server
+}
+
+func tryReq(txId, bizId string) *model.TCCReq {
+	return &model.TCCReq{
+		TXId:        txId,
+		Componentid: "cp1",
+		RequestArg:  map[string]interface{}{"biz_id": bizId},
+	}
+}
+
+func Test_mock_component_try_confirm(t *testing.T) {
+	cp, server := newTestComponent(t)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		resp, err := cp.Try(ctx, tryReq("tx1", "biz1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.ACK {
+			t.Fatal("try should be acked, including idempotent retries")
+		}
+	}
+	if got, _ := server.Get(cp.keys.Data("cp1", "tx1", "biz1")); got != DataFrozen.String() {
+		t.Fatalf("data should be frozen after try, got: %s", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := cp.Confirm(ctx, "tx1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.ACK {
+			t.Fatal("confirm should be acked, including idempotent retries")
+		}
+	}
+	if got, _ := server.Get(cp.keys.Data("cp1", "tx1", "biz1")); got != DataSuccess.String() {
+		t.Fatalf("data should be success after confirm, got: %s", got)
+	}
+	if got, _ := server.Get(cp.keys.TX("cp1", "tx1")); got != ConfirmStatus.String() {
+		t.Fatalf("status should be confirm, got: %s", got)
+	}
+
+	if _, err := cp.Cancel(ctx, "tx1"); err == nil {
+		t.Fatal("cancel confirmed tx should fail")
+	}
+}
+
+func Test_mock_component_try_cancel(t *testing.T) {
+	cp, server := newTestComponent(t)
+	ctx := context.Background()
+
+	if _, err := cp.Try(ctx, tryReq("tx2", "biz2")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cp.Cancel(ctx, "tx2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.ACK {
+		t.Fatal("cancel should be acked")
+	}
+	if server.Exists(cp.keys.Data("cp1", "tx2", "biz2")) {
+		t.Fatal("frozen data should be released after cancel")
+	}
+
+	//取消后的Try不再冻结数据
+	resp, err = cp.Try(ctx, tryReq("tx2", "biz2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ACK || server.Exists(cp.keys.Data("cp1", "tx2", "biz2")) {
+		t.Fatal("try after cancel should be rejected")
+	}
+}
+
+// 锁过期后被持有更大fencing token的持有者写入过, 旧持有者的写入被拒绝
+func Test_mock_component_rejects_stale_fencing_token(t *testing.T) {
+	cp, server := newTestComponent(t)
+	ctx := context.Background()
+
+	if _, err := cp.Try(ctx, tryReq("tx3", "biz3")); err != nil {
+		t.Fatal(err)
+	}
+	token, err := server.Get(cp.keys.TXFencing("cp1", "tx3"))
+	if err != nil || token == "" {
+		t.Fatal("try should record its fencing token: ", err)
+	}
+
+	//模拟之后取得锁的持有者已写入更大的token
+	if err := server.Set(cp.keys.TXFencing("cp1", "tx3"), "9007199254740000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cp.Confirm(ctx, "tx3"); !errors.Is(err, redis_lock.ErrStaleFencingToken) {
+		t.Fatal("expect ErrStaleFencingToken, got: ", err)
+	}
+	if got, _ := server.Get(cp.keys.Data("cp1", "tx3", "biz3")); got != DataFrozen.String() {
+		t.Fatalf("stale confirm should not change data, got: %s", got)
+	}
+}
@@ -5,132 +5,371 @@ import (
 	"TCC/model"
 	"TCC/pkg"
 	"TCC/redis_lock"
+	"TCC/third_party"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/demdxx/gocast"
 )
 
+var _ model.TXStore = (*MockTXStore)(nil)
+
 type MockTXStore struct {
 	dao DAO.TXRecordDAOInterface
 
-	lock *redis_lock.RedisLock
+	//调用方未提供事务id时使用的id生成器
+	idGenerator pkg.IDGenerator
+
+	//全局锁, 加锁期间不为空
+	lockMux sync.Mutex
+	lock    *redis_lock.RedisLock
+
+	//分片租约
+	client     third_party.LockClient
+	shardMux   sync.Mutex
+	shardLocks map[int]*redis_lock.RedisLock
+
+	//构造锁key
+	keys *pkg.KeyBuilder
+
+	//以乐观锁更新事务记录, 否则使用行锁
+	optimistic bool
+	//乐观锁版本冲突时的最大重试次数, 由DAO.OptimisticDo处理默认值
+	optimisticRetries int
+}
+
+type MockTXStoreOption func(m *MockTXStore)
+
+// 设置构造全局锁与分片租约key的KeyBuilder, 默认为pkg.DefaultKeyBuilder
+func WithStoreKeyBuilder(keys *pkg.KeyBuilder) MockTXStoreOption {
+	return func(m *MockTXStore) {
+		m.keys = keys
+	}
+}
+
+// 以版本号乐观锁代替行锁更新事务记录, 版本冲突时最多重试maxRetries次, 不大于0时使用DAO.DefaultOptimisticRetries.
+// 适合同一事务并发更新较少的场景; 旧版本以json储存组件状态的事务仍使用行锁
+func WithOptimisticUpdate(maxRetries int) MockTXStoreOption {
+	return func(m *MockTXStore) {
+		m.optimistic, m.optimisticRetries = true, maxRetries
+	}
+}
+
+func NewMockTXStore(dao DAO.TXRecordDAOInterface, client third_party.LockClient, opts ...MockTXStoreOption) *MockTXStore {
+	m := &MockTXStore{
+		dao:         dao,
+		idGenerator: pkg.NewUUIDv7Generator(),
+		client:      client,
+		shardLocks:  make(map[int]*redis_lock.RedisLock),
+		keys:        pkg.DefaultKeyBuilder,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (m *MockTXStore) CreateTX(ctx context.Context, TXId string, components ...model.TCCComponent) (string, error) {
+	return m.createTX(ctx, TXId, nil, components...)
 }
 
-func (m *MockTXStore) CreateTX(ctx context.Context, components ...model.TCCComponent) (string, error) {
-	componentTryStatuses := make(map[string]*DAO.ComponentTryStatus, len(components))
+func (m *MockTXStore) CreateTXWithKey(ctx context.Context, TXId string, key string, retention time.Duration, components ...model.TCCComponent) (string, bool, error) {
+	records, err := m.dao.GetTXRecords(ctx, DAO.WithIdempotencyKey(key))
+	if err != nil {
+		return "", false, err
+	}
+	if len(records) > 0 {
+		record := records[0]
+		if retention <= 0 || record.CreatedAt.After(time.Now().Add(-retention)) {
+			return record.GetTXId(), false, nil
+		}
+		//幂等键已过保留期, 释放后重新创建事务
+		if err := m.dao.ReleaseIdempotencyKey(ctx, record.GetTXId()); err != nil {
+			return "", false, err
+		}
+	}
+
+	txId, err := m.createTX(ctx, TXId, &key, components...)
+	if err == nil {
+		return txId, true, nil
+	}
+
+	//并发创建时唯一索引冲突, 返回先创建的事务
+	records, getErr := m.dao.GetTXRecords(ctx, DAO.WithIdempotencyKey(key))
+	if getErr != nil || len(records) == 0 {
+		return "", false, err
+	}
+	return records[0].GetTXId(), false, nil
+}
 
+// 释放幂等键时每批的数量
+const releaseKeyBatchSize = 100
+
+func (m *MockTXStore) ReleaseExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	var total int64
+	for {
+		released, err := m.dao.ReleaseIdempotencyKeysBefore(ctx, before, releaseKeyBatchSize)
+		total += released
+		if err != nil || released < releaseKeyBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (m *MockTXStore) createTX(ctx context.Context, TXId string, key *string, components ...model.TCCComponent) (string, error) {
+	if TXId == "" {
+		var err error
+		if TXId, err = m.idGenerator.NextID(); err != nil {
+			return "", err
+		}
+	}
+
+	//每个组件一个分支, 与事务记录一同写入
+	branches := make([]*DAO.TXBranchPO, 0, len(components))
 	for _, component := range components {
-		componentTryStatuses[component.ID()] = &DAO.ComponentTryStatus{
+		branches = append(branches, &DAO.TXBranchPO{
+			TXId:        TXId,
 			ComponentID: component.ID(),
 			TryStatus:   pkg.TryHanging.String(),
-		}
+		})
 	}
 
-	body, _ := json.Marshal(componentTryStatuses)
-	txID, err := m.dao.CreateTXRecord(ctx, &DAO.TXRecordPO{
-		Status:               pkg.TryHanging.String(),
-		ComponentTryStatuses: string(body),
+	_, err := m.dao.CreateTXRecord(ctx, &DAO.TXRecordPO{
+		TXId:           TXId,
+		Status:         pkg.TryHanging.String(),
+		ShardBucket:    pkg.ShardBucketOf(TXId),
+		IdempotencyKey: key,
+		Branches:       branches,
 	})
 	if err != nil {
 		return "", err
 	}
-	return gocast.ToString(txID), nil
+	return TXId, nil
 }
 
 func (m *MockTXStore) TXUpdate(ctx context.Context, TXId string, componentId string, successful bool) error {
-	txId := gocast.ToUint(TXId)
 	status := pkg.TryFailure.String()
 	if successful {
 		status = pkg.TrySuccess.String()
 	}
 
-	return m.dao.UpdateComponentStatus(ctx, txId, componentId, status)
+	err := m.dao.UpdateBranchTryStatus(ctx, TXId, componentId, status)
+	if errors.Is(err, DAO.ErrBranchNotFound) { //旧版本创建的事务没有分支, 仍更新json
+		return m.dao.UpdateComponentStatus(ctx, TXId, componentId, status)
+	}
+	return err
+}
+
+// 旧版本创建的事务没有分支, 不记录二阶段结果
+func (m *MockTXStore) TXPhase2Update(ctx context.Context, TXId string, componentId string, successful bool) error {
+	status := DAO.BranchPhase2Cancelled
+	if successful {
+		status = DAO.BranchPhase2Confirmed
+	}
+
+	err := m.dao.UpdateBranchPhase2Status(ctx, TXId, componentId, status)
+	if errors.Is(err, DAO.ErrBranchNotFound) {
+		return nil
+	}
+	return err
+}
+
+// 旧版本创建的事务没有分支, 不记录失败原因
+func (m *MockTXStore) TXRecordFailure(ctx context.Context, TXId string, componentId string, cause error) error {
+	err := m.dao.RecordBranchFailure(ctx, TXId, componentId, cause.Error())
+	if errors.Is(err, DAO.ErrBranchNotFound) {
+		return nil
+	}
+	return err
 }
 
 func (m *MockTXStore) TXSubmit(ctx context.Context, TXId string, success bool) error {
 	do := func(ctx context.Context, dao *DAO.TXRecordDAO, record *DAO.TXRecordPO) error {
-		if success {
-			if record.Status == pkg.TryFailure.String() {
-				return fmt.Errorf("invalid TX status: %s, txid: %s", record.Status, TXId)
-			}
-			record.Status = pkg.TrySuccess.String()
-		} else {
-			if record.Status == pkg.TrySuccess.String() {
-				return fmt.Errorf("invalid TX status: %s, txid: %s", record.Status, TXId)
-			}
-			record.Status = pkg.TryFailure.String()
+		if err := submitStatus(record, success); err != nil {
+			return err
 		}
 		return dao.UpdateTXRecord(ctx, record)
 	}
-	return m.dao.LockAndDo(ctx, gocast.ToUint(TXId), do)
+	return m.updateTX(ctx, TXId, do)
+}
+
+func (m *MockTXStore) TXSubmitFenced(ctx context.Context, TXId string, success bool, token int64) error {
+	do := func(ctx context.Context, dao *DAO.TXRecordDAO, record *DAO.TXRecordPO) error {
+		if err := submitStatus(record, success); err != nil {
+			return err
+		}
+		return dao.UpdateTXStatusFenced(ctx, record, token)
+	}
+	return m.updateTX(ctx, TXId, do)
+}
+
+// 校验并设置事务的最终状态, 已提交为相反状态的事务返回错误
+func submitStatus(record *DAO.TXRecordPO, success bool) error {
+	if success {
+		if record.Status == pkg.TryFailure.String() {
+			return fmt.Errorf("invalid TX status: %s, txid: %s", record.Status, record.GetTXId())
+		}
+		record.Status = pkg.TrySuccess.String()
+		return nil
+	}
+	if record.Status == pkg.TrySuccess.String() {
+		return fmt.Errorf("invalid TX status: %s, txid: %s", record.Status, record.GetTXId())
+	}
+	record.Status = pkg.TryFailure.String()
+	return nil
+}
+
+// 按储存中心的更新策略读取并更新事务记录
+func (m *MockTXStore) updateTX(ctx context.Context, TXId string, do func(ctx context.Context, dao *DAO.TXRecordDAO, record *DAO.TXRecordPO) error) error {
+	if m.optimistic {
+		return m.dao.OptimisticDo(ctx, TXId, m.optimisticRetries, do)
+	}
+	return m.dao.LockAndDo(ctx, TXId, do)
 }
 
-func (m *MockTXStore) GetHangingTXs(ctx context.Context) ([]*pkg.Transaction, error) {
-	records, err := m.dao.GetTXRecords(ctx, DAO.WithStatus(pkg.TryHanging))
+func (m *MockTXStore) GetHangingTXs(ctx context.Context, opts ...pkg.HangingTXOption) ([]*pkg.Transaction, string, error) {
+	query := pkg.NewHangingTXQuery(opts...)
+
+	queryOpts := []DAO.QueryOption{DAO.WithStatus(pkg.TryHanging), DAO.WithOrderByID(), DAO.WithBranches()}
+	if buckets := query.ShardBuckets(); buckets != nil {
+		queryOpts = append(queryOpts, DAO.WithShardBuckets(buckets))
+	}
+	if query.Cursor != "" {
+		queryOpts = append(queryOpts, DAO.WithIDAfter(gocast.ToUint(query.Cursor)))
+	}
+	if !query.CreatedAfter.IsZero() {
+		queryOpts = append(queryOpts, DAO.WithCreatedAfter(query.CreatedAfter))
+	}
+	if !query.CreatedBefore.IsZero() {
+		queryOpts = append(queryOpts, DAO.WithCreatedBefore(query.CreatedBefore))
+	}
+	if query.Limit > 0 {
+		queryOpts = append(queryOpts, DAO.WithLimit(query.Limit))
+	}
+
+	records, err := m.dao.GetTXRecords(ctx, queryOpts...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	txs := make([]*pkg.Transaction, 0, len(records))
 	for _, record := range records {
+		txs = append(txs, toTransaction(record))
+	}
+
+	//游标为记录的自增主键, 未取满一页说明已经取完
+	var nextCursor string
+	if query.Limit > 0 && len(records) == query.Limit {
+		nextCursor = gocast.ToString(records[len(records)-1].ID)
+	}
+	return txs, nextCursor, nil
+}
+
+func (m *MockTXStore) GetTX(ctx context.Context, TXId string) (pkg.Transaction, error) {
+	records, err := m.dao.GetTXRecords(ctx, DAO.WithTXId(TXId), DAO.WithBranches())
+	if err != nil {
+		return pkg.Transaction{}, err
+	}
+	if len(records) == 0 {
+		return pkg.Transaction{}, fmt.Errorf("TX %s not exist", TXId)
+	}
+	return *toTransaction(records[0]), nil
+}
+
+func toTransaction(record *DAO.TXRecordPO) *pkg.Transaction {
+	//每个组件的id和状态
+	components := make([]*pkg.ComponentTryEntity, 0, len(record.Branches))
+	for _, branch := range record.Branches {
+		components = append(components, &pkg.ComponentTryEntity{
+			ComponentId:     branch.ComponentID,
+			ComponentStatus: pkg.ComponentTryStatus(branch.TryStatus),
+		})
+	}
+	if len(record.Branches) == 0 { //旧版本创建的事务, 组件状态储存在json中
 		componentTryStatuses := make(map[string]*DAO.ComponentTryStatus)
 		_ = json.Unmarshal([]byte(record.ComponentTryStatuses), &componentTryStatuses)
-		components := make([]*pkg.ComponentTryEntity, 0, len(componentTryStatuses))
 		for _, component := range componentTryStatuses {
 			components = append(components, &pkg.ComponentTryEntity{
 				ComponentId:     component.ComponentID,
 				ComponentStatus: pkg.ComponentTryStatus(component.TryStatus),
 			})
 		}
-		txs = append(txs, &pkg.Transaction{
-			TXid:             gocast.ToString(record.ID),
-			ComponentsStatus: components,
-			TxStatus:         pkg.TXHanging,
-			CreatedAt:        record.CreatedAt,
-		})
 	}
-	return txs, nil
+	return &pkg.Transaction{
+		TXid:             record.GetTXId(),
+		ComponentsStatus: components,
+		TxStatus:         pkg.TXStatus(record.Status),
+		CreatedAt:        record.CreatedAt,
+	}
 }
 
-func (m *MockTXStore) GetTX(ctx context.Context, TXId string) (*pkg.Transaction, error) {
-	record, err := m.dao.GetTXRecords(ctx, DAO.WithID(gocast.ToUint(TXId)))
-	if err != nil {
-		return nil, err
+func (m *MockTXStore) Lock(ctx context.Context, duration time.Duration) (model.Lease, error) {
+	m.lockMux.Lock()
+	defer m.lockMux.Unlock()
+	if m.lock != nil {
+		return model.Lease{}, errors.New("tx store already locked")
 	}
 
-	//每个组件的id和状态
-	componentTryStatuses := make(map[string]*DAO.ComponentTryStatus)
-	json.Unmarshal([]byte(record[0].ComponentTryStatuses), &componentTryStatuses)
-	components := make([]*pkg.ComponentTryEntity, 0, len(componentTryStatuses))
-	for _, component := range componentTryStatuses {
-		components = append(components, &pkg.ComponentTryEntity{
-			ComponentId:     component.ComponentID,
-			ComponentStatus: pkg.ComponentTryStatus(component.TryStatus),
-		})
+	lock := redis_lock.NewRedisLock(pkg.TXStoreLockName(), m.client, m.leaseOptions(duration)...)
+	if err := lock.Lock(ctx); err != nil {
+		return model.Lease{}, err
 	}
-	return &pkg.Transaction{
-		TXid:             TXId,
-		ComponentsStatus: components,
-		TxStatus:         pkg.TXStatus(record[0].Status),
-		CreatedAt:        record[0].CreatedAt,
-	}, nil
+	m.lock = lock
+	return model.Lease{Lost: lock.Lost(), FencingToken: lock.FencingToken()}, nil
 }
 
-func (m *MockTXStore) Lock(ctx context.Context, duration time.Duration) error {
-	err := m.lock.Lock(ctx)
-	if err != nil {
-		return err
+func (m *MockTXStore) Unlock(ctx context.Context) error {
+	m.lockMux.Lock()
+	lock := m.lock
+	m.lock = nil
+	m.lockMux.Unlock()
+
+	if lock == nil {
+		return errors.New("tx store not locked")
 	}
-	return nil
+	return lock.Unlock(ctx)
 }
 
-func (m *MockTXStore) Unlock(ctx context.Context) error {
-	err := m.lock.Unlock(ctx)
-	if err != nil {
-		return err
+func (m *MockTXStore) LockShard(ctx context.Context, shard int, duration time.Duration) (model.Lease, error) {
+	m.shardMux.Lock()
+	defer m.shardMux.Unlock()
+	if _, ok := m.shardLocks[shard]; ok {
+		return model.Lease{}, fmt.Errorf("shard %d already leased", shard)
 	}
-	return nil
+
+	lock := redis_lock.NewRedisLock(pkg.ShardLeaseName(shard), m.client, m.leaseOptions(duration)...)
+	if err := lock.Lock(ctx); err != nil {
+		return model.Lease{}, err
+	}
+	m.shardLocks[shard] = lock
+	return model.Lease{Lost: lock.Lost(), FencingToken: lock.FencingToken()}, nil
+}
+
+// 全局锁与分片租约的选项: 以duration为过期时间并由看门狗续期, 持有者崩溃后最多duration即可被其他副本取得,
+// 健康的持有者则不会因处理时间超过duration而丢失租约
+func (m *MockTXStore) leaseOptions(duration time.Duration) []redis_lock.LockOption {
+	expireSeconds := int64(duration / time.Second)
+	if expireSeconds <= 0 {
+		expireSeconds = 1
+	}
+	return []redis_lock.LockOption{
+		redis_lock.WithExpireSeconds(expireSeconds), redis_lock.WithWatchDog(),
+		redis_lock.WithFencingToken(), redis_lock.WithKeyBuilder(m.keys),
+	}
+}
+
+func (m *MockTXStore) UnlockShard(ctx context.Context, shard int) error {
+	m.shardMux.Lock()
+	lock, ok := m.shardLocks[shard]
+	delete(m.shardLocks, shard)
+	m.shardMux.Unlock()
+
+	if !ok {
+		return fmt.Errorf("shard %d not leased", shard)
+	}
+	return lock.Unlock(ctx)
 }
@@ -0,0 +1,213 @@
+package internel
+
+import (
+	"TCC/DAO"
+	"TCC/pkg"
+	"TCC/testutil"
+	"TCC/testutil/memlock"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestTXStore(t *testing.T, opts ...MockTXStoreOption) *MockTXStore {
+	dao := DAO.NewTXRecordDAO(testutil.NewDB(t, &DAO.TXRecordPO{}, &DAO.TXBranchPO{}))
+	return NewMockTXStore(dao, memlock.NewClient(nil), opts...)
+}
+
+func Test_tx_store_branches(t *testing.T) {
+	store := newTestTXStore(t)
+	ctx := context.Background()
+
+	txId, err := store.CreateTX(ctx, "", NewMockComponent("cp1", nil), NewMockComponent("cp2", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.TXUpdate(ctx, txId, "cp1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.TXUpdate(ctx, txId, "cp2", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.TXUpdate(ctx, txId, "cp2", true); err == nil {
+		t.Fatal("update a finished component to another status should fail")
+	}
+
+	tx, err := store.GetTX(ctx, txId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.ComponentsStatus) != 2 ||
+		tx.ComponentsStatus[0].ComponentStatus != pkg.TrySuccess || tx.ComponentsStatus[1].ComponentStatus != pkg.TryFailure {
+		t.Fatalf("unexpected components: %+v", tx.ComponentsStatus)
+	}
+
+	txs, _, err := store.GetHangingTXs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || len(txs[0].ComponentsStatus) != 2 {
+		t.Fatalf("unexpected hanging txs: %+v", txs)
+	}
+}
+
+func Test_tx_store_legacy_json_components(t *testing.T) {
+	store := newTestTXStore(t)
+	ctx := context.Background()
+
+	//旧版本创建的事务, 组件状态储存在json中
+	if _, err := store.dao.CreateTXRecord(ctx, &DAO.TXRecordPO{
+		TXId:                 "tx1",
+		Status:               pkg.TryHanging.String(),
+		ComponentTryStatuses: `{"cp1":{"component_id":"cp1","try_status":"Hanging"},"cp2":{"component_id":"cp2","try_status":"Hanging"}}`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.TXUpdate(ctx, "tx1", "cp1", true); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := store.GetTX(ctx, "tx1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//更新一个组件后, 其余组件的状态保持不变
+	statuses := make(map[string]pkg.ComponentTryStatus)
+	for _, component := range tx.ComponentsStatus {
+		statuses[component.ComponentId] = component.ComponentStatus
+	}
+	if len(statuses) != 2 || statuses["cp1"] != pkg.TrySuccess || statuses["cp2"] != pkg.TryHanging {
+		t.Fatalf("unexpected components: %+v", statuses)
+	}
+}
+
+func Test_tx_store_submit(t *testing.T) {
+	for name, store := range map[string]*MockTXStore{
+		"pessimistic": newTestTXStore(t),
+		"optimistic":  newTestTXStore(t, WithOptimisticUpdate(0)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			testTXSubmit(t, store)
+		})
+	}
+}
+
+func testTXSubmit(t *testing.T, store *MockTXStore) {
+	ctx := context.Background()
+
+	txId, err := store.CreateTX(ctx, "", NewMockComponent("cp1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.TXSubmit(ctx, txId, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.TXSubmit(ctx, txId, false); err == nil {
+		t.Fatal("submit a successful TX as failure should fail")
+	}
+	tx, err := store.GetTX(ctx, txId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.TxStatus != pkg.TXSuccess {
+		t.Fatalf("unexpected TX status: %s", tx.TxStatus)
+	}
+}
+
+// 携带fencing token提交: 更小的token被拒绝, 未携带token的提交不受影响
+func Test_tx_store_submit_fenced(t *testing.T) {
+	for name, store := range map[string]*MockTXStore{
+		"pessimistic": newTestTXStore(t),
+		"optimistic":  newTestTXStore(t, WithOptimisticUpdate(0)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			txId, err := store.CreateTX(ctx, "", NewMockComponent("cp1", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = store.TXSubmitFenced(ctx, txId, true, 10); err != nil {
+				t.Fatal(err)
+			}
+			if err = store.TXSubmitFenced(ctx, txId, true, 9); !errors.Is(err, pkg.ErrStaleFencingToken) {
+				t.Fatal("expect ErrStaleFencingToken, got: ", err)
+			}
+			if err = store.TXSubmitFenced(ctx, txId, true, 11); err != nil {
+				t.Fatal(err)
+			}
+			if err = store.TXSubmit(ctx, txId, true); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// 全局锁与分片租约都携带fencing token, 之后取得的租约token更大
+func Test_tx_store_lease_fencing_token(t *testing.T) {
+	store := newTestTXStore(t)
+	ctx := context.Background()
+
+	global, err := store.Lock(ctx, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	shard, err := store.LockShard(ctx, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UnlockShard(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if global.FencingToken <= 0 || shard.FencingToken <= global.FencingToken {
+		t.Fatalf("lease tokens should increase, global: %d, shard: %d", global.FencingToken, shard.FencingToken)
+	}
+}
+
+func Test_tx_store_shard_paging(t *testing.T) {
+	store := newTestTXStore(t)
+	ctx := context.Background()
+
+	const shardCount = 3
+	created := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		txId, err := store.CreateTX(ctx, "", NewMockComponent("cp1", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		created[txId] = true
+	}
+
+	for shard := 0; shard < shardCount; shard++ {
+		var cursor string
+		for {
+			txs, next, err := store.GetHangingTXs(ctx, pkg.WithShard(shard, shardCount), pkg.WithPageLimit(2), pkg.WithPageCursor(cursor))
+			if err != nil {
+				t.Fatal(err)
+			}
+			//分片在查询中过滤, 非最后一页总是取满
+			if next != "" && len(txs) != 2 {
+				t.Fatalf("page with next cursor should be full, got %d", len(txs))
+			}
+			for _, tx := range txs {
+				if pkg.ShardOf(tx.TXid, shardCount) != shard {
+					t.Fatalf("TX %s does not belong to shard %d", tx.TXid, shard)
+				}
+				if !created[tx.TXid] {
+					t.Fatalf("TX %s returned twice or unknown", tx.TXid)
+				}
+				delete(created, tx.TXid)
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+	if len(created) != 0 {
+		t.Fatalf("TXs not returned by any shard: %v", created)
+	}
+}
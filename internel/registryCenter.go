@@ -2,6 +2,7 @@ package internel
 
 import (
 	"TCC/model"
+	"TCC/pkg"
 	"errors"
 	"fmt"
 	"sync"
@@ -34,7 +35,7 @@ func (rc *RegistryCenter) GetComponentByIDs(componentIDs ...string) ([]model.TCC
 		if component, ok := rc.components[id]; ok {
 			components = append(components, component)
 		} else {
-			return nil, fmt.Errorf("component id:%v does not exist", id)
+			return nil, fmt.Errorf("component id:%v does not exist: %w", id, pkg.ErrComponentNotFound)
 		}
 	}
 	return components, nil
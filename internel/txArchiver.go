@@ -0,0 +1,192 @@
+package internel
+
+import (
+	"TCC/DAO"
+	"TCC/metrics"
+	"TCC/pkg"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 默认保留已结束事务7天
+	DefaultArchiveRetention = 7 * 24 * time.Hour
+	DefaultArchiveBatchSize = 100
+	DefaultArchiveInterval  = time.Hour
+)
+
+// 归档器: 定期将结束时间早于保留期的已结束事务转移到归档表或JSONL文件, 然后分批物理删除.
+// 归档与删除是幂等的, 多个副本可同时运行; 导出JSONL时进程在写入后、删除前退出会使下次运行重复导出这些记录
+type TXArchiver struct {
+	dao DAO.TXRecordDAOInterface
+
+	retention time.Duration
+	batchSize int
+	interval  time.Duration
+	//不为空时导出为JSONL, 否则写入归档表
+	writer io.Writer
+
+	//同一时刻只执行一轮归档
+	runMux sync.Mutex
+	//保护后台归档的启停
+	startMux sync.Mutex
+	stop     context.CancelFunc
+	done     chan struct{}
+	lastRun  atomic.Int64
+}
+
+type TXArchiverOption func(a *TXArchiver)
+
+// 已结束事务的保留期, 以记录的最后更新时间计算
+func WithArchiveRetention(retention time.Duration) TXArchiverOption {
+	return func(a *TXArchiver) {
+		a.retention = retention
+	}
+}
+
+// 每批归档并删除的记录数
+func WithArchiveBatchSize(batchSize int) TXArchiverOption {
+	return func(a *TXArchiver) {
+		a.batchSize = batchSize
+	}
+}
+
+// 后台归档的间隔
+func WithArchiveInterval(interval time.Duration) TXArchiverOption {
+	return func(a *TXArchiver) {
+		a.interval = interval
+	}
+}
+
+// 将归档记录以JSONL写入w而不是归档表, 每批写入后再删除; w实现了Sync(如*os.File)时会在删除前落盘
+func WithArchiveWriter(w io.Writer) TXArchiverOption {
+	return func(a *TXArchiver) {
+		a.writer = w
+	}
+}
+
+func NewTXArchiver(dao DAO.TXRecordDAOInterface, opts ...TXArchiverOption) *TXArchiver {
+	a := &TXArchiver{
+		dao:       dao,
+		retention: DefaultArchiveRetention,
+		batchSize: DefaultArchiveBatchSize,
+		interval:  DefaultArchiveInterval,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.retention <= 0 {
+		a.retention = DefaultArchiveRetention
+	}
+	if a.batchSize <= 0 {
+		a.batchSize = DefaultArchiveBatchSize
+	}
+	if a.interval <= 0 {
+		a.interval = DefaultArchiveInterval
+	}
+
+	metrics.Publish("archiver.last_run", func() interface{} {
+		if last := a.lastRun.Load(); last > 0 {
+			return time.Unix(0, last)
+		}
+		return nil
+	})
+	return a
+}
+
+// 启动后台归档, 每隔interval执行一轮; 已启动时直接返回
+func (a *TXArchiver) Start() {
+	a.startMux.Lock()
+	defer a.startMux.Unlock()
+	if a.stop != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.stop = cancel
+	a.done = make(chan struct{})
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, _ = a.RunOnce(ctx) //失败已记录在指标中, 下一轮重试
+			}
+		}
+	}()
+}
+
+// 停止后台归档并等待当前批次结束, 之后可再次Start
+func (a *TXArchiver) Stop() {
+	a.startMux.Lock()
+	defer a.startMux.Unlock()
+	if a.stop == nil {
+		return
+	}
+	a.stop()
+	<-a.done
+	a.stop, a.done = nil, nil
+}
+
+// 执行一轮归档, 逐批处理直到没有过期的已结束事务; 返回本轮删除的记录数
+func (a *TXArchiver) RunOnce(ctx context.Context) (int64, error) {
+	a.runMux.Lock()
+	defer a.runMux.Unlock()
+
+	before := time.Now().Add(-a.retention)
+	var total int64
+	for {
+		records, err := a.dao.GetTXRecords(ctx,
+			DAO.WithStatusIn(pkg.TrySuccess, pkg.TryFailure), DAO.WithUpdatedBefore(before),
+			DAO.WithOrderByID(), DAO.WithLimit(a.batchSize), DAO.WithBranches())
+		var purged int64
+		if err == nil && len(records) > 0 {
+			purged, err = a.archive(ctx, records)
+		}
+		if err != nil {
+			metrics.Counter("archiver.errors").Add(1)
+			return total, fmt.Errorf("archive TX records: %w", err)
+		}
+		total += purged
+		//只统计处理过记录的批次
+		if len(records) > 0 {
+			metrics.Counter("archiver.archived").Add(purged)
+			metrics.Counter("archiver.batches").Add(1)
+		}
+
+		//未取满一批说明已经处理完; 一条都未删除时停止, 避免反复处理同一批记录
+		if len(records) < a.batchSize || purged == 0 {
+			a.lastRun.Store(time.Now().UnixNano())
+			return total, nil
+		}
+	}
+}
+
+func (a *TXArchiver) archive(ctx context.Context, records []*DAO.TXRecordPO) (int64, error) {
+	if a.writer == nil {
+		return a.dao.ArchiveTXRecords(ctx, records)
+	}
+
+	archivedAt := time.Now()
+	encoder := json.NewEncoder(a.writer)
+	for _, record := range records {
+		if err := encoder.Encode(DAO.NewTXRecordArchive(record, archivedAt)); err != nil {
+			return 0, err
+		}
+	}
+	if syncer, ok := a.writer.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return a.dao.PurgeTXRecords(ctx, records)
+}
@@ -0,0 +1,141 @@
+package internel
+
+import (
+	"TCC/DAO"
+	"TCC/metrics"
+	"TCC/pkg"
+	"TCC/testutil"
+	"TCC/testutil/memlock"
+	"bytes"
+	"context"
+	"encoding/json"
+	"runtime"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 创建n个已提交的事务与一个悬挂事务, 并将它们的更新时间调到保留期之前
+func prepareFinishedTXs(t *testing.T, db *gorm.DB, store *MockTXStore, n int) {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		txId, err := store.CreateTX(ctx, "", NewMockComponent("cp1", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = store.TXSubmit(ctx, txId, i%2 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.CreateTX(ctx, "hanging", NewMockComponent("cp1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&DAO.TXRecordPO{}).Where("1 = 1").UpdateColumn("updated_at", time.Now().Add(-2*time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_archiver_to_table(t *testing.T) {
+	db := testutil.NewDB(t, &DAO.TXRecordPO{}, &DAO.TXBranchPO{}, &DAO.TXRecordArchivePO{})
+	dao := DAO.NewTXRecordDAO(db)
+	store := NewMockTXStore(dao, memlock.NewClient(nil))
+	prepareFinishedTXs(t, db, store, 5)
+	ctx := context.Background()
+
+	archived, batches := metrics.Counter("archiver.archived").Value(), metrics.Counter("archiver.batches").Value()
+	archiver := NewTXArchiver(dao, WithArchiveRetention(time.Hour), WithArchiveBatchSize(2))
+	purged, err := archiver.RunOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 5 || metrics.Counter("archiver.archived").Value()-archived != 5 {
+		t.Fatalf("expect 5 records archived, got: %d", purged)
+	}
+	if got := metrics.Counter("archiver.batches").Value() - batches; got != 3 {
+		t.Fatalf("expect 3 batches, got: %d", got)
+	}
+	//没有可归档的记录时不计入批次
+	if _, err = archiver.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics.Counter("archiver.batches").Value() - batches; got != 3 {
+		t.Fatalf("empty run should not count a batch, got: %d", got)
+	}
+
+	//悬挂事务不会被归档
+	records, _ := dao.GetTXRecords(ctx)
+	if len(records) != 1 || records[0].TXId != "hanging" {
+		t.Fatalf("only hanging TX should remain, got: %+v", records)
+	}
+	var archives []*DAO.TXRecordArchivePO
+	if err = db.Find(&archives).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 5 || !bytes.Contains(archives[0].Branches, []byte(`"cp1"`)) {
+		t.Fatalf("unexpected archives: %+v", archives)
+	}
+	var branches int64
+	db.Model(&DAO.TXBranchPO{}).Count(&branches)
+	if branches != 1 {
+		t.Fatalf("branches of archived TXs should be deleted, remain: %d", branches)
+	}
+	if !db.Migrator().HasIndex(&DAO.TXRecordPO{}, "idx_tx_record_status_updated") {
+		t.Fatal("archive query should be covered by the (status, updated_at) index")
+	}
+	if metrics.Get("archiver.last_run").String() == "null" {
+		t.Fatal("last run should be published")
+	}
+}
+
+func Test_archiver_to_jsonl(t *testing.T) {
+	db := testutil.NewDB(t, &DAO.TXRecordPO{}, &DAO.TXBranchPO{})
+	dao := DAO.NewTXRecordDAO(db)
+	store := NewMockTXStore(dao, memlock.NewClient(nil))
+	prepareFinishedTXs(t, db, store, 3)
+
+	//保留期内的事务不会被归档
+	var buf bytes.Buffer
+	purged, err := NewTXArchiver(dao, WithArchiveRetention(3*time.Hour), WithArchiveWriter(&buf)).RunOnce(context.Background())
+	if err != nil || purged != 0 || buf.Len() != 0 {
+		t.Fatalf("nothing should be archived within retention, got: %d, %v", purged, err)
+	}
+
+	purged, err = NewTXArchiver(dao, WithArchiveRetention(time.Hour), WithArchiveWriter(&buf)).RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if purged != 3 || len(lines) != 3 {
+		t.Fatalf("expect 3 records exported, got: %d, %d lines", purged, len(lines))
+	}
+	archive := &DAO.TXRecordArchivePO{}
+	if err = json.Unmarshal(lines[0], archive); err != nil {
+		t.Fatal(err)
+	}
+	if archive.TXId == "" || archive.Status != pkg.TrySuccess.String() {
+		t.Fatalf("unexpected archive: %+v", archive)
+	}
+}
+
+// 重复Start只启动一个后台协程, Stop后可再次启动
+func Test_archiver_start_twice(t *testing.T) {
+	dao := DAO.NewTXRecordDAO(testutil.NewDB(t, &DAO.TXRecordPO{}, &DAO.TXBranchPO{}, &DAO.TXRecordArchivePO{}))
+	archiver := NewTXArchiver(dao, WithArchiveInterval(time.Hour))
+
+	base := runtime.NumGoroutine()
+	archiver.Start()
+	done := archiver.done
+	archiver.Start()
+	if archiver.done != done || runtime.NumGoroutine() != base+1 {
+		t.Fatalf("second start should not launch another goroutine, goroutines: %d, base: %d", runtime.NumGoroutine(), base)
+	}
+	archiver.Stop()
+	archiver.Stop()
+
+	archiver.Start()
+	if archiver.done == done {
+		t.Fatal("archiver should restart after stop")
+	}
+	archiver.Stop()
+}
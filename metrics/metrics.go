@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"expvar"
+	"sync"
+)
+
+// 所有指标通过expvar挂在"tcc"下, 引入net/http/pprof或expvar.Handler的服务可在/debug/vars查看
+var (
+	vars = expvar.NewMap("tcc")
+	mux  sync.Mutex
+)
+
+// 发布按需计算的指标, 每次读取时调用value; 同名指标会被覆盖
+func Publish(name string, value func() interface{}) {
+	vars.Set(name, expvar.Func(value))
+}
+
+// 获取计数器, 不存在时创建
+func Counter(name string) *expvar.Int {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if counter, ok := vars.Get(name).(*expvar.Int); ok {
+		return counter
+	}
+	counter := new(expvar.Int)
+	vars.Set(name, counter)
+	return counter
+}
+
+// 获取已发布的指标, 不存在时返回nil
+func Get(name string) expvar.Var {
+	return vars.Get(name)
+}
@@ -7,11 +7,36 @@ import (
 )
 
 type TXStore interface {
-	CreateTX(ctx context.Context, components ...TCCComponent) (string, error)
+	//使用外部生成的事务id创建事务, TXId为空时由储存中心生成
+	CreateTX(ctx context.Context, TXId string, components ...TCCComponent) (string, error)
+	//携带幂等键创建事务, 幂等键在保留期内已存在时返回已有的事务id且created为false
+	CreateTXWithKey(ctx context.Context, TXId string, key string, retention time.Duration, components ...TCCComponent) (string, bool, error)
+	//释放创建时间早于before的事务的幂等键, 返回释放的数量
+	ReleaseExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int64, error)
 	TXUpdate(ctx context.Context, TXId string, componentId string, successful bool) error
+	//记录组件的二阶段结果: successful为true表示已confirm, 否则表示已cancel
+	TXPhase2Update(ctx context.Context, TXId string, componentId string, successful bool) error
+	//记录组件一次失败的执行(try或二阶段)及其原因
+	TXRecordFailure(ctx context.Context, TXId string, componentId string, cause error) error
 	TXSubmit(ctx context.Context, TXId string, successful bool) error
-	GetHangingTXs(context.Context) ([]*pkg.Transaction, error)
+	//恢复悬挂事务时携带租约的fencing token提交事务状态, 租约已被其他副本以更大的token接管时返回pkg.ErrStaleFencingToken
+	TXSubmitFenced(ctx context.Context, TXId string, successful bool, token int64) error
+	//分页获取悬挂事务, 返回下一页的游标, 游标为空表示已取完
+	GetHangingTXs(ctx context.Context, opts ...pkg.HangingTXOption) ([]*pkg.Transaction, string, error)
 	GetTX(ctx context.Context, TXId string) (pkg.Transaction, error)
-	Lock(ctx context.Context, duration time.Duration) error
+	//加锁成功后返回租约, 租约丢失时持有者应中止受锁保护的操作.
+	//duration为租约的过期时间, 持有期间自动续期, 持有者崩溃后最多经过duration可被其他副本取得
+	Lock(ctx context.Context, duration time.Duration) (Lease, error)
 	Unlock(ctx context.Context) error
+	//以租约的方式认领分片, 续期语义同Lock; 租约过期后分片可被其他副本认领
+	LockShard(ctx context.Context, shard int, duration time.Duration) (Lease, error)
+	UnlockShard(ctx context.Context, shard int) error
+}
+
+// 储存中心的全局锁或分片租约
+type Lease struct {
+	//租约丢失时关闭
+	Lost <-chan struct{}
+	//租约的fencing token, 之后取得的租约token更大; 提交事务状态时携带, 使过期持有者的提交被拒绝
+	FencingToken int64
 }
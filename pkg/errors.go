@@ -0,0 +1,18 @@
+package pkg
+
+import "errors"
+
+//该文件主要记录事务执行过程中的通用错误, 可配合errors.Is使用
+
+var (
+	//组件try返回未确认或返回了超时以外的错误
+	ErrTryRejected = errors.New("try rejected by component")
+	//组件try超时
+	ErrTryTimeout = errors.New("try timeout")
+	//组件未注册
+	ErrComponentNotFound = errors.New("component not found")
+	//事务的二阶段未能在本次执行中完成, 事务仍未结束, 会由轮询继续推进
+	ErrTXPending = errors.New("tx pending")
+	//携带的fencing token比资源已见过的token小, 说明锁已被其他持有者取得
+	ErrStaleFencingToken = errors.New("stale fencing token")
+)
@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//该文件主要记录事务id生成器, 事务id在持久化之前生成, 便于提前记录日志
+
+type IDGenerator interface {
+	NextID() (string, error)
+}
+
+// ---------------------------------------------snowflake---------------------------------------------
+
+const (
+	// snowflake起始时间: 2024-01-01 00:00:00 UTC
+	SnowflakeEpochMillis = 1704067200000
+
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+	snowflakeMaxNode      = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSequence  = 1<<snowflakeSequenceBits - 1
+)
+
+var ErrClockMovedBackwards = errors.New("clock moved backwards")
+
+// 41位毫秒时间戳 + 10位节点id + 12位序列号, 节点id需要在各副本间唯一
+type SnowflakeGenerator struct {
+	mux      sync.Mutex
+	now      func() time.Time
+	node     int64
+	lastTime int64
+	sequence int64
+}
+
+func NewSnowflakeGenerator(node int64) (*SnowflakeGenerator, error) {
+	if node < 0 || node > snowflakeMaxNode {
+		return nil, errors.New("snowflake node must be in [0, 1023]")
+	}
+	return &SnowflakeGenerator{node: node, now: time.Now}, nil
+}
+
+func (g *SnowflakeGenerator) NextID() (string, error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	now := g.now().UnixMilli() - SnowflakeEpochMillis
+	if now < g.lastTime {
+		return "", ErrClockMovedBackwards
+	}
+	if now == g.lastTime {
+		g.sequence = (g.sequence + 1) & snowflakeMaxSequence
+		if g.sequence == 0 {
+			//当前毫秒的序列号已用完, 等待下一毫秒
+			for now <= g.lastTime {
+				now = g.now().UnixMilli() - SnowflakeEpochMillis
+			}
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastTime = now
+
+	id := now<<(snowflakeNodeBits+snowflakeSequenceBits) | g.node<<snowflakeSequenceBits | g.sequence
+	return strconv.FormatInt(id, 10), nil
+}
+
+// ---------------------------------------------ULID---------------------------------------------
+
+// Crockford base32 编码表
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// 48位毫秒时间戳 + 80位随机数, 编码为26位字符串, 按字典序即按时间排序.
+// 同一毫秒内随机数递增, 保证同一生成器生成的id单调递增
+type ULIDGenerator struct {
+	random *monotonicRandom
+}
+
+func NewULIDGenerator() *ULIDGenerator {
+	return &ULIDGenerator{random: newMonotonicRandom([10]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})}
+}
+
+func (g *ULIDGenerator) NextID() (string, error) {
+	millis, random, err := g.random.next()
+	if err != nil {
+		return "", err
+	}
+	var id [16]byte
+	putMillis(id[:6], millis)
+	copy(id[6:], random[:])
+
+	//128位按5位一组编码, 首字符只使用高3位
+	buf := make([]byte, 26)
+	var acc uint64
+	var bits uint
+	pos := 25
+	for i := len(id) - 1; i >= 0; i-- {
+		acc |= uint64(id[i]) << bits
+		bits += 8
+		for bits >= 5 && pos >= 0 {
+			buf[pos] = crockfordAlphabet[acc&0x1f]
+			acc >>= 5
+			bits -= 5
+			pos--
+		}
+	}
+	buf[0] = crockfordAlphabet[acc&0x1f]
+	return string(buf), nil
+}
+
+// ---------------------------------------------UUIDv7---------------------------------------------
+
+// RFC 9562 UUID version 7: 48位毫秒时间戳 + 版本号 + 随机数.
+// 同一毫秒内随机数递增(RFC 9562 6.2 方法2), 保证同一生成器生成的id单调递增
+type UUIDv7Generator struct {
+	random *monotonicRandom
+}
+
+func NewUUIDv7Generator() *UUIDv7Generator {
+	//版本号占用第1个字节的高4位, variant占用第3个字节的高2位
+	return &UUIDv7Generator{random: newMonotonicRandom([10]byte{0x0f, 0xff, 0x3f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})}
+}
+
+func (g *UUIDv7Generator) NextID() (string, error) {
+	millis, random, err := g.random.next()
+	if err != nil {
+		return "", err
+	}
+	var id [16]byte
+	putMillis(id[:6], millis)
+	copy(id[6:], random[:])
+	id[6] = id[6]&0x0f | 0x70 //version 7
+	id[8] = id[8]&0x3f | 0x80 //variant 10
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], id[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], id[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], id[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], id[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], id[10:])
+	return string(buf), nil
+}
+
+// 以大端序写入48位毫秒时间戳
+func putMillis(b []byte, millis int64) {
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(millis)
+		millis >>= 8
+	}
+}
+
+// 单调递增的时间戳与随机数: 同一毫秒内(或时钟回拨时)沿用上次的时间戳并将随机数加一,
+// 随机数用尽时时间戳加一并重新生成随机数
+type monotonicRandom struct {
+	mux sync.Mutex
+	now func() time.Time
+	//每个字节中可用于随机数的低位
+	masks      [10]byte
+	lastMillis int64
+	last       [10]byte
+}
+
+func newMonotonicRandom(masks [10]byte) *monotonicRandom {
+	return &monotonicRandom{now: time.Now, masks: masks}
+}
+
+func (m *monotonicRandom) next() (int64, [10]byte, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	millis := m.now().UnixMilli()
+	if millis <= m.lastMillis {
+		if m.increment() {
+			return m.lastMillis, m.last, nil
+		}
+		millis = m.lastMillis + 1
+	}
+	if _, err := rand.Read(m.last[:]); err != nil {
+		return 0, m.last, err
+	}
+	for i := range m.last {
+		m.last[i] &= m.masks[i]
+	}
+	m.lastMillis = millis
+	return millis, m.last, nil
+}
+
+// 将随机数作为大端序整数加一, 只使用masks中的位; 溢出时返回false
+func (m *monotonicRandom) increment() bool {
+	for i := len(m.last) - 1; i >= 0; i-- {
+		if m.last[i] < m.masks[i] {
+			m.last[i]++
+			return true
+		}
+		m.last[i] = 0
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package pkg
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 可手动设置的时钟, calls记录调用次数
+type stubClock struct {
+	mux   sync.Mutex
+	now   time.Time
+	calls int
+	//不为空时每次调用后执行, 可用于在调用中拨动时钟
+	onCall func(c *stubClock)
+}
+
+func (c *stubClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.calls++
+	now := c.now
+	if c.onCall != nil {
+		c.onCall(c)
+	}
+	return now
+}
+
+func Test_snowflake_generator(t *testing.T) {
+	if _, err := NewSnowflakeGenerator(1024); err == nil {
+		t.Fatal("node out of range should be rejected")
+	}
+	g, err := NewSnowflakeGenerator(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last int64
+	for i := 0; i < 10000; i++ {
+		id, err := g.NextID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := strconv.ParseInt(id, 10, 64)
+		if n <= last {
+			t.Fatalf("ids should be increasing: %d after %d", n, last)
+		}
+		if node := n >> snowflakeSequenceBits & snowflakeMaxNode; node != 5 {
+			t.Fatalf("unexpected node: %d", node)
+		}
+		last = n
+	}
+}
+
+func Test_snowflake_sequence_rollover(t *testing.T) {
+	start := time.UnixMilli(SnowflakeEpochMillis + 1000)
+	clock := &stubClock{now: start}
+	g, _ := NewSnowflakeGenerator(1)
+	g.now = clock.Now
+
+	for i := 0; i <= snowflakeMaxSequence; i++ {
+		id, err := g.NextID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := strconv.ParseInt(id, 10, 64)
+		if seq := n & snowflakeMaxSequence; seq != int64(i) {
+			t.Fatalf("expect sequence %d, got %d", i, seq)
+		}
+	}
+
+	//序列号用尽后等待时钟进入下一毫秒
+	clock.mux.Lock()
+	waitFrom := clock.calls
+	clock.onCall = func(c *stubClock) {
+		if c.calls > waitFrom+3 {
+			c.now = start.Add(time.Millisecond)
+		}
+	}
+	clock.mux.Unlock()
+	id, err := g.NextID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.ParseInt(id, 10, 64)
+	if seq, millis := n&snowflakeMaxSequence, n>>(snowflakeNodeBits+snowflakeSequenceBits); seq != 0 || millis != 1001 {
+		t.Fatalf("expect sequence 0 of next millisecond, got sequence %d at %d", seq, millis)
+	}
+}
+
+func Test_snowflake_clock_backwards(t *testing.T) {
+	clock := &stubClock{now: time.Now()}
+	g, _ := NewSnowflakeGenerator(1)
+	g.now = clock.Now
+	if _, err := g.NextID(); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(-time.Second)
+	if _, err := g.NextID(); !errors.Is(err, ErrClockMovedBackwards) {
+		t.Fatal("expect ErrClockMovedBackwards, got: ", err)
+	}
+}
+
+var (
+	ulidPattern   = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+	uuidv7Pattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+)
+
+// 生成n个id, 检查格式并且严格按字典序递增
+func assertMonotonicIDs(t *testing.T, g IDGenerator, pattern *regexp.Regexp, n int) []string {
+	t.Helper()
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := g.NextID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pattern.MatchString(id) {
+			t.Fatalf("malformed id: %s", id)
+		}
+		if i > 0 && id <= ids[i-1] {
+			t.Fatalf("ids should be increasing: %s after %s", id, ids[i-1])
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func Test_ulid_generator(t *testing.T) {
+	before := time.Now().UnixMilli()
+	ids := assertMonotonicIDs(t, NewULIDGenerator(), ulidPattern, 10000)
+
+	//前10个字符为毫秒时间戳
+	var millis int64
+	for _, c := range ids[0][:10] {
+		millis = millis<<5 | int64(indexOf(crockfordAlphabet, byte(c)))
+	}
+	if millis < before || millis > time.Now().UnixMilli() {
+		t.Fatalf("unexpected timestamp %d in %s", millis, ids[0])
+	}
+}
+
+func Test_uuidv7_generator(t *testing.T) {
+	before := time.Now().UnixMilli()
+	ids := assertMonotonicIDs(t, NewUUIDv7Generator(), uuidv7Pattern, 10000)
+
+	millis, _ := strconv.ParseInt(ids[0][:8]+ids[0][9:13], 16, 64)
+	if millis < before || millis > time.Now().UnixMilli() {
+		t.Fatalf("unexpected timestamp %d in %s", millis, ids[0])
+	}
+}
+
+func Test_monotonic_ids_on_frozen_and_backwards_clock(t *testing.T) {
+	ulid, uuidv7 := NewULIDGenerator(), NewUUIDv7Generator()
+	for name, g := range map[string]struct {
+		gen     IDGenerator
+		random  *monotonicRandom
+		pattern *regexp.Regexp
+	}{
+		"ulid":   {gen: ulid, random: ulid.random, pattern: ulidPattern},
+		"uuidv7": {gen: uuidv7, random: uuidv7.random, pattern: uuidv7Pattern},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clock := &stubClock{now: time.Now()}
+			random := g.random
+			random.now = clock.Now
+
+			//时钟不动或回拨时id仍然递增
+			first := assertMonotonicIDs(t, g.gen, g.pattern, 100)
+			clock.now = clock.now.Add(-time.Hour)
+			second := assertMonotonicIDs(t, g.gen, g.pattern, 100)
+			if second[0] <= first[len(first)-1] {
+				t.Fatalf("ids should keep increasing after clock moved backwards: %s after %s", second[0], first[len(first)-1])
+			}
+
+			//随机数用尽时时间戳加一
+			lastMillis := random.lastMillis
+			random.last = random.masks
+			id, err := g.gen.NextID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if random.lastMillis != lastMillis+1 || id <= second[len(second)-1] {
+				t.Fatalf("timestamp should advance on overflow: %s", id)
+			}
+		})
+	}
+}
+
+func indexOf(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == c {
+			return i
+		}
+	}
+	return -1
+}
@@ -1,19 +1,208 @@
 package pkg
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
+const (
+	// 默认的key命名空间
+	DefaultKeyNamespace = "tcc"
+	// 当前的key格式版本
+	CurrentKeyVersion = "v1"
+	// key各部分之间的分隔符
+	KeyDelimiter = ":"
+)
+
+// 默认的KeyBuilder, 命名空间为DefaultKeyNamespace, 版本为CurrentKeyVersion, 不使用hash tag
+var DefaultKeyBuilder = NewKeyBuilder()
+
+// redis key构造器, 生成的key形如 <命名空间>:<版本>:<类型>:<id>:<id>...
+// id中的分隔符、转义符与hash tag的花括号会被转义, 不同的id组合不会生成相同的key.
+// 多个应用共用一个redis时应使用不同的命名空间.
+//
+// key的格式变更时提升版本号, 不同版本的key互不可见. 切换版本时不能滚动发布, 否则新旧副本各自加锁、
+// 读写各自的key, 锁与事务状态会被拆分到两套key中. 切换步骤:
+//  1. 停止所有旧版本副本发起新事务;
+//  2. 等待进行中的事务完成二阶段, 旧版本的锁全部释放或过期;
+//  3. 启动新版本的副本.
+//
+// 引入KeyBuilder之前的key(TX_key:、REDIS_LOCK_PREFIX等, 见BuildTXKey)视为版本v0, 切换到v1时同样遵循上述步骤,
+// 需要保留的旧数据可通过BuildTXKey等函数定位后迁移
+type KeyBuilder struct {
+	namespace string
+	version   string
+	hashTag   bool
+}
+
+type KeyBuilderOption func(b *KeyBuilder)
+
+// 设置命名空间, 通常为应用名
+func WithKeyNamespace(namespace string) KeyBuilderOption {
+	return func(b *KeyBuilder) {
+		b.namespace = namespace
+	}
+}
+
+// 设置key的格式版本, 为空时key中不包含版本; 默认为CurrentKeyVersion
+func WithKeyVersion(version string) KeyBuilderOption {
+	return func(b *KeyBuilder) {
+		b.version = version
+	}
+}
+
+// 启用Cluster hash tag: 将key的第一个id包在{}中, 同一事务、同一把锁的所有key落在同一个slot,
+// 保证多key的lua脚本与MULTI事务在Cluster下可用
+func WithHashTag() KeyBuilderOption {
+	return func(b *KeyBuilder) {
+		b.hashTag = true
+	}
+}
+
+func NewKeyBuilder(opts ...KeyBuilderOption) *KeyBuilder {
+	b := &KeyBuilder{namespace: DefaultKeyNamespace, version: CurrentKeyVersion}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// 构造类型为kind的key, 第一个id为路由id, 启用hash tag时以它计算slot
+func (b *KeyBuilder) Key(kind string, ids ...string) string {
+	var sb strings.Builder
+	if b.namespace != "" {
+		sb.WriteString(escapeKeyPart(b.namespace))
+		sb.WriteString(KeyDelimiter)
+	}
+	if b.version != "" {
+		sb.WriteString(escapeKeyPart(b.version))
+		sb.WriteString(KeyDelimiter)
+	}
+	sb.WriteString(escapeKeyPart(kind))
+	for i, id := range ids {
+		sb.WriteString(KeyDelimiter)
+		if i == 0 && b.hashTag {
+			sb.WriteString("{" + escapeKeyPart(id) + "}")
+			continue
+		}
+		sb.WriteString(escapeKeyPart(id))
+	}
+	return sb.String()
+}
+
+// 组件中事务的状态
+func (b *KeyBuilder) TX(componentId, txId string) string {
+	return b.Key("tx", txId, componentId)
+}
+
+// 组件中事务的明细
+func (b *KeyBuilder) TXDetail(componentId, txId string) string {
+	return b.Key("tx_detail", txId, componentId)
+}
+
+// 组件中事务最近一次写入时携带的fencing token
+func (b *KeyBuilder) TXFencing(componentId, txId string) string {
+	return b.Key("tx_fencing", txId, componentId)
+}
+
+// 组件中事务涉及的业务数据
+func (b *KeyBuilder) Data(componentId, txId, bizId string) string {
+	return b.Key("data", txId, componentId, bizId)
+}
+
+// 分布式锁, 同一把锁的附属key(如读写锁的读锁、公平锁的等待队列)通过suffix区分, 与锁落在同一个slot.
+// name可以是JoinKeyParts拼接的多个部分(如ComponentLockName), 拆分后各部分只转义一次, 启用hash tag时以第一部分计算slot
+func (b *KeyBuilder) Lock(name string, suffix ...string) string {
+	return b.Key("lock", append(SplitKeyParts(name), suffix...)...)
+}
+
+// 组件处理某个事务时使用的锁名, 锁key为KeyBuilder.Key("lock", txId, componentId)
+func ComponentLockName(componentId, txId string) string {
+	return JoinKeyParts(txId, componentId)
+}
+
+// 储存中心恢复悬挂事务时使用的全局锁名
+func TXStoreLockName() string {
+	return "tx_store"
+}
+
+// 储存中心恢复某个分片的悬挂事务时使用的租约锁名
+func ShardLeaseName(shard int) string {
+	return JoinKeyParts("shard_lease", strconv.Itoa(shard))
+}
+
+// 转义各部分后以分隔符拼接
+func JoinKeyParts(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, part := range parts {
+		escaped[i] = escapeKeyPart(part)
+	}
+	return strings.Join(escaped, KeyDelimiter)
+}
+
+// JoinKeyParts的逆操作: 按未转义的分隔符拆分并还原各部分, 不合法的转义按原样保留
+func SplitKeyParts(joined string) []string {
+	var parts []string
+	var sb strings.Builder
+	for i := 0; i < len(joined); i++ {
+		if joined[i] == '\\' && i+1 < len(joined) {
+			if unescaped, ok := keyPartUnescapes[joined[i+1]]; ok {
+				sb.WriteString(unescaped)
+				i++
+				continue
+			}
+		}
+		if joined[i] == KeyDelimiter[0] {
+			parts = append(parts, sb.String())
+			sb.Reset()
+			continue
+		}
+		sb.WriteByte(joined[i])
+	}
+	return append(parts, sb.String())
+}
+
+// 转义符之后的字符 -> 还原后的内容, 与keyPartEscaper对应
+var keyPartUnescapes = map[byte]string{'\\': `\`, KeyDelimiter[0]: KeyDelimiter, '[': "{", ']': "}"}
+
+// 花括号替换为\[与\], 避免id中的花括号被redis当作hash tag
+var keyPartEscaper = strings.NewReplacer(`\`, `\\`, KeyDelimiter, `\`+KeyDelimiter, "{", `\[`, "}", `\]`)
+
+func escapeKeyPart(part string) string {
+	return keyPartEscaper.Replace(part)
+}
+
+// ---------------------------------------------v0---------------------------------------------
+
+// 以下为引入KeyBuilder之前(v0)的key格式, 仅用于切换到v1时定位与迁移旧数据, 新代码应使用KeyBuilder
+
+// Deprecated: 使用KeyBuilder.TX
 func BuildTXKey(componentId, txId string) string {
 	return fmt.Sprintf("TX_key:%s_%s", txId, componentId)
 }
 
+// Deprecated: 使用KeyBuilder.TXDetail
 func BuildTXKeyWithDetail(componentId, txId string) string {
 	return fmt.Sprintf("TX_detail_key:%s_%s", componentId, txId)
 }
 
+// Deprecated: 使用KeyBuilder.Data
+func BuildDataKey(componentId, txId, bizid string) string {
+	return fmt.Sprintf("DATA_key:%s_%s_%s", txId, componentId, bizid)
+}
+
+// Deprecated: 使用KeyBuilder.Lock与ComponentLockName, 旧版本的锁key为redis_lock.RedisLockKeyPrePrefix+该函数的返回值
 func BuildRedisLockKey(componentId, txId string) string {
 	return fmt.Sprintf("TX_lock_key:%s_%s", txId, componentId)
 }
 
-func BuildDataKey(componentId, txId, bizid string) string {
-	return fmt.Sprintf("DATA_key:%s_%s_%s", txId, componentId, bizid)
+// Deprecated: 使用KeyBuilder.Lock与TXStoreLockName
+func BuildTXStoreLockKey() string {
+	return "TX_store_lock_key"
+}
+
+// Deprecated: 使用KeyBuilder.Lock与ShardLeaseName
+func BuildShardLeaseKey(shard int) string {
+	return fmt.Sprintf("TX_shard_lease_key:%d", shard)
 }
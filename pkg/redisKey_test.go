@@ -0,0 +1,93 @@
+package pkg
+
+import "testing"
+
+func Test_key_builder(t *testing.T) {
+	keys := NewKeyBuilder(WithKeyNamespace("app1"))
+	if got := keys.TX("cp1", "tx1"); got != "app1:v1:tx:tx1:cp1" {
+		t.Fatalf("unexpected tx key: %s", got)
+	}
+	if got := keys.Data("cp1", "tx1", "biz1"); got != "app1:v1:data:tx1:cp1:biz1" {
+		t.Fatalf("unexpected data key: %s", got)
+	}
+
+	//不同的命名空间不会冲突
+	if NewKeyBuilder(WithKeyNamespace("app2")).TX("cp1", "tx1") == keys.TX("cp1", "tx1") {
+		t.Fatal("keys of different namespaces should not collide")
+	}
+
+	//id中包含下划线或分隔符时不同的id组合不会冲突
+	pairs := [][2][2]string{
+		{{"a_b", "c"}, {"a", "b_c"}},
+		{{"a:b", "c"}, {"a", "b:c"}},
+		{{`a\`, ":c"}, {`a\:`, "c"}},
+	}
+	for _, pair := range pairs {
+		k1, k2 := keys.TX(pair[0][0], pair[0][1]), keys.TX(pair[1][0], pair[1][1])
+		if k1 == k2 {
+			t.Fatalf("keys should not collide: %v %v -> %s", pair[0], pair[1], k1)
+		}
+	}
+}
+
+func Test_key_builder_hash_tag(t *testing.T) {
+	keys := NewKeyBuilder(WithHashTag())
+	if got := keys.TX("cp1", "tx1"); got != "tcc:v1:tx:{tx1}:cp1" {
+		t.Fatalf("unexpected tx key: %s", got)
+	}
+	if got := keys.Lock("order", "read"); got != "tcc:v1:lock:{order}:read" {
+		t.Fatalf("unexpected lock key: %s", got)
+	}
+	//id中的花括号被转义, 不会改变key的slot
+	if got := keys.TX("cp1", "{x}"); got != `tcc:v1:tx:{\[x\]}:cp1` {
+		t.Fatalf("unexpected escaped key: %s", got)
+	}
+}
+
+// 不同版本的key互不相同, 版本为空时key中不包含版本
+func Test_key_builder_version(t *testing.T) {
+	v1 := NewKeyBuilder()
+	v2 := NewKeyBuilder(WithKeyVersion("v2"))
+	if got := v2.Lock("order"); got != "tcc:v2:lock:order" {
+		t.Fatalf("unexpected versioned key: %s", got)
+	}
+	if v1.TX("cp1", "tx1") == v2.TX("cp1", "tx1") {
+		t.Fatal("keys of different versions should not collide")
+	}
+	if got := NewKeyBuilder(WithKeyVersion("")).TX("cp1", "tx1"); got != "tcc:tx:tx1:cp1" {
+		t.Fatalf("unexpected unversioned key: %s", got)
+	}
+	//v0的key与任何版本的key都不相同
+	if BuildTXKey("cp1", "tx1") == v1.TX("cp1", "tx1") {
+		t.Fatal("v1 keys should not collide with v0 keys")
+	}
+}
+
+// 组件锁名中的id只转义一次, 锁key与直接以各id构造的key相同, 锁名可还原出各id
+func Test_component_lock_name_round_trip(t *testing.T) {
+	ids := [][2]string{
+		{"cp1", "tx1"},
+		{"cp:1", "tx:1"},
+		{`cp\`, `:tx`},
+		{"{cp}", `tx\[`},
+	}
+	for _, keys := range []*KeyBuilder{NewKeyBuilder(), NewKeyBuilder(WithHashTag())} {
+		for _, id := range ids {
+			componentId, txId := id[0], id[1]
+			name := ComponentLockName(componentId, txId)
+			if parts := SplitKeyParts(name); len(parts) != 2 || parts[0] != txId || parts[1] != componentId {
+				t.Fatalf("lock name %s should split into %v, got: %q", name, id, parts)
+			}
+			if got, want := keys.Lock(name), keys.Key("lock", txId, componentId); got != want {
+				t.Fatalf("lock key of %v should be %s, got: %s", id, want, got)
+			}
+			if got, want := keys.Lock(name, "fencing"), keys.Key("lock", txId, componentId, "fencing"); got != want {
+				t.Fatalf("suffixed lock key of %v should be %s, got: %s", id, want, got)
+			}
+		}
+	}
+	//不含分隔符与转义符的锁名保持不变
+	if got := NewKeyBuilder().Lock("order"); got != "tcc:v1:lock:order" {
+		t.Fatalf("unexpected lock key: %s", got)
+	}
+}
@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+//该文件主要记录悬挂事务的分片与分页查询参数
+
+// 哈希桶的数量, 也是分片数的上限.
+// 事务创建时将所属的桶持久化, 分片由若干个桶组成, 调整分片数时无需重新计算已有事务
+const ShardBucketCount = 1024
+
+// 根据事务id的哈希值计算事务所属的桶
+func ShardBucketOf(txId string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(txId))
+	return int(h.Sum32() % ShardBucketCount)
+}
+
+// 计算事务所属的分片
+func ShardOf(txId string, shardCount int) int {
+	if shardCount <= 1 {
+		return 0
+	}
+	return ShardBucketOf(txId) % shardCount
+}
+
+// 分片包含的所有桶, shardCount超过ShardBucketCount时多出的分片不包含任何桶
+func ShardBuckets(shard, shardCount int) []int {
+	if shardCount <= 1 {
+		shardCount = 1
+	}
+	buckets := make([]int, 0, ShardBucketCount/shardCount+1)
+	for bucket := shard; bucket < ShardBucketCount; bucket += shardCount {
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+type HangingTXQuery struct {
+	//单页最多返回的事务数, <=0 表示不限制
+	Limit int
+	//上一页返回的游标, 为空则从头开始
+	Cursor string
+	//事务创建时间的上下界, 零值表示不限制
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	//分片总数, <=1 表示不分片
+	ShardCount int
+	//当前查询的分片
+	Shard int
+}
+
+type HangingTXOption func(q *HangingTXQuery)
+
+func WithPageLimit(limit int) HangingTXOption {
+	return func(q *HangingTXQuery) {
+		q.Limit = limit
+	}
+}
+
+func WithPageCursor(cursor string) HangingTXOption {
+	return func(q *HangingTXQuery) {
+		q.Cursor = cursor
+	}
+}
+
+func WithCreatedAfter(createdAfter time.Time) HangingTXOption {
+	return func(q *HangingTXQuery) {
+		q.CreatedAfter = createdAfter
+	}
+}
+
+func WithCreatedBefore(createdBefore time.Time) HangingTXOption {
+	return func(q *HangingTXQuery) {
+		q.CreatedBefore = createdBefore
+	}
+}
+
+func WithShard(shard, shardCount int) HangingTXOption {
+	return func(q *HangingTXQuery) {
+		q.Shard = shard
+		q.ShardCount = shardCount
+	}
+}
+
+func NewHangingTXQuery(opts ...HangingTXOption) *HangingTXQuery {
+	q := &HangingTXQuery{}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// 当前查询的分片包含的桶, 不分片时返回nil
+func (q *HangingTXQuery) ShardBuckets() []int {
+	if q.ShardCount <= 1 {
+		return nil
+	}
+	return ShardBuckets(q.Shard, q.ShardCount)
+}
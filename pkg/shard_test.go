@@ -0,0 +1,39 @@
+package pkg
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_shard_assignment(t *testing.T) {
+	for _, shardCount := range []int{1, 3, 4, 7} {
+		//每个桶恰好属于一个分片
+		owner := make(map[int]int)
+		for shard := 0; shard < shardCount; shard++ {
+			for _, bucket := range ShardBuckets(shard, shardCount) {
+				if prev, ok := owner[bucket]; ok {
+					t.Fatalf("bucket %d belongs to shard %d and %d", bucket, prev, shard)
+				}
+				owner[bucket] = shard
+			}
+		}
+		if len(owner) != ShardBucketCount {
+			t.Fatalf("%d shards cover %d buckets", shardCount, len(owner))
+		}
+
+		//事务所属的分片包含事务所属的桶
+		for i := 0; i < 100; i++ {
+			txId := fmt.Sprintf("tx-%d", i)
+			if owner[ShardBucketOf(txId)] != ShardOf(txId, shardCount) {
+				t.Fatalf("shard of %s mismatches its bucket", txId)
+			}
+		}
+	}
+
+	if buckets := NewHangingTXQuery().ShardBuckets(); buckets != nil {
+		t.Fatalf("query without shard should not filter buckets: %v", buckets)
+	}
+	if buckets := ShardBuckets(ShardBucketCount, ShardBucketCount+1); len(buckets) != 0 {
+		t.Fatalf("extra shard should own no bucket: %v", buckets)
+	}
+}
@@ -0,0 +1,201 @@
+package redis_lock
+
+import (
+	"TCC/pkg"
+	"TCC/third_party"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// 公平锁等待唤醒的超时时间, 超时后会主动重试取锁, 防止唤醒通知丢失
+	FairLockPollIntervalSeconds = 1
+	// 等待者超过该时间未刷新则视为已放弃等待, 会被移出等待队列
+	FairLockWaiterTimeoutSeconds = 3 * FairLockPollIntervalSeconds
+	// 唤醒通知的过期时间
+	FairLockNotifyExpireSeconds = 10
+	// 进程内同时通过BLPOP等待唤醒的等待者上限. 每个BLPOP在等待期间占用一个连接池中的连接,
+	// 超过上限的等待者退化为每FairLockPollIntervalSeconds轮询一次, 避免大量等待者耗尽连接池.
+	// 该值应小于RedisClient的最大连接数
+	FairLockMaxBlockingWaiters = 16
+)
+
+// 进程内正在BLPOP的等待者, 容量为FairLockMaxBlockingWaiters
+var fairLockBlockingWaiters = make(chan struct{}, FairLockMaxBlockingWaiters)
+
+// 公平锁: 等待者按先来后到排队, 解锁时通过BLPOP唤醒队首等待者, 代替固定间隔的轮询.
+// 唤醒通知丢失时等待者会在FairLockPollIntervalSeconds后主动重试.
+// 等待者的超时时间以redis服务端时间计算, 不受各客户端时钟偏差影响
+type FairLock struct {
+	key    string
+	token  string
+	client third_party.BlockingLockClient
+
+	LockOptions
+
+	//看门狗
+	dog watchDog
+}
+
+func NewFairLock(key string, client third_party.BlockingLockClient, opts ...LockOption) *FairLock {
+	l := &FairLock{
+		key:    key,
+		client: client,
+		token:  getPidAndGidStr(),
+	}
+
+	for _, opt := range opts {
+		opt(&l.LockOptions)
+	}
+
+	repairLockOpt(&l.LockOptions)
+
+	return l
+}
+
+func (l *FairLock) Lock(ctx context.Context) error {
+	//非阻塞模式不入队, 队列中有等待者时直接失败
+	var waitTimeout int64
+	if l.isBlock {
+		waitTimeout = FairLockWaiterTimeoutSeconds
+	}
+
+	err := l.tryLock(ctx, waitTimeout)
+	if err != nil && l.isBlock && IsRetryableErr(err) {
+		err = l.waitLock(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.dog.watch(ctx, &l.LockOptions, l.DelayExpire)
+	return nil
+}
+
+// 排队等待唤醒, 被唤醒或等待超时后重试取锁
+func (l *FairLock) waitLock(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			//放弃等待时出队, 避免阻塞后面的等待者
+			_ = l.dequeue(context.WithoutCancel(ctx))
+		}
+	}()
+
+	deadline := time.Now().Add(time.Duration(l.blockWaitingSeconds) * time.Second)
+	for {
+		if ctx.Err() != nil {
+			return fmt.Errorf("ctx timeout, lock fai: %w", ctx.Err())
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("block wait timeout: %w", ErrLockInUse)
+		}
+
+		if err := l.waitNotify(ctx); err != nil {
+			return err
+		}
+
+		err := l.tryLock(ctx, FairLockWaiterTimeoutSeconds)
+		if err == nil {
+			return nil
+		}
+		if !IsRetryableErr(err) {
+			return err
+		}
+	}
+}
+
+// 等待唤醒通知, 最多等待FairLockPollIntervalSeconds; BLPOP的等待者已达上限时改为休眠同样的时长
+func (l *FairLock) waitNotify(ctx context.Context) error {
+	select {
+	case fairLockBlockingWaiters <- struct{}{}:
+		defer func() {
+			<-fairLockBlockingWaiters
+		}()
+	default:
+		timer := time.NewTimer(FairLockPollIntervalSeconds * time.Second)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		return nil
+	}
+
+	_, err := l.client.BLPop(ctx, l.getNotifyKey(), FairLockPollIntervalSeconds)
+	if err != nil && !errors.Is(err, ErrNil) && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func (l *FairLock) tryLock(ctx context.Context, waitTimeoutSeconds int64) error {
+	keysAndArgs := []interface{}{
+		l.getLockKey(), l.getQueueKey(), l.getTimeoutKey(),
+		l.token, l.expireSeconds, waitTimeoutSeconds * 1000,
+	}
+	reply, err := l.client.Eval(ctx, third_party.LuaFairLockAcquire, 3, keysAndArgs)
+	if err != nil {
+		return err
+	}
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("reply: %d, err: %w", ret, ErrLockInUse)
+	}
+	return nil
+}
+
+func (l *FairLock) dequeue(ctx context.Context) error {
+	keysAndArgs := []interface{}{
+		l.getLockKey(), l.getQueueKey(), l.getTimeoutKey(),
+		l.token, l.getNotifyPrefix(), FairLockNotifyExpireSeconds,
+	}
+	_, err := l.client.Eval(ctx, third_party.LuaFairLockDequeue, 3, keysAndArgs)
+	return err
+}
+
+// 更新锁的过期时间
+func (l *FairLock) DelayExpire(ctx context.Context, expireSeconds int64) error {
+	keysAndArgs := []interface{}{l.getLockKey(), l.token, expireSeconds}
+	reply, err := l.client.Eval(ctx, third_party.LuaCheckAndExpireDistributionLock, 1, keysAndArgs)
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("fail to delay expired key:%s expire:%d err: %w", l.getLockKey(), expireSeconds, err)
+	}
+	return nil
+}
+
+func (l *FairLock) Unlock(ctx context.Context) error {
+	l.dog.Stop()
+
+	keysAndArgs := []interface{}{l.getLockKey(), l.getQueueKey(), l.token, l.getNotifyPrefix(), FairLockNotifyExpireSeconds}
+	reply, err := l.client.Eval(ctx, third_party.LuaFairLockRelease, 2, keysAndArgs)
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("fail to unlock key:%s err: %w", l.getLockKey(), err)
+	}
+	return nil
+}
+
+// 锁丢失时关闭的channel: 看门狗续期失败或锁到达过期时间时关闭, 持有者应停止访问受保护的资源
+func (l *FairLock) Lost() <-chan struct{} {
+	return l.dog.Lost()
+}
+
+func (l *FairLock) getLockKey() string {
+	return l.keyBuilder.Lock(l.key)
+}
+
+func (l *FairLock) getQueueKey() string {
+	return l.keyBuilder.Lock(l.key, "queue")
+}
+
+func (l *FairLock) getTimeoutKey() string {
+	return l.keyBuilder.Lock(l.key, "timeout")
+}
+
+func (l *FairLock) getNotifyPrefix() string {
+	return l.keyBuilder.Lock(l.key, "notify") + pkg.KeyDelimiter
+}
+
+func (l *FairLock) getNotifyKey() string {
+	return l.getNotifyPrefix() + l.token
+}
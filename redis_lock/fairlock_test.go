@@ -0,0 +1,175 @@
+package redis_lock
+
+import (
+	"TCC/third_party"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_fair_lock_fifo(t *testing.T) {
+	client, _ := newMiniLockClient(t)
+	ctx := context.Background()
+
+	holder := NewFairLock("fair1", client, WithExpireSeconds(5))
+	if err := holder.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var mux sync.Mutex
+	var order []int
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock := NewFairLock("fair1", client, WithExpireSeconds(5), WithBlock(), WithBlockWaitingSeconds(5))
+			if err := lock.Lock(ctx); err != nil {
+				t.Error(err)
+				return
+			}
+			mux.Lock()
+			order = append(order, i)
+			mux.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			if err := lock.Unlock(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+		//保证等待者按顺序入队
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := holder.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	for i, waiter := range order {
+		if waiter != i {
+			t.Fatalf("waiters should acquire in FIFO order, got %v", order)
+		}
+	}
+}
+
+func Test_fair_lock_non_block(t *testing.T) {
+	client, _ := newMiniLockClient(t)
+	ctx := context.Background()
+
+	holder := NewFairLock("fair2", client, WithExpireSeconds(5))
+	if err := holder.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := inOtherGoroutine(func() error {
+		return NewFairLock("fair2", client, WithExpireSeconds(5)).Lock(ctx)
+	}); !IsRetryableErr(err) {
+		t.Fatal("lock should be held by other, got: ", err)
+	}
+	if err := holder.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 统计redis操作次数的LockClient
+type countingLockClient struct {
+	third_party.BlockingLockClient
+	ops int64
+}
+
+func (c *countingLockClient) SetNXWithEX(ctx context.Context, key, value string, expiration int64) (int64, error) {
+	atomic.AddInt64(&c.ops, 1)
+	return c.BlockingLockClient.SetNXWithEX(ctx, key, value, expiration)
+}
+
+func (c *countingLockClient) Eval(ctx context.Context, src string, keyCount int, keyAndArgs []interface{}) (interface{}, error) {
+	atomic.AddInt64(&c.ops, 1)
+	return c.BlockingLockClient.Eval(ctx, src, keyCount, keyAndArgs)
+}
+
+func (c *countingLockClient) BLPop(ctx context.Context, key string, timeoutSeconds int64) (string, error) {
+	atomic.AddInt64(&c.ops, 1)
+	return c.BlockingLockClient.BLPop(ctx, key, timeoutSeconds)
+}
+
+type locker interface {
+	Lock(ctx context.Context) error
+	Unlock(ctx context.Context) error
+}
+
+// 对比竞争激烈时轮询锁和公平锁的redis操作次数
+func Test_fair_lock_ops_under_contention(t *testing.T) {
+	const waiters = 5
+	const holdTime = 100 * time.Millisecond
+
+	contend := func(newLock func(client *countingLockClient) locker) int64 {
+		miniClient, _ := newMiniLockClient(t)
+		client := &countingLockClient{BlockingLockClient: miniClient}
+		ctx := context.Background()
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < waiters; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				lock := newLock(client)
+				if err := lock.Lock(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(holdTime)
+				if err := lock.Unlock(ctx); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		return atomic.LoadInt64(&client.ops)
+	}
+
+	pollingOps := contend(func(client *countingLockClient) locker {
+		return NewRedisLock("contend", client, WithExpireSeconds(5), WithBlock(), WithBlockWaitingSeconds(5))
+	})
+	fairOps := contend(func(client *countingLockClient) locker {
+		return NewFairLock("contend", client, WithExpireSeconds(5), WithBlock(), WithBlockWaitingSeconds(5))
+	})
+
+	t.Logf("redis ops with %d waiters: polling lock %d, fair lock %d", waiters, pollingOps, fairOps)
+	if fairOps >= pollingOps {
+		t.Fatalf("fair lock should issue fewer redis ops than polling lock, polling: %d, fair: %d", pollingOps, fairOps)
+	}
+}
+
+// 等待者的超时以redis服务端时间计算
+func Test_fair_lock_waiter_timeout_uses_server_time(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	holder := NewFairLock("fair4", client, WithExpireSeconds(2))
+	if err := holder.tryLock(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	//waiter入队后不再刷新, 模拟崩溃的等待者
+	if err := inOtherGoroutine(func() error {
+		return NewFairLock("fair4", client, WithExpireSeconds(5)).tryLock(ctx, FairLockWaiterTimeoutSeconds)
+	}); !IsRetryableErr(err) {
+		t.Fatal("waiter should be queued behind the holder, got: ", err)
+	}
+
+	//持有者的锁已过期, 但waiter仍在队首
+	server.Advance(FairLockWaiterTimeoutSeconds*time.Second - 500*time.Millisecond)
+	if err := inOtherGoroutine(func() error {
+		return NewFairLock("fair4", client, WithExpireSeconds(5)).tryLock(ctx, 0)
+	}); !IsRetryableErr(err) {
+		t.Fatal("newcomer should wait for the queued waiter, got: ", err)
+	}
+
+	//服务端时钟越过waiter的超时时间后, waiter被移出队列
+	server.Advance(time.Second)
+	if err := inOtherGoroutine(func() error {
+		return NewFairLock("fair4", client, WithExpireSeconds(5)).tryLock(ctx, 0)
+	}); err != nil {
+		t.Fatal("timed out waiter should be pruned by server time: ", err)
+	}
+}
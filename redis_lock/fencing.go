@@ -0,0 +1,28 @@
+package redis_lock
+
+import (
+	"TCC/pkg"
+	"TCC/third_party"
+	"context"
+	"fmt"
+)
+
+var ErrStaleFencingToken = pkg.ErrStaleFencingToken
+
+// 携带fencing token写入redis数据, token比该数据最近一次写入的token小时返回ErrStaleFencingToken
+func FencedSet(ctx context.Context, client third_party.LockClient, key, value string, token int64) error {
+	keysAndArgs := []interface{}{key, getFencedDataKey(key), token, value}
+	reply, err := client.Eval(ctx, third_party.LuaFencedSet, 2, keysAndArgs)
+	if err != nil {
+		return err
+	}
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("key:%s token:%d err: %w", key, token, ErrStaleFencingToken)
+	}
+	return nil
+}
+
+// 记录数据最近一次写入的fencing token
+func getFencedDataKey(key string) string {
+	return key + ":fencing"
+}
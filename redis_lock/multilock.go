@@ -0,0 +1,117 @@
+package redis_lock
+
+import (
+	"TCC/third_party"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// 没有需要加锁的key, 加锁不会持有任何资源
+var ErrNoKeys = errors.New("multilock: no keys to lock")
+
+// 多key锁: 在一个lua脚本中原子地对一组key全部加锁或全部不加锁, 避免逐个加锁时事务间相互等待造成死锁.
+// key按字典序排列, 与RedisLock使用相同的key格式, 因此与单key锁互斥
+type MultiLock struct {
+	keys   []string
+	token  string
+	client third_party.LockClient
+
+	LockOptions
+
+	//看门狗, 所有key共用
+	dog watchDog
+}
+
+func NewMultiLock(keys []string, client third_party.LockClient, opts ...LockOption) *MultiLock {
+	m := &MultiLock{
+		keys:   sortedUniqueKeys(keys),
+		client: client,
+		token:  getPidAndGidStr(),
+	}
+
+	for _, opt := range opts {
+		opt(&m.LockOptions)
+	}
+
+	repairLockOpt(&m.LockOptions)
+
+	return m
+}
+
+func (m *MultiLock) Lock(ctx context.Context) error {
+	if len(m.keys) == 0 {
+		return ErrNoKeys
+	}
+	err := m.tryLock(ctx)
+	if err != nil && m.isBlock && IsRetryableErr(err) {
+		err = blockingAcquire(ctx, m.blockWaitingSeconds, m.tryLock)
+	}
+	if err != nil {
+		return err
+	}
+
+	m.dog.watch(ctx, &m.LockOptions, m.DelayExpire)
+	return nil
+}
+
+func (m *MultiLock) tryLock(ctx context.Context) error {
+	reply, err := m.client.Eval(ctx, third_party.LuaMultiLockAcquire, len(m.keys), m.keysAndArgs(m.expireSeconds))
+	if err != nil {
+		return err
+	}
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("reply: %d, err: %w", ret, ErrLockInUse)
+	}
+	return nil
+}
+
+// 更新所有key的过期时间, 任一key已不由当前token持有时返回错误
+func (m *MultiLock) DelayExpire(ctx context.Context, expireSeconds int64) error {
+	reply, err := m.client.Eval(ctx, third_party.LuaMultiLockExpire, len(m.keys), m.keysAndArgs(expireSeconds))
+	if extended, _ := reply.(int64); extended != int64(len(m.keys)) {
+		return fmt.Errorf("fail to delay expired keys:%v expire:%d extended: %d err: %w", m.keys, expireSeconds, extended, err)
+	}
+	return nil
+}
+
+// 原子地释放所有key, 任一key已不由当前token持有时返回错误, 其余key仍会被释放
+func (m *MultiLock) Unlock(ctx context.Context) error {
+	m.dog.Stop()
+
+	reply, err := m.client.Eval(ctx, third_party.LuaMultiLockRelease, len(m.keys), m.keysAndArgs())
+	if released, _ := reply.(int64); released != int64(len(m.keys)) {
+		return fmt.Errorf("fail to unlock keys:%v released: %d err: %w", m.keys, released, err)
+	}
+	return nil
+}
+
+// 锁丢失时关闭的channel: 看门狗续期失败或锁到达过期时间时关闭, 持有者应停止访问受保护的资源
+func (m *MultiLock) Lost() <-chan struct{} {
+	return m.dog.Lost()
+}
+
+func (m *MultiLock) keysAndArgs(args ...interface{}) []interface{} {
+	keysAndArgs := make([]interface{}, 0, len(m.keys)+1+len(args))
+	for _, key := range m.keys {
+		keysAndArgs = append(keysAndArgs, m.keyBuilder.Lock(key))
+	}
+	keysAndArgs = append(keysAndArgs, m.token)
+	return append(keysAndArgs, args...)
+}
+
+// 去重并按字典序排列, 保证加锁顺序确定
+func sortedUniqueKeys(keys []string) []string {
+	sorted := make([]string, 0, len(keys))
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,83 @@
+package redis_lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func Test_multi_lock_all_or_nothing(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	lock := NewMultiLock([]string{"account_b", "account_a", "account_b"}, client, WithExpireSeconds(5))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	//部分key被持有时不会对其余key加锁
+	if err := inOtherGoroutine(func() error {
+		return NewMultiLock([]string{"account_c", "account_b"}, client, WithExpireSeconds(5)).Lock(ctx)
+	}); !IsRetryableErr(err) {
+		t.Fatal("multi lock should fail when any key is held, got: ", err)
+	}
+	if server.Exists(lockKey("account_c")) {
+		t.Fatal("no key should be locked when acquisition fails")
+	}
+
+	//与单key锁互斥
+	if err := inOtherGoroutine(func() error {
+		return NewRedisLock("account_a", client, WithExpireSeconds(5)).Lock(ctx)
+	}); !IsRetryableErr(err) {
+		t.Fatal("single key lock should be blocked by multi lock, got: ", err)
+	}
+
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"account_a", "account_b"} {
+		if server.Exists(lockKey(key)) {
+			t.Fatalf("key %s should be released", key)
+		}
+	}
+}
+
+func Test_multi_lock_release_partially_lost(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	lock := NewMultiLock([]string{"k1", "k2"}, client, WithExpireSeconds(5))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	//k1的锁已被其他持有者取得
+	if err := server.Set(lockKey("k1"), "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Unlock(ctx); err == nil {
+		t.Fatal("unlock should report the lost key")
+	}
+	if got, _ := server.Get(lockKey("k1")); got != "other" {
+		t.Fatal("key held by other should not be released")
+	}
+	if server.Exists(lockKey("k2")) {
+		t.Fatal("key still held should be released")
+	}
+}
+
+// 没有key时加锁失败, 不会报告持有了空的锁
+func Test_multi_lock_no_keys(t *testing.T) {
+	client, _ := newMiniLockClient(t)
+	ctx := context.Background()
+
+	for _, keys := range [][]string{nil, {}} {
+		lock := NewMultiLock(keys, client, WithExpireSeconds(5), WithBlock())
+		if err := lock.Lock(ctx); !errors.Is(err, ErrNoKeys) {
+			t.Fatal("lock without keys should fail with ErrNoKeys, got: ", err)
+		}
+		if lock.Lost() != nil {
+			t.Fatal("watchdog should not be started without keys")
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package redis_lock
 
+import (
+	"TCC/pkg"
+	"time"
+)
+
 const (
 	// 默认分布式锁过期时间
 	DefaultLockExpireSeconds = 30
@@ -13,6 +18,28 @@ type LockOptions struct {
 	blockWaitingSeconds int64
 	expireSeconds       int64
 	watchDogMode        bool
+	//看门狗续期的间隔与续期后的过期时间, 由repairLockOpt根据是否显式设置过期时间确定
+	watchDogStep          time.Duration
+	watchDogExpireSeconds int64
+	reentrant             bool
+	fencing               bool
+	keyBuilder            *pkg.KeyBuilder
+	clock                 Clock
+}
+
+// 看门狗的时钟, 续期的间隔与非看门狗模式下的过期通知均由其计时
+type Clock interface {
+	//d之后向返回的channel发送当时的时间, stop取消尚未触发的计时
+	NewTimer(d time.Duration) (c <-chan time.Time, stop func())
+}
+
+type realClock struct{}
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func()) {
+	timer := time.NewTimer(d)
+	return timer.C, func() {
+		timer.Stop()
+	}
 }
 
 type LockOption func(c *LockOptions)
@@ -35,17 +62,68 @@ func WithExpireSeconds(expireSeconds int64) LockOption {
 	}
 }
 
+// 可重入模式: 同一持有者(进程id+协程id)可多次加锁, 解锁次数与加锁次数相同时才真正释放
+func WithReentrant() LockOption {
+	return func(c *LockOptions) {
+		c.reentrant = true
+	}
+}
+
+// fencing token模式: 每次加锁成功时生成单调递增的fencing token, 通过RedisLock.FencingToken获取.
+// 写入受保护的资源时携带该token, 资源拒绝比已见过的token更小的写入, 避免锁过期后的旧持有者继续写入.
+// token以redis服务端时间(微秒)为基础而不是INCR, 不同锁发放的token按取锁先后可比较, fencing key丢失后也不会回退;
+// 服务端时钟回拨时仍在该锁上一次的token上递增. 与WithReentrant同时使用时重入沿用首次加锁的token
+func WithFencingToken() LockOption {
+	return func(c *LockOptions) {
+		c.fencing = true
+	}
+}
+
+// 设置构造锁key的KeyBuilder, 默认为pkg.DefaultKeyBuilder.
+// 启用hash tag后同一把锁的所有key落在同一个slot; MultiLock的多个锁名仍可能分布在不同的slot
+func WithKeyBuilder(keys *pkg.KeyBuilder) LockOption {
+	return func(c *LockOptions) {
+		c.keyBuilder = keys
+	}
+}
+
+// 显式设置过期时间时同样启用看门狗: 每隔过期时间的1/3续期, 续期后的过期时间不变.
+// 适合按租约时长认领、但持有时间可能超过租约的场景, 只有续期失败时才发出丢失通知; 未设置过期时间时默认即为看门狗模式
+func WithWatchDog() LockOption {
+	return func(c *LockOptions) {
+		c.watchDogMode = true
+	}
+}
+
+// 设置看门狗的时钟, 默认为系统时钟; 测试中可替换为可拨动的时钟
+func WithClock(clock Clock) LockOption {
+	return func(c *LockOptions) {
+		c.clock = clock
+	}
+}
+
 func repairLockOpt(c *LockOptions) {
+	if c.keyBuilder == nil {
+		c.keyBuilder = pkg.DefaultKeyBuilder
+	}
+	if c.clock == nil {
+		c.clock = realClock{}
+	}
+
 	if c.isBlock && c.blockWaitingSeconds <= 0 {
 		//默认阻塞等待时间为5秒
 		c.blockWaitingSeconds = 5
 	}
 
 	if c.expireSeconds > 0 {
+		c.watchDogStep = time.Duration(c.expireSeconds) * time.Second / 3
+		c.watchDogExpireSeconds = c.expireSeconds
 		return
 	}
 
-	//未设置过期时间，则启用看门狗模式
+	//未设置过期时间，则启用看门狗模式; 为了避免网络阻塞造成时延，续期时间会额外增加5s
 	c.expireSeconds = DefaultLockExpireSeconds
 	c.watchDogMode = true
+	c.watchDogStep = WatchDogWorkStepSeconds * time.Second
+	c.watchDogExpireSeconds = WatchDogWorkStepSeconds + 5
 }
@@ -1,95 +1,429 @@
 package redis_lock
 
 import (
+	"TCC/pkg"
+	"TCC/testutil"
+	"TCC/testutil/memlock"
 	"TCC/third_party"
 	"context"
-	"sync"
+	"errors"
+	"strconv"
 	"testing"
 	"time"
 )
 
 func Test_block_lock(t *testing.T) {
-	addr := "127.0.0.1:6379"
-	password := ""
-
-	client := third_party.NewClient("tcp", addr, password)
+	clock := memlock.NewFakeClock(time.Now())
+	client := memlock.NewClient(clock)
 
 	lock1 := NewRedisLock("test1", client, WithExpireSeconds(2))
-	lock2 := NewRedisLock("test1", client, WithBlock(), WithBlockWaitingSeconds(1))
 
-	wg := sync.WaitGroup{}
 	ctx := context.Background()
 
-	wg.Add(1)
-
 	t.Log("lock1 work")
 	if err := lock1.Lock(ctx); err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
-	wg.Done()
 
-	time.Sleep(1000 * time.Millisecond)
+	clock.Advance(time.Second)
+
+	//lock2阻塞等待期间lock1过期
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		clock.Advance(time.Second)
+	}()
 
-	wg.Add(1)
 	t.Log("lock2 work")
-	if err := lock2.Lock(ctx); err != nil {
-		t.Error(err)
-		return
+	var lock2 *RedisLock
+	if err := inOtherGoroutine(func() error {
+		lock2 = NewRedisLock("test1", client, WithBlock(), WithBlockWaitingSeconds(1))
+		return lock2.Lock(ctx)
+	}); err != nil {
+		t.Fatal(err)
 	}
-	wg.Done()
 
-	wg.Wait()
-	err := lock1.Unlock(ctx)
-	if err != nil {
-		t.Error(err)
+	//lock1已过期, 锁由lock2持有
+	if err := lock1.Unlock(ctx); err == nil {
+		t.Error("unlock expired lock should fail")
 	}
-	err = lock2.Unlock(ctx)
-	if err != nil {
+	if err := lock2.Unlock(ctx); err != nil {
 		t.Error(err)
 	}
 	t.Log("success")
 }
 
 func Test_non_block_lock(t *testing.T) {
-	addr := "127.0.0.1:6379"
-	password := ""
-
-	client := third_party.NewClient("tcp", addr, password)
+	client := memlock.NewClient(memlock.NewFakeClock(time.Now()))
 
 	lock1 := NewRedisLock("test2", client, WithExpireSeconds(1))
+
+	ctx := context.Background()
+
+	t.Log("lock1 work")
+	if err := inOtherGoroutine(func() error {
+		return lock1.Lock(ctx)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("lock2 work")
 	lock2 := NewRedisLock("test2", client, WithExpireSeconds(1))
+	if err := lock2.Lock(ctx); !IsRetryableErr(err) {
+		t.Fatal("non-block lock should fail immediately when held by other, got: ", err)
+	}
+
+	if err := lock1.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock2.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_ = lock2.Unlock(ctx)
+	t.Log("success")
+}
+
+// 看门狗续期使用的DelayExpire在锁过期前刷新过期时间, 过期后续期失败
+func Test_lock_delay_expire(t *testing.T) {
+	clock := memlock.NewFakeClock(time.Now())
+	client := memlock.NewClient(clock)
+	ctx := context.Background()
+
+	lock := NewRedisLock("test6", client, WithExpireSeconds(5))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer lock.dog.Stop()
+
+	clock.Advance(4 * time.Second)
+	if err := lock.DelayExpire(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := client.TTL(lockKey("test6")); ttl != 5*time.Second {
+		t.Fatalf("ttl should be refreshed to 5s, got: %v", ttl)
+	}
+
+	clock.Advance(4 * time.Second)
+	if err := inOtherGoroutine(func() error {
+		return NewRedisLock("test6", client, WithExpireSeconds(5)).Lock(ctx)
+	}); !IsRetryableErr(err) {
+		t.Fatal("renewed lock should still be held, got: ", err)
+	}
 
-	wg := sync.WaitGroup{}
+	clock.Advance(time.Second)
+	if err := lock.DelayExpire(ctx, 5); err == nil {
+		t.Fatal("delay expire on expired lock should fail")
+	}
+	if err := inOtherGoroutine(func() error {
+		return NewRedisLock("test6", client, WithExpireSeconds(5)).Lock(ctx)
+	}); err != nil {
+		t.Fatal("expired lock should be acquirable, got: ", err)
+	}
+}
+
+func Test_reentrant_lock(t *testing.T) {
+	client, _ := newMiniLockClient(t)
 	ctx := context.Background()
 
-	wg.Add(1)
+	lock1 := NewRedisLock("test3", client, WithReentrant(), WithExpireSeconds(5))
+	//同一协程内通过另一个实例重入
+	lock2 := NewRedisLock("test3", client, WithReentrant(), WithExpireSeconds(5))
+
+	if err := lock1.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock1.Lock(ctx); err != nil {
+		t.Fatal("reentrant lock failed: ", err)
+	}
+	if err := lock2.Lock(ctx); err != nil {
+		t.Fatal("reentrant lock by nested helper failed: ", err)
+	}
 
+	//其他协程的持有者无法取锁
+	errCh := make(chan error)
 	go func() {
-		defer wg.Done()
-		t.Log("lock1 work")
-		if err := lock1.Lock(ctx); err != nil {
-			t.Error(err)
-			return
+		errCh <- NewRedisLock("test3", client, WithReentrant(), WithExpireSeconds(5)).Lock(ctx)
+	}()
+	if err := <-errCh; !IsRetryableErr(err) {
+		t.Fatal("lock should be held by other goroutine, got: ", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := lock1.Unlock(ctx); err != nil {
+			t.Fatal(err)
 		}
+	}
+	if err := lock1.Unlock(ctx); err == nil {
+		t.Fatal("unlock released lock should fail")
+	}
+
+	go func() {
+		errCh <- NewRedisLock("test3", client, WithReentrant(), WithExpireSeconds(5)).Lock(ctx)
 	}()
+	if err := <-errCh; err != nil {
+		t.Fatal("lock should be released, got: ", err)
+	}
+}
 
-	wg.Add(1)
+// 默认KeyBuilder下锁在redis中的key
+func lockKey(name string, suffix ...string) string {
+	return pkg.DefaultKeyBuilder.Lock(name, suffix...)
+}
 
-	t.Log("lock2 work")
-	if err := lock2.Lock(ctx); err != nil {
-		if IsRetryableErr(err) {
-			t.Error("lock acquired by other: ", err)
-			return
+// 连接进程内redis的RedisClient, 测试时无需启动真实的redis
+func newMiniLockClient(t *testing.T) (*third_party.RedisClient, *testutil.RedisServer) {
+	server := testutil.NewRedisServer(t)
+	client, err := third_party.NewClient("tcp", server.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func Test_fencing_token(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	lock1 := NewRedisLock("test4", client, WithFencingToken(), WithExpireSeconds(1))
+	if err := lock1.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	token1 := lock1.FencingToken()
+
+	//lock1的锁过期后被lock2取得
+	server.Advance(2 * time.Second)
+	var token2 int64
+	if err := inOtherGoroutine(func() error {
+		lock2 := NewRedisLock("test4", client, WithFencingToken(), WithExpireSeconds(1))
+		err := lock2.Lock(ctx)
+		token2 = lock2.FencingToken()
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if token2 <= token1 {
+		t.Fatalf("fencing token should increase, token1: %d, token2: %d", token1, token2)
+	}
+
+	if err := FencedSet(ctx, client, "data", "v2", token2); err != nil {
+		t.Fatal(err)
+	}
+	//旧持有者携带过期的token写入被拒绝
+	if err := FencedSet(ctx, client, "data", "v1", token1); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatal("stale token write should be rejected, got: ", err)
+	}
+	if got, _ := server.Get("data"); got != "v2" {
+		t.Fatalf("data should not be overwritten by stale token, got: %s", got)
+	}
+}
+
+// 记录的token与写入时的token字符串一致, 不会因lua数字的精度被舍入
+func Test_fenced_set_stores_exact_token(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	lock := NewRedisLock("test10", client, WithFencingToken(), WithExpireSeconds(5))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	token := lock.FencingToken()
+	if got, _ := server.Get(lockKey("test10", "fencing")); got != strconv.FormatInt(token, 10) {
+		t.Fatalf("lock should store the decimal token %d, got: %s", token, got)
+	}
+	if err := FencedSet(ctx, client, "data", "v1", token); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := server.Get(getFencedDataKey("data")); got != strconv.FormatInt(token, 10) {
+		t.Fatalf("fenced set should store the decimal token %d, got: %s", token, got)
+	}
+	//相差1的token仍可区分
+	if err := FencedSet(ctx, client, "data", "v0", token-1); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatal("token smaller by one should be rejected, got: ", err)
+	}
+}
+
+// 服务端时钟回拨后发放的token仍然递增
+func Test_fencing_token_clock_regression(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	lock := NewRedisLock("test11", client, WithFencingToken(), WithExpireSeconds(5))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	token := lock.FencingToken()
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetTime(server.Now().Add(-time.Hour))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lock.FencingToken() != token+1 {
+		t.Fatalf("token should keep increasing after clock regression, before: %d, after: %d", token, lock.FencingToken())
+	}
+}
+
+// 可重入模式同样生成fencing token, 重入时沿用首次加锁的token
+func Test_reentrant_fencing_token(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	lock := NewRedisLock("test6", client, WithReentrant(), WithFencingToken(), WithExpireSeconds(5))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	token := lock.FencingToken()
+	if token <= 0 {
+		t.Fatalf("reentrant lock should get a fencing token, got: %d", token)
+	}
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := lock.FencingToken(); got != token {
+		t.Fatalf("reentry should keep the fencing token, want: %d, got: %d", token, got)
+	}
+	for i := 0; i < 2; i++ {
+		if err := lock.Unlock(ctx); err != nil {
+			t.Fatal(err)
 		}
-		t.Error(err)
-		return
 	}
 
-	wg.Done()
+	//其他锁随后发放的token更大
+	server.Advance(time.Millisecond)
+	other := NewRedisLock("test7", client, WithFencingToken(), WithExpireSeconds(5))
+	if err := other.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if other.FencingToken() <= token {
+		t.Fatalf("tokens of different locks should be ordered by acquisition, first: %d, second: %d", token, other.FencingToken())
+	}
 
-	wg.Wait()
-	_ = lock1.Unlock(ctx)
-	_ = lock2.Unlock(ctx)
-	t.Log("success")
+	server.Advance(time.Millisecond)
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lock.FencingToken() <= other.FencingToken() {
+		t.Fatalf("reacquired lock should get a new token, got: %d", lock.FencingToken())
+	}
+}
+
+func Test_lock_lost_on_expire(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	lock := NewRedisLock("test5", client, WithExpireSeconds(1))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lock.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatal("lost should be notified after lock expired")
+	}
+	server.Advance(time.Second)
+
+	//正常解锁不会发出丢失通知
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lock.Lost():
+		t.Fatal("lost should not be notified after unlock")
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+// 等待后台协程开始(或停止)计时后再拨动时钟
+func waitTimers(t *testing.T, clock *memlock.FakeClock, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for clock.Timers() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d timers, got: %d", n, clock.Timers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 看门狗的续期与过期通知由注入的时钟驱动
+func Test_watchdog_driven_by_clock(t *testing.T) {
+	clock := memlock.NewFakeClock(time.Now())
+	client := memlock.NewClient(clock)
+	ctx := context.Background()
+
+	lock := NewRedisLock("test8", client, WithClock(clock))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitTimers(t, clock, 1)
+	clock.Advance(WatchDogWorkStepSeconds * time.Second)
+
+	//续期时额外增加5s
+	want := (WatchDogWorkStepSeconds + 5) * time.Second
+	deadline := time.Now().Add(2 * time.Second)
+	for ttl, _ := client.TTL(lockKey("test8")); ttl != want; ttl, _ = client.TTL(lockKey("test8")) {
+		if time.Now().After(deadline) {
+			t.Fatalf("watchdog should renew the lock to %v, got: %v", want, ttl)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitTimers(t, clock, 0)
+
+	//非看门狗模式下锁到达过期时间时发出丢失通知
+	expiring := NewRedisLock("test9", client, WithExpireSeconds(5), WithClock(clock))
+	if err := expiring.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitTimers(t, clock, 1)
+	select {
+	case <-expiring.Lost():
+		t.Fatal("lost should not be notified before expired")
+	default:
+	}
+	clock.Advance(5 * time.Second)
+	select {
+	case <-expiring.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatal("lost should be notified after the clock passes the expire time")
+	}
+}
+
+// 显式设置过期时间的看门狗模式按过期时间的1/3续期, 续期为设置的过期时间
+func Test_watchdog_with_expire_seconds(t *testing.T) {
+	clock := memlock.NewFakeClock(time.Now())
+	client := memlock.NewClient(clock)
+	ctx := context.Background()
+
+	lock := NewRedisLock("test10", client, WithExpireSeconds(3), WithWatchDog(), WithClock(clock))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	//多次续期后锁仍被持有, 不发出丢失通知
+	for i := 0; i < 5; i++ {
+		waitTimers(t, clock, 1)
+		clock.Advance(time.Second)
+	}
+	waitTimers(t, clock, 1)
+	if ttl, _ := client.TTL(lockKey("test10")); ttl != 3*time.Second {
+		t.Fatalf("watchdog should renew the lock to 3s, got: %v", ttl)
+	}
+	select {
+	case <-lock.Lost():
+		t.Fatal("lost should not be notified while the watchdog renews the lock")
+	default:
+	}
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lock.Lost():
+		t.Fatal("lost should not be notified after unlock")
+	default:
+	}
 }
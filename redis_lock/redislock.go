@@ -6,15 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gomodule/redigo/redis"
-	"log"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync/atomic"
-	"time"
 )
 
+// 引入pkg.KeyBuilder之前(v0)的锁key前缀, 锁key为该前缀拼接锁名, 仅用于切换key版本时定位旧版本的锁.
+// 新版本的锁key由KeyBuilder.Lock生成, 与旧版本的锁互不可见, 切换步骤见pkg.KeyBuilder.
+// Deprecated: 使用WithKeyBuilder
 const RedisLockKeyPrePrefix = "REDIS_LOCK_PREFIX"
 
 type RedisLock struct {
@@ -24,10 +25,12 @@ type RedisLock struct {
 
 	LockOptions
 
-	//看门狗运作标识
-	runningDog int32
-	//停止看门狗
-	stopDog context.CancelFunc
+	//看门狗
+	dog watchDog
+	//可重入模式下最近一次加锁后的重入次数
+	holdCount int64
+	//fencing token模式下最近一次加锁取得的token
+	fencingToken int64
 }
 
 func NewRedisLock(key string, client third_party.LockClient, opts ...LockOption) *RedisLock {
@@ -52,6 +55,11 @@ func (r *RedisLock) Lock(ctx context.Context) (err error) {
 			return
 		}
 
+		//重入加锁时看门狗已在首次加锁时启动, 续期作用于整个锁
+		if r.reentrant && atomic.LoadInt64(&r.holdCount) > 1 {
+			return
+		}
+
 		//在加锁成功下启动看门狗模式
 		r.startWatchDog(ctx)
 	}()
@@ -78,6 +86,13 @@ func (r *RedisLock) Lock(ctx context.Context) (err error) {
 }
 
 func (r *RedisLock) tryLock(ctx context.Context) error {
+	if r.reentrant {
+		return r.tryReentrantLock(ctx)
+	}
+	if r.fencing {
+		return r.tryFencingLock(ctx)
+	}
+
 	resp, err := r.client.SetNXWithEX(ctx, r.getLockKey(), r.token, r.expireSeconds)
 	if err != nil {
 		return err
@@ -91,43 +106,75 @@ func (r *RedisLock) tryLock(ctx context.Context) error {
 	return nil
 }
 
-func (r *RedisLock) startWatchDog(ctx context.Context) {
-	//没启用看门狗模式则直接返回
-	if !r.watchDogMode {
-		return
+func (r *RedisLock) tryReentrantLock(ctx context.Context) error {
+	if r.fencing {
+		return r.tryReentrantFencingLock(ctx)
 	}
 
-	for !atomic.CompareAndSwapInt32(&r.runningDog, 0, 1) {
-		time.Sleep(time.Second) //循环等待之前的看门狗回事
+	keysAndArgs := []interface{}{r.getLockKey(), r.token, r.expireSeconds}
+	reply, err := r.client.Eval(ctx, third_party.LuaReentrantLock, 1, keysAndArgs)
+	if err != nil {
+		return err
+	}
+	count, _ := reply.(int64)
+	if count <= 0 {
+		return fmt.Errorf("reply: %d, err: %w", count, ErrLockInUse)
 	}
 
-	ctx, r.stopDog = context.WithCancel(ctx)
-
-	//进入看门狗模式
-	go func() {
-		defer func() {
-			atomic.StoreInt32(&r.runningDog, 0)
-		}()
-		r.watchDogRunning(ctx)
-	}()
+	atomic.StoreInt64(&r.holdCount, count)
+	return nil
 }
 
-func (r *RedisLock) watchDogRunning(ctx context.Context) {
-	ticker := time.NewTicker(WatchDogWorkStepSeconds * time.Second)
-	defer ticker.Stop()
+// 可重入且启用fencing token: 首次加锁时生成token, 重入时沿用同一个token
+func (r *RedisLock) tryReentrantFencingLock(ctx context.Context) error {
+	keysAndArgs := []interface{}{r.getLockKey(), r.getFencingKey(), r.token, r.expireSeconds}
+	reply, err := r.client.Eval(ctx, third_party.LuaReentrantLockWithFencingToken, 2, keysAndArgs)
+	if err != nil {
+		return err
+	}
+	values, _ := reply.([]interface{})
+	if len(values) != 2 {
+		return fmt.Errorf("unexpected reply: %v", reply)
+	}
+	count, _ := values[0].(int64)
+	token, _ := values[1].(int64)
+	if count <= 0 {
+		return fmt.Errorf("reply: %d, err: %w", count, ErrLockInUse)
+	}
 
-	for range ticker.C {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			//给锁续期，为了避免网络阻塞造成时延，续期时间会额外增加5s
-			err := r.DelayExpire(ctx, WatchDogWorkStepSeconds+5)
-			if err != nil {
-				log.Printf("redis_lock: watchDogRunning err:%v", err)
-			}
-		}
+	atomic.StoreInt64(&r.holdCount, count)
+	atomic.StoreInt64(&r.fencingToken, token)
+	return nil
+}
+
+func (r *RedisLock) tryFencingLock(ctx context.Context) error {
+	keysAndArgs := []interface{}{r.getLockKey(), r.getFencingKey(), r.token, r.expireSeconds}
+	reply, err := r.client.Eval(ctx, third_party.LuaSetNXWithFencingToken, 2, keysAndArgs)
+	if err != nil {
+		return err
+	}
+	token, _ := reply.(int64)
+	if token <= 0 {
+		return fmt.Errorf("reply: %d, err: %w", token, ErrLockInUse)
 	}
+
+	atomic.StoreInt64(&r.fencingToken, token)
+	return nil
+}
+
+// 获取最近一次加锁取得的fencing token, 未启用fencing token模式时为0
+func (r *RedisLock) FencingToken() int64 {
+	return atomic.LoadInt64(&r.fencingToken)
+}
+
+func (r *RedisLock) startWatchDog(ctx context.Context) {
+	//没启用看门狗模式时只在锁过期时发出丢失通知
+	r.dog.watch(ctx, &r.LockOptions, r.DelayExpire)
+}
+
+// 锁丢失时关闭的channel: 看门狗续期失败或锁到达过期时间时关闭, 持有者应停止访问受保护的资源
+func (r *RedisLock) Lost() <-chan struct{} {
+	return r.dog.Lost()
 }
 
 // 更新锁的过期时间。
@@ -135,7 +182,11 @@ func (r *RedisLock) watchDogRunning(ctx context.Context) {
 func (r *RedisLock) DelayExpire(ctx context.Context, expireSeconds int64) error {
 	keysAndArgs := []interface{}{r.getLockKey(), r.token, expireSeconds}
 
-	reply, err := r.client.Eval(ctx, third_party.LuaCheckAndExpireDistributionLock, 1, keysAndArgs)
+	script := third_party.LuaCheckAndExpireDistributionLock
+	if r.reentrant {
+		script = third_party.LuaReentrantExpire
+	}
+	reply, err := r.client.Eval(ctx, script, 1, keysAndArgs)
 
 	if ret, _ := reply.(int64); ret != 1 {
 		return fmt.Errorf("fail to delay expired key:%s expire:%d err: %w", r.getLockKey(), expireSeconds, err)
@@ -144,40 +195,16 @@ func (r *RedisLock) DelayExpire(ctx context.Context, expireSeconds int64) error
 }
 
 func (r *RedisLock) blockingLock(ctx context.Context) error {
-	timeoutCh := time.After(time.Duration(r.blockWaitingSeconds) * time.Second)
-
-	ticker := time.NewTicker(50 * time.Millisecond)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("ctx timeout, lock fai: %w", ctx.Err())
-		case <-timeoutCh:
-			return fmt.Errorf("block wait timeout: %w", ctx.Err())
-		default:
-			err := r.tryLock(ctx)
-
-			if err == nil {
-				return nil //成功加锁后返回
-			}
-
-			//非重试错误，直接返回
-			if !IsRetryableErr(err) {
-				return err
-			}
-		}
-	}
-
-	return nil
+	return blockingAcquire(ctx, r.blockWaitingSeconds, r.tryLock)
 }
 
 func (r *RedisLock) Unlock(ctx context.Context) error {
-	defer func() {
-		if r.stopDog != nil {
-			r.stopDog()
-		}
-	}()
+	if r.reentrant {
+		return r.reentrantUnlock(ctx)
+	}
+
+	//先停止看门狗, 避免删除key后的续期失败被误报为锁丢失
+	r.dog.Stop()
 
 	keysAndArgs := []interface{}{r.getLockKey(), r.token}
 
@@ -190,8 +217,32 @@ func (r *RedisLock) Unlock(ctx context.Context) error {
 	return nil
 }
 
+// 可重入解锁, 重入次数减到0时才停止看门狗
+func (r *RedisLock) reentrantUnlock(ctx context.Context) error {
+	keysAndArgs := []interface{}{r.getLockKey(), r.token}
+	reply, err := r.client.Eval(ctx, third_party.LuaReentrantUnlock, 1, keysAndArgs)
+	if err != nil {
+		return fmt.Errorf("fail to unlock key:%s err: %w", r.getLockKey(), err)
+	}
+	count, ok := reply.(int64)
+	if !ok || count < 0 {
+		return fmt.Errorf("fail to unlock key:%s, lock not held by token:%s", r.getLockKey(), r.token)
+	}
+
+	atomic.StoreInt64(&r.holdCount, count)
+	if count == 0 {
+		r.dog.Stop()
+	}
+	return nil
+}
+
 func (r *RedisLock) getLockKey() string {
-	return RedisLockKeyPrePrefix + r.key
+	return r.keyBuilder.Lock(r.key)
+}
+
+// 记录该锁最近一次发放的fencing token, 不设置过期时间以保证token单调递增
+func (r *RedisLock) getFencingKey() string {
+	return r.keyBuilder.Lock(r.key, "fencing")
 }
 
 //------------------------------------------------------------
@@ -0,0 +1,174 @@
+package redis_lock
+
+import (
+	"TCC/third_party"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// 单个节点取锁的超时时间, 远小于锁的过期时间, 避免在故障节点上阻塞过久
+	RedLockNodeTimeout = 100 * time.Millisecond
+	// 时钟漂移系数, 锁的有效期需要扣除过期时间乘以该系数的漂移
+	RedLockClockDriftFactor = 0.01
+)
+
+var ErrNoQuorum = errors.New("redlock: failed to acquire lock on majority of nodes")
+
+// 多节点分布式锁(Redlock): 在多个相互独立的redis节点上加锁, 在有效期内取得多数节点的锁才算加锁成功.
+// 单个节点故障或主从切换时不会导致锁被两个持有者同时持有
+type RedLock struct {
+	key     string
+	token   string
+	clients []third_party.LockClient
+
+	LockOptions
+
+	//看门狗
+	dog watchDog
+
+	mux sync.RWMutex
+	//锁的有效期截止时间
+	validUntil time.Time
+}
+
+func NewRedLock(key string, clients []third_party.LockClient, opts ...LockOption) *RedLock {
+	r := &RedLock{
+		key:     key,
+		clients: clients,
+		token:   getPidAndGidStr(),
+	}
+
+	for _, opt := range opts {
+		opt(&r.LockOptions)
+	}
+
+	repairLockOpt(&r.LockOptions)
+
+	return r
+}
+
+func (r *RedLock) Lock(ctx context.Context) error {
+	err := r.tryLock(ctx)
+	if err != nil && r.isBlock && IsRetryableErr(err) {
+		err = blockingAcquire(ctx, r.blockWaitingSeconds, r.tryLock)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.dog.watch(ctx, &r.LockOptions, r.DelayExpire)
+	return nil
+}
+
+func (r *RedLock) tryLock(ctx context.Context) error {
+	start := time.Now()
+	acquired := r.forEachNode(ctx, func(ctx context.Context, client third_party.LockClient) bool {
+		resp, err := client.SetNXWithEX(ctx, r.getLockKey(), r.token, r.expireSeconds)
+		return err == nil && resp == 1
+	})
+
+	//扣除取锁耗时和时钟漂移后的剩余有效期
+	expire := time.Duration(r.expireSeconds) * time.Second
+	drift := time.Duration(float64(expire)*RedLockClockDriftFactor) + 2*time.Millisecond
+	validity := expire - time.Since(start) - drift
+
+	if acquired >= r.quorum() && validity > 0 {
+		r.setValidUntil(start.Add(expire - drift))
+		return nil
+	}
+
+	//未取得多数节点的锁, 释放所有节点上已取得的锁
+	_ = r.release(context.WithoutCancel(ctx))
+	return fmt.Errorf("acquired: %d/%d, validity: %v, err: %w", acquired, len(r.clients), validity, errors.Join(ErrNoQuorum, ErrLockInUse))
+}
+
+// 更新所有节点上锁的过期时间, 多数节点续期成功才算成功
+func (r *RedLock) DelayExpire(ctx context.Context, expireSeconds int64) error {
+	start := time.Now()
+	keysAndArgs := []interface{}{r.getLockKey(), r.token, expireSeconds}
+	extended := r.forEachNode(ctx, func(ctx context.Context, client third_party.LockClient) bool {
+		reply, err := client.Eval(ctx, third_party.LuaCheckAndExpireDistributionLock, 1, keysAndArgs)
+		ret, _ := reply.(int64)
+		return err == nil && ret == 1
+	})
+	if extended < r.quorum() {
+		return fmt.Errorf("fail to delay expired key:%s expire:%d extended: %d/%d", r.getLockKey(), expireSeconds, extended, len(r.clients))
+	}
+
+	expire := time.Duration(expireSeconds) * time.Second
+	r.setValidUntil(start.Add(expire - time.Duration(float64(expire)*RedLockClockDriftFactor)))
+	return nil
+}
+
+// 释放所有节点上的锁, 包括加锁失败的节点, 避免节点上残留已超时响应的锁
+func (r *RedLock) Unlock(ctx context.Context) error {
+	r.dog.Stop()
+
+	released := r.release(ctx)
+	r.setValidUntil(time.Time{})
+	if released < r.quorum() {
+		return fmt.Errorf("fail to unlock key:%s released: %d/%d", r.getLockKey(), released, len(r.clients))
+	}
+	return nil
+}
+
+func (r *RedLock) release(ctx context.Context) int {
+	keysAndArgs := []interface{}{r.getLockKey(), r.token}
+	return r.forEachNode(ctx, func(ctx context.Context, client third_party.LockClient) bool {
+		reply, err := client.Eval(ctx, third_party.LuaCheckAndDeleteDistributionLock, 1, keysAndArgs)
+		ret, _ := reply.(int64)
+		return err == nil && ret == 1
+	})
+}
+
+// 锁丢失时关闭的channel: 看门狗续期失败或锁到达过期时间时关闭, 持有者应停止访问受保护的资源
+func (r *RedLock) Lost() <-chan struct{} {
+	return r.dog.Lost()
+}
+
+// 锁的有效期截止时间, 超过该时间后锁可能已被其他持有者取得
+func (r *RedLock) ValidUntil() time.Time {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.validUntil
+}
+
+func (r *RedLock) setValidUntil(validUntil time.Time) {
+	r.mux.Lock()
+	r.validUntil = validUntil
+	r.mux.Unlock()
+}
+
+// 并发地在所有节点上执行操作, 返回成功的节点数
+func (r *RedLock) forEachNode(ctx context.Context, do func(ctx context.Context, client third_party.LockClient) bool) int {
+	var succeeded int
+	var mux sync.Mutex
+	wg := sync.WaitGroup{}
+	for _, client := range r.clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nctx, cancel := context.WithTimeout(ctx, RedLockNodeTimeout)
+			defer cancel()
+			if do(nctx, client) {
+				mux.Lock()
+				succeeded++
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return succeeded
+}
+
+func (r *RedLock) quorum() int {
+	return len(r.clients)/2 + 1
+}
+
+func (r *RedLock) getLockKey() string {
+	return r.keyBuilder.Lock(r.key)
+}
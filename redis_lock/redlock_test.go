@@ -0,0 +1,89 @@
+package redis_lock
+
+import (
+	"TCC/testutil"
+	"TCC/third_party"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newRedLockNodes(t *testing.T, n int) ([]third_party.LockClient, []*testutil.RedisServer) {
+	clients := make([]third_party.LockClient, n)
+	servers := make([]*testutil.RedisServer, n)
+	for i := 0; i < n; i++ {
+		clients[i], servers[i] = newMiniLockClient(t)
+	}
+	return clients, servers
+}
+
+func Test_redlock_majority(t *testing.T) {
+	clients, servers := newRedLockNodes(t, 3)
+	ctx := context.Background()
+
+	//其中一个节点上的锁被其他持有者占用, 仍能取得多数节点的锁
+	if err := servers[0].Set(lockKey("red1"), "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	lock := NewRedLock("red1", clients, WithExpireSeconds(5))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lock.ValidUntil().Before(time.Now()) {
+		t.Fatal("lock should be valid after acquired")
+	}
+
+	if err := inOtherGoroutine(func() error {
+		return NewRedLock("red1", clients, WithExpireSeconds(5)).Lock(ctx)
+	}); !errors.Is(err, ErrNoQuorum) || !IsRetryableErr(err) {
+		t.Fatal("lock should be held by other, got: ", err)
+	}
+
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, server := range servers[1:] {
+		if server.Exists(lockKey("red1")) {
+			t.Fatalf("lock should be released on node %d", i+1)
+		}
+	}
+	if got, _ := servers[0].Get(lockKey("red1")); got != "other" {
+		t.Fatal("lock held by other should not be released")
+	}
+}
+
+func Test_redlock_no_quorum_releases_acquired_nodes(t *testing.T) {
+	clients, servers := newRedLockNodes(t, 3)
+	ctx := context.Background()
+
+	for _, server := range servers[:2] {
+		if err := server.Set(lockKey("red2"), "other"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock := NewRedLock("red2", clients, WithExpireSeconds(5))
+	if err := lock.Lock(ctx); !errors.Is(err, ErrNoQuorum) {
+		t.Fatal("lock should fail without quorum, got: ", err)
+	}
+	if servers[2].Exists(lockKey("red2")) {
+		t.Fatal("lock acquired on minority nodes should be released")
+	}
+}
+
+func Test_redlock_node_down(t *testing.T) {
+	clients, servers := newRedLockNodes(t, 3)
+	ctx := context.Background()
+
+	servers[1].Close()
+
+	lock := NewRedLock("red3", clients, WithExpireSeconds(5), WithBlock(), WithBlockWaitingSeconds(1))
+	if err := lock.Lock(ctx); err != nil {
+		t.Fatal("lock should survive a single node failure: ", err)
+	}
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package redis_lock
+
+import (
+	"TCC/third_party"
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// 写者等待标识的过期时间, 写者放弃等待后读者最多被阻塞该时长
+	RWLockWriterWaitSeconds = 1
+)
+
+// 分布式读写锁: 读锁可被多个读者共享, 写锁独占; 阻塞等待的写者会阻止新的读者加锁, 避免写者饥饿.
+// 与RedisLock相同, 持有者标识为进程id+协程id, 不同协程的读者需要使用各自的RWLock实例
+type RWLock struct {
+	key    string
+	token  string
+	client third_party.LockClient
+
+	LockOptions
+
+	//看门狗, 读锁和写锁共用
+	dog watchDog
+	//读锁的重入次数
+	readCount int64
+}
+
+func NewRWLock(key string, client third_party.LockClient, opts ...LockOption) *RWLock {
+	l := &RWLock{
+		key:    key,
+		client: client,
+		token:  getPidAndGidStr(),
+	}
+
+	for _, opt := range opts {
+		opt(&l.LockOptions)
+	}
+
+	repairLockOpt(&l.LockOptions)
+
+	return l
+}
+
+func (l *RWLock) RLock(ctx context.Context) error {
+	if err := l.acquire(ctx, l.tryRLock); err != nil {
+		return err
+	}
+	//同一读者重入时看门狗已在首次加读锁时启动
+	if atomic.LoadInt64(&l.readCount) == 1 {
+		l.startWatchDog(ctx, l.delayReadExpire)
+	}
+	return nil
+}
+
+func (l *RWLock) Lock(ctx context.Context) error {
+	try := func(ctx context.Context) error {
+		return l.tryLock(ctx, 0)
+	}
+	if l.isBlock {
+		//阻塞模式下登记写者等待标识, 阻止新的读者加锁
+		try = func(ctx context.Context) error {
+			return l.tryLock(ctx, RWLockWriterWaitSeconds)
+		}
+	}
+	if err := l.acquire(ctx, try); err != nil {
+		return err
+	}
+	l.startWatchDog(ctx, l.delayWriteExpire)
+	return nil
+}
+
+func (l *RWLock) acquire(ctx context.Context, try func(ctx context.Context) error) error {
+	err := try(ctx)
+	if err != nil && l.isBlock && IsRetryableErr(err) {
+		return blockingAcquire(ctx, l.blockWaitingSeconds, try)
+	}
+	return err
+}
+
+func (l *RWLock) startWatchDog(ctx context.Context, delayExpire delayExpireFunc) {
+	//没启用看门狗模式时只在锁过期时发出丢失通知
+	l.dog.watch(ctx, &l.LockOptions, delayExpire)
+}
+
+// 锁丢失时关闭的channel: 看门狗续期失败或锁到达过期时间时关闭, 持有者应停止访问受保护的资源
+func (l *RWLock) Lost() <-chan struct{} {
+	return l.dog.Lost()
+}
+
+func (l *RWLock) tryRLock(ctx context.Context) error {
+	keysAndArgs := append(l.getKeys(), l.token, l.expireSeconds)
+	reply, err := l.client.Eval(ctx, third_party.LuaRWLockReadLock, 4, keysAndArgs)
+	if err != nil {
+		return err
+	}
+	count, _ := reply.(int64)
+	if count <= 0 {
+		return fmt.Errorf("reply: %d, err: %w", count, ErrLockInUse)
+	}
+	atomic.StoreInt64(&l.readCount, count)
+	return nil
+}
+
+func (l *RWLock) tryLock(ctx context.Context, writerWaitSeconds int64) error {
+	keysAndArgs := append(l.getKeys(), l.token, l.expireSeconds, writerWaitSeconds)
+	reply, err := l.client.Eval(ctx, third_party.LuaRWLockWriteLock, 4, keysAndArgs)
+	if err != nil {
+		return err
+	}
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("reply: %d, err: %w", ret, ErrLockInUse)
+	}
+	return nil
+}
+
+func (l *RWLock) RUnlock(ctx context.Context) error {
+	keysAndArgs := append(l.getKeys(), l.token)
+	reply, err := l.client.Eval(ctx, third_party.LuaRWLockReadUnlock, 4, keysAndArgs)
+	count, ok := reply.(int64)
+	if err != nil || !ok || count < 0 {
+		return fmt.Errorf("fail to runlock key:%s err: %w", l.getReadKey(), err)
+	}
+
+	atomic.StoreInt64(&l.readCount, count)
+	//重入次数减到0时才停止看门狗
+	if count == 0 {
+		l.dog.Stop()
+	}
+	return nil
+}
+
+func (l *RWLock) Unlock(ctx context.Context) error {
+	l.dog.Stop()
+
+	keysAndArgs := []interface{}{l.getWriteKey(), l.token}
+	reply, err := l.client.Eval(ctx, third_party.LuaCheckAndDeleteDistributionLock, 1, keysAndArgs)
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("fail to unlock key:%s err: %w", l.getWriteKey(), err)
+	}
+	return nil
+}
+
+func (l *RWLock) delayReadExpire(ctx context.Context, expireSeconds int64) error {
+	keysAndArgs := append(l.getKeys(), l.token, expireSeconds)
+	reply, err := l.client.Eval(ctx, third_party.LuaRWLockReadExpire, 4, keysAndArgs)
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("fail to delay expired key:%s expire:%d err: %w", l.getReadKey(), expireSeconds, err)
+	}
+	return nil
+}
+
+func (l *RWLock) delayWriteExpire(ctx context.Context, expireSeconds int64) error {
+	keysAndArgs := []interface{}{l.getWriteKey(), l.token, expireSeconds}
+	reply, err := l.client.Eval(ctx, third_party.LuaCheckAndExpireDistributionLock, 1, keysAndArgs)
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("fail to delay expired key:%s expire:%d err: %w", l.getWriteKey(), expireSeconds, err)
+	}
+	return nil
+}
+
+// 读写锁脚本共用的KEYS: 写锁, 读锁, 读者过期时间, 写者等待标识
+func (l *RWLock) getKeys() []interface{} {
+	return []interface{}{l.getWriteKey(), l.getReadKey(), l.getReadersKey(), l.getWriterWaitKey()}
+}
+
+func (l *RWLock) getWriteKey() string {
+	return l.keyBuilder.Lock(l.key, "write")
+}
+
+func (l *RWLock) getReadKey() string {
+	return l.keyBuilder.Lock(l.key, "read")
+}
+
+func (l *RWLock) getReadersKey() string {
+	return l.keyBuilder.Lock(l.key, "readers")
+}
+
+func (l *RWLock) getWriterWaitKey() string {
+	return l.keyBuilder.Lock(l.key, "writer_wait")
+}
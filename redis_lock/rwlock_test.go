@@ -0,0 +1,174 @@
+package redis_lock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 在新的协程中执行, 使持有者标识与当前协程不同
+func inOtherGoroutine(f func() error) error {
+	errCh := make(chan error)
+	go func() {
+		errCh <- f()
+	}()
+	return <-errCh
+}
+
+func Test_rwlock_shared_read(t *testing.T) {
+	client, _ := newMiniLockClient(t)
+	ctx := context.Background()
+
+	reader1 := NewRWLock("rw1", client, WithExpireSeconds(5))
+	if err := reader1.RLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var reader2 *RWLock
+	if err := inOtherGoroutine(func() error {
+		reader2 = NewRWLock("rw1", client, WithExpireSeconds(5))
+		return reader2.RLock(ctx)
+	}); err != nil {
+		t.Fatal("readers should share the lock: ", err)
+	}
+
+	//有读者时写锁取锁失败
+	if err := inOtherGoroutine(func() error {
+		return NewRWLock("rw1", client, WithExpireSeconds(5)).Lock(ctx)
+	}); !IsRetryableErr(err) {
+		t.Fatal("writer should be blocked by readers, got: ", err)
+	}
+
+	if err := reader1.RUnlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader2.RUnlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := NewRWLock("rw1", client, WithExpireSeconds(5))
+	if err := writer.Lock(ctx); err != nil {
+		t.Fatal("writer should acquire after readers released: ", err)
+	}
+
+	//有写者时读锁取锁失败
+	if err := inOtherGoroutine(func() error {
+		return NewRWLock("rw1", client, WithExpireSeconds(5)).RLock(ctx)
+	}); !IsRetryableErr(err) {
+		t.Fatal("reader should be blocked by writer, got: ", err)
+	}
+
+	if err := writer.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Unlock(ctx); err == nil {
+		t.Fatal("unlock released lock should fail")
+	}
+}
+
+func Test_rwlock_writer_preference(t *testing.T) {
+	client, _ := newMiniLockClient(t)
+	ctx := context.Background()
+
+	reader := NewRWLock("rw2", client, WithExpireSeconds(5))
+	if err := reader.RLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	writerErr := make(chan error)
+	go func() {
+		writer := NewRWLock("rw2", client, WithExpireSeconds(5), WithBlock(), WithBlockWaitingSeconds(3))
+		if err := writer.Lock(ctx); err != nil {
+			writerErr <- err
+			return
+		}
+		writerErr <- writer.Unlock(ctx)
+	}()
+
+	//等待写者登记等待标识后, 新的读者无法加锁
+	time.Sleep(200 * time.Millisecond)
+	if err := inOtherGoroutine(func() error {
+		return NewRWLock("rw2", client, WithExpireSeconds(5)).RLock(ctx)
+	}); !IsRetryableErr(err) {
+		t.Fatal("new reader should wait for the waiting writer, got: ", err)
+	}
+
+	if err := reader.RUnlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-writerErr; err != nil {
+		t.Fatal("waiting writer should acquire after reader released: ", err)
+	}
+
+	if err := inOtherGoroutine(func() error {
+		return NewRWLock("rw2", client, WithExpireSeconds(5)).RLock(ctx)
+	}); err != nil {
+		t.Fatal("reader should acquire after writer released: ", err)
+	}
+}
+
+func Test_rwlock_reentrant_read(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	reader := NewRWLock("rw3", client, WithExpireSeconds(5))
+	for i := 0; i < 2; i++ {
+		if err := reader.RLock(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reader.RUnlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !server.Exists(reader.getReadKey()) {
+		t.Fatal("read lock should still be held after one of two runlocks")
+	}
+	if err := reader.RUnlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists(reader.getReadKey()) {
+		t.Fatal("read lock should be released")
+	}
+}
+
+// 崩溃的读者不再续期, 到达其过期时间后不能因其他读者续期而继续阻塞写者
+func Test_rwlock_crashed_reader_does_not_block_writer(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	//crashed加锁后不再续期也不解锁
+	if err := inOtherGoroutine(func() error {
+		return NewRWLock("rw4", client, WithExpireSeconds(2)).RLock(ctx)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	alive := NewRWLock("rw4", client, WithExpireSeconds(5))
+	if err := alive.RLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server.Advance(time.Second)
+	if err := alive.delayReadExpire(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	//crashed已过期, alive仍持有读锁
+	server.Advance(2 * time.Second)
+	if err := inOtherGoroutine(func() error {
+		return NewRWLock("rw4", client, WithExpireSeconds(5)).Lock(ctx)
+	}); !IsRetryableErr(err) {
+		t.Fatal("writer should be blocked by the alive reader, got: ", err)
+	}
+
+	if err := alive.RUnlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := inOtherGoroutine(func() error {
+		return NewRWLock("rw4", client, WithExpireSeconds(5)).Lock(ctx)
+	}); err != nil {
+		t.Fatal("expired reader should not block the writer: ", err)
+	}
+	if server.Exists(alive.getReadKey()) || server.Exists(alive.getReadersKey()) {
+		t.Fatal("expired reader should be pruned")
+	}
+}
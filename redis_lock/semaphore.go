@@ -0,0 +1,115 @@
+package redis_lock
+
+import (
+	"TCC/third_party"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// 许可序号, 保证同一协程多次取得的许可token不同
+var permitSeq int64
+
+// 分布式计数信号量: 所有副本共享同一个许可上限, 持有者以有序集合储存, 过期未续期的持有者会被自动清理
+type Semaphore struct {
+	key    string
+	limit  int64
+	client third_party.LockClient
+
+	LockOptions
+}
+
+// 信号量的一个许可, 释放后不可再使用
+type Permit struct {
+	token string
+	//看门狗
+	dog watchDog
+}
+
+func NewSemaphore(key string, limit int64, client third_party.LockClient, opts ...LockOption) *Semaphore {
+	s := &Semaphore{
+		key:    key,
+		limit:  limit,
+		client: client,
+	}
+
+	for _, opt := range opts {
+		opt(&s.LockOptions)
+	}
+
+	repairLockOpt(&s.LockOptions)
+
+	return s
+}
+
+// 阻塞等待许可, 直到取得许可或ctx结束
+func (s *Semaphore) Acquire(ctx context.Context) (*Permit, error) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		permit, err := s.TryAcquire(ctx)
+		if err == nil {
+			return permit, nil
+		}
+		if !IsRetryableErr(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("ctx timeout, acquire fail: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// 尝试取得许可, 许可已用完时返回可重试的ErrLockInUse
+func (s *Semaphore) TryAcquire(ctx context.Context) (*Permit, error) {
+	permit := &Permit{
+		token: fmt.Sprintf("%s-%d", getPidAndGidStr(), atomic.AddInt64(&permitSeq, 1)),
+	}
+
+	keysAndArgs := []interface{}{s.getSemaphoreKey(), permit.token, s.limit, s.expireSeconds * 1000}
+	reply, err := s.client.Eval(ctx, third_party.LuaSemaphoreAcquire, 1, keysAndArgs)
+	if err != nil {
+		return nil, err
+	}
+	if ret, _ := reply.(int64); ret != 1 {
+		return nil, fmt.Errorf("semaphore:%s limit:%d err: %w", s.key, s.limit, ErrLockInUse)
+	}
+
+	permit.dog.watch(ctx, &s.LockOptions, func(ctx context.Context, expireSeconds int64) error {
+		return s.renew(ctx, permit, expireSeconds)
+	})
+	return permit, nil
+}
+
+func (s *Semaphore) Release(ctx context.Context, permit *Permit) error {
+	permit.dog.Stop()
+
+	reply, err := s.client.Eval(ctx, third_party.LuaSemaphoreRelease, 1, []interface{}{s.getSemaphoreKey(), permit.token})
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("fail to release semaphore:%s err: %w", s.key, err)
+	}
+	return nil
+}
+
+func (s *Semaphore) renew(ctx context.Context, permit *Permit, expireSeconds int64) error {
+	keysAndArgs := []interface{}{s.getSemaphoreKey(), permit.token, expireSeconds * 1000}
+	reply, err := s.client.Eval(ctx, third_party.LuaSemaphoreRenew, 1, keysAndArgs)
+	if ret, _ := reply.(int64); ret != 1 {
+		return fmt.Errorf("fail to renew semaphore:%s err: %w", s.key, err)
+	}
+	return nil
+}
+
+// 许可丢失时关闭的channel: 看门狗续期失败或许可到达过期时间时关闭
+func (p *Permit) Lost() <-chan struct{} {
+	return p.dog.Lost()
+}
+
+func (s *Semaphore) getSemaphoreKey() string {
+	return s.keyBuilder.Lock(s.key, "semaphore")
+}
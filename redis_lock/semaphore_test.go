@@ -0,0 +1,75 @@
+package redis_lock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_semaphore_limit(t *testing.T) {
+	client, _ := newMiniLockClient(t)
+	ctx := context.Background()
+
+	sem := NewSemaphore("sem1", 2, client, WithExpireSeconds(5))
+	permit1, err := sem.TryAcquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permit2, err := sem.TryAcquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sem.TryAcquire(ctx); !IsRetryableErr(err) {
+		t.Fatal("semaphore should be exhausted, got: ", err)
+	}
+
+	//阻塞等待其他持有者释放许可
+	acquired := make(chan error)
+	go func() {
+		permit, err := sem.Acquire(ctx)
+		if err == nil {
+			err = sem.Release(ctx, permit)
+		}
+		acquired <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := sem.Release(ctx, permit1); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-acquired; err != nil {
+		t.Fatal("blocked acquire should succeed after release: ", err)
+	}
+
+	if err := sem.Release(ctx, permit2); err != nil {
+		t.Fatal(err)
+	}
+	if err := sem.Release(ctx, permit2); err == nil {
+		t.Fatal("release released permit should fail")
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	full := NewSemaphore("sem1", 0, client, WithExpireSeconds(5))
+	if _, err := full.Acquire(cctx); err == nil {
+		t.Fatal("acquire should stop when ctx done")
+	}
+}
+
+func Test_semaphore_reap_expired_holder(t *testing.T) {
+	client, server := newMiniLockClient(t)
+	ctx := context.Background()
+
+	sem := NewSemaphore("sem2", 1, client, WithExpireSeconds(1))
+	if _, err := sem.TryAcquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sem.TryAcquire(ctx); !IsRetryableErr(err) {
+		t.Fatal("semaphore should be exhausted, got: ", err)
+	}
+
+	//持有者崩溃未释放, 过期后许可被回收
+	server.Advance(2 * time.Second)
+	if _, err := sem.TryAcquire(ctx); err != nil {
+		t.Fatal("expired holder should be reaped: ", err)
+	}
+}
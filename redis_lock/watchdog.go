@@ -0,0 +1,131 @@
+package redis_lock
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 看门狗: 加锁成功后在后台定期为锁续期, 直到解锁时被停止.
+// 续期失败或锁过期时关闭lost通知持有者锁已丢失
+type watchDog struct {
+	//看门狗运作标识
+	running int32
+
+	mux sync.Mutex
+	//停止看门狗
+	stop context.CancelFunc
+	//锁丢失时关闭
+	lost chan struct{}
+}
+
+// 续期函数, 为锁设置新的过期时间
+type delayExpireFunc func(ctx context.Context, expireSeconds int64) error
+
+// 加锁成功后调用: 看门狗模式下定期续期, 否则在锁过期时发出丢失通知
+func (w *watchDog) watch(ctx context.Context, opts *LockOptions, delayExpire delayExpireFunc) {
+	if opts.watchDogMode {
+		w.launch(ctx, func(ctx context.Context, markLost func()) {
+			w.run(ctx, opts, delayExpire, markLost)
+		})
+		return
+	}
+	w.launch(ctx, func(ctx context.Context, markLost func()) {
+		expired, stop := opts.clock.NewTimer(time.Duration(opts.expireSeconds) * time.Second)
+		defer stop()
+		select {
+		case <-ctx.Done():
+		case <-expired:
+			markLost()
+		}
+	})
+}
+
+func (w *watchDog) launch(ctx context.Context, watch func(ctx context.Context, markLost func())) {
+	for !atomic.CompareAndSwapInt32(&w.running, 0, 1) {
+		time.Sleep(10 * time.Millisecond) //循环等待之前的看门狗退出
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	lost := make(chan struct{})
+	w.mux.Lock()
+	w.stop, w.lost = stop, lost
+	w.mux.Unlock()
+
+	//进入看门狗模式
+	go func() {
+		defer func() {
+			atomic.StoreInt32(&w.running, 0)
+		}()
+		watch(ctx, func() {
+			close(lost)
+		})
+	}()
+}
+
+func (w *watchDog) run(ctx context.Context, opts *LockOptions, delayExpire delayExpireFunc, markLost func()) {
+	for {
+		tick, stop := opts.clock.NewTimer(opts.watchDogStep)
+		select {
+		case <-ctx.Done():
+			stop()
+			return
+		case <-tick:
+			err := delayExpire(ctx, opts.watchDogExpireSeconds)
+			if err != nil && ctx.Err() == nil {
+				//续期失败时无法保证锁仍被持有, 通知持有者后退出
+				log.Printf("redis_lock: watchDogRunning err:%v", err)
+				markLost()
+				return
+			}
+		}
+	}
+}
+
+// 锁丢失时关闭的channel, 每次加锁成功后更新; 尚未加锁时返回nil
+func (w *watchDog) Lost() <-chan struct{} {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.lost
+}
+
+func (w *watchDog) Stop() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.stop != nil {
+		w.stop()
+	}
+}
+
+// 阻塞模式下轮询取锁, 直到取锁成功、超时或出现不可重试的错误
+func blockingAcquire(ctx context.Context, blockWaitingSeconds int64, try func(ctx context.Context) error) error {
+	timeoutCh := time.After(time.Duration(blockWaitingSeconds) * time.Second)
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("ctx timeout, lock fai: %w", ctx.Err())
+		case <-timeoutCh:
+			return fmt.Errorf("block wait timeout: %w", ErrLockInUse)
+		default:
+			err := try(ctx)
+
+			if err == nil {
+				return nil //成功加锁后返回
+			}
+
+			//非重试错误，直接返回
+			if !IsRetryableErr(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
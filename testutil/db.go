@@ -0,0 +1,30 @@
+package testutil
+
+import (
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// 进程内的sqlite内存库, 按models建表, 测试结束时自动关闭.
+// 生产环境的表结构由外部维护, 这里的AutoMigrate只用于测试
+func NewDB(t testing.TB, models ...interface{}) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//内存库每个连接相互独立, 只保留一个连接
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	if err = db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
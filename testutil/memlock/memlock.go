@@ -0,0 +1,264 @@
+package memlock
+
+import (
+	"TCC/third_party"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//该文件主要记录测试使用的内存LockClient与可拨动的时钟, 无需启动redis即可测试分布式锁
+
+// 内存LockClient不支持的lua脚本
+var ErrScriptNotSupported = errors.New("script not supported by memory lock client")
+
+// 时钟, 内存LockClient以此判断key是否过期
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// 可手动拨动的时钟, 用于在测试中确定性地触发key过期.
+// 同时满足redis_lock.Clock, 看门狗的续期与过期通知由Advance触发
+type FakeClock struct {
+	mux    sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+// 将时钟向前拨动d, 触发到期的计时器
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+
+	//按到期时间依次触发
+	sort.Slice(c.timers, func(i, j int) bool {
+		return c.timers[i].deadline.Before(c.timers[j].deadline)
+	})
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
+
+// d之后向返回的channel发送当时的时间, stop取消尚未触发的计时器
+func (c *FakeClock) NewTimer(d time.Duration) (<-chan time.Time, func()) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	timer := &fakeTimer{deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer.c, func() {}
+	}
+	c.timers = append(c.timers, timer)
+	return timer.c, func() {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		for i, t := range c.timers {
+			if t == timer {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// 尚未触发的计时器数量, 测试中用于等待后台协程开始计时后再拨动时钟
+func (c *FakeClock) Timers() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.timers)
+}
+
+type memoryEntry struct {
+	value    string
+	expireAt time.Time
+}
+
+// 进程内的LockClient, 模拟SET NX EX以及分布式锁解锁、续期、fencing token加锁三个lua脚本的语义, 无需启动redis
+type Client struct {
+	mux     sync.Mutex
+	clock   Clock
+	entries map[string]memoryEntry
+}
+
+var _ third_party.LockClient = (*Client)(nil)
+
+// clock为nil时使用系统时钟
+func NewClient(clock Clock) *Client {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &Client{
+		clock:   clock,
+		entries: make(map[string]memoryEntry),
+	}
+}
+
+func (c *Client) SetNXWithEX(ctx context.Context, key, value string, expirationSeconds int64) (int64, error) {
+	if key == "" || value == "" {
+		return -1, errors.New("SETNXWithEX: redis key or value can't be empty")
+	}
+	if expirationSeconds <= 0 {
+		return -1, fmt.Errorf("SETNXWithEX: invalid expire time: %d", expirationSeconds)
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if _, ok := c.get(key); ok {
+		return 0, nil
+	}
+	c.entries[key] = memoryEntry{
+		value:    value,
+		expireAt: c.clock.Now().Add(time.Duration(expirationSeconds) * time.Second),
+	}
+	return 1, nil
+}
+
+// 仅支持LuaCheckAndDeleteDistributionLock、LuaCheckAndExpireDistributionLock与LuaSetNXWithFencingToken,
+// 其余脚本返回ErrScriptNotSupported
+func (c *Client) Eval(ctx context.Context, src string, keyCount int, keyAndArgs []interface{}) (interface{}, error) {
+	switch src {
+	case third_party.LuaCheckAndDeleteDistributionLock:
+		if keyCount != 1 || len(keyAndArgs) < 2 {
+			return nil, fmt.Errorf("check and delete: wrong number of keys or args: %d, %d", keyCount, len(keyAndArgs))
+		}
+		return c.checkAndDelete(fmt.Sprint(keyAndArgs[0]), fmt.Sprint(keyAndArgs[1])), nil
+	case third_party.LuaCheckAndExpireDistributionLock:
+		if keyCount != 1 || len(keyAndArgs) < 3 {
+			return nil, fmt.Errorf("check and expire: wrong number of keys or args: %d, %d", keyCount, len(keyAndArgs))
+		}
+		expire, err := strconv.ParseInt(fmt.Sprint(keyAndArgs[2]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("check and expire: invalid expire time: %w", err)
+		}
+		return c.checkAndExpire(fmt.Sprint(keyAndArgs[0]), fmt.Sprint(keyAndArgs[1]), expire), nil
+	case third_party.LuaSetNXWithFencingToken:
+		if keyCount != 2 || len(keyAndArgs) < 4 {
+			return nil, fmt.Errorf("set nx with fencing token: wrong number of keys or args: %d, %d", keyCount, len(keyAndArgs))
+		}
+		expire, err := strconv.ParseInt(fmt.Sprint(keyAndArgs[3]), 10, 64)
+		if err != nil || expire <= 0 {
+			return nil, fmt.Errorf("set nx with fencing token: invalid expire time: %v", keyAndArgs[3])
+		}
+		return c.setNXWithFencingToken(fmt.Sprint(keyAndArgs[0]), fmt.Sprint(keyAndArgs[1]), fmt.Sprint(keyAndArgs[2]), expire), nil
+	}
+	return nil, ErrScriptNotSupported
+}
+
+func (c *Client) checkAndDelete(key, token string) int64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entry, ok := c.get(key)
+	if !ok || entry.value != token {
+		return 0
+	}
+	delete(c.entries, key)
+	return 1
+}
+
+func (c *Client) checkAndExpire(key, token string, expireSeconds int64) int64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entry, ok := c.get(key)
+	if !ok || entry.value != token {
+		return 0
+	}
+	//与redis一致, 非正数的过期时间会直接删除key
+	if expireSeconds <= 0 {
+		delete(c.entries, key)
+		return 1
+	}
+	entry.expireAt = c.clock.Now().Add(time.Duration(expireSeconds) * time.Second)
+	c.entries[key] = entry
+	return 1
+}
+
+// 与lua脚本一致, token以时钟的微秒数为基础且大于上一次的token, fencing计数器不过期
+func (c *Client) setNXWithFencingToken(key, fencingKey, token string, expireSeconds int64) int64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if _, ok := c.get(key); ok {
+		return 0
+	}
+	now := c.clock.Now()
+	c.entries[key] = memoryEntry{value: token, expireAt: now.Add(time.Duration(expireSeconds) * time.Second)}
+
+	fencingToken := now.UnixMicro()
+	if last, ok := c.get(fencingKey); ok {
+		if lastToken, _ := strconv.ParseInt(last.value, 10, 64); fencingToken <= lastToken {
+			fencingToken = lastToken + 1
+		}
+	}
+	c.entries[fencingKey] = memoryEntry{value: strconv.FormatInt(fencingToken, 10)}
+	return fencingToken
+}
+
+// 获取key的值, key不存在或已过期时返回false
+func (c *Client) Get(key string) (string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entry, ok := c.get(key)
+	return entry.value, ok
+}
+
+// 获取key的剩余存活时间, key不存在或已过期时返回false
+func (c *Client) TTL(key string) (time.Duration, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entry, ok := c.get(key)
+	if !ok {
+		return 0, false
+	}
+	return entry.expireAt.Sub(c.clock.Now()), true
+}
+
+// 调用方需持有锁, 顺带清理已过期的key; 过期时间为零值的key不过期
+func (c *Client) get(key string) (memoryEntry, bool) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if !entry.expireAt.IsZero() && !c.clock.Now().Before(entry.expireAt) {
+		delete(c.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
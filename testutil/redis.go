@@ -0,0 +1,44 @@
+package testutil
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// 进程内的RESP服务端, 监听随机端口, 测试结束时自动关闭.
+// 支持RedisClient使用的命令, 包括EVAL/EVALSHA执行项目中的lua脚本、MULTI/EXEC/WATCH以及BLPOP.
+// key的过期与TIME命令均由可控时钟驱动, 通过Advance拨动
+type RedisServer struct {
+	*miniredis.Miniredis
+
+	mux sync.Mutex
+	now time.Time
+}
+
+func NewRedisServer(t testing.TB) *RedisServer {
+	s := &RedisServer{
+		Miniredis: miniredis.RunT(t),
+		now:       time.Now(),
+	}
+	s.SetTime(s.now)
+	return s
+}
+
+// 服务端的当前时间, 满足memlock.Clock, 可与内存LockClient共用同一时钟
+func (s *RedisServer) Now() time.Time {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.now
+}
+
+// 将时钟向前拨动d, 剩余存活时间不超过d的key随之过期
+func (s *RedisServer) Advance(d time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.now = s.now.Add(d)
+	s.SetTime(s.now)
+	s.FastForward(d)
+}
@@ -0,0 +1,91 @@
+package testutil_test
+
+import (
+	"TCC/testutil"
+	"TCC/third_party"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func newClient(t *testing.T, server *testutil.RedisServer) *third_party.RedisClient {
+	client, err := third_party.NewClient("tcp", server.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// 项目中的lua脚本都能被加载
+func Test_load_project_scripts(t *testing.T) {
+	server := testutil.NewRedisServer(t)
+	client := newClient(t, server)
+	ctx := context.Background()
+
+	scripts := map[string]string{
+		"LuaCheckAndDeleteDistributionLock": third_party.LuaCheckAndDeleteDistributionLock,
+		"LuaCheckAndExpireDistributionLock": third_party.LuaCheckAndExpireDistributionLock,
+		"LuaReentrantLock":                  third_party.LuaReentrantLock,
+		"LuaReentrantUnlock":                third_party.LuaReentrantUnlock,
+		"LuaReentrantExpire":                third_party.LuaReentrantExpire,
+		"LuaRWLockReadLock":                 third_party.LuaRWLockReadLock,
+		"LuaRWLockReadUnlock":               third_party.LuaRWLockReadUnlock,
+		"LuaRWLockReadExpire":               third_party.LuaRWLockReadExpire,
+		"LuaRWLockWriteLock":                third_party.LuaRWLockWriteLock,
+		"LuaFairLockAcquire":                third_party.LuaFairLockAcquire,
+		"LuaFairLockRelease":                third_party.LuaFairLockRelease,
+		"LuaFairLockDequeue":                third_party.LuaFairLockDequeue,
+		"LuaSetNXWithFencingToken":          third_party.LuaSetNXWithFencingToken,
+		"LuaReentrantLockWithFencingToken":  third_party.LuaReentrantLockWithFencingToken,
+		"LuaFencedSet":                      third_party.LuaFencedSet,
+		"LuaSemaphoreAcquire":               third_party.LuaSemaphoreAcquire,
+		"LuaSemaphoreRenew":                 third_party.LuaSemaphoreRenew,
+		"LuaSemaphoreRelease":               third_party.LuaSemaphoreRelease,
+		"LuaMultiLockAcquire":               third_party.LuaMultiLockAcquire,
+		"LuaMultiLockRelease":               third_party.LuaMultiLockRelease,
+		"LuaMultiLockExpire":                third_party.LuaMultiLockExpire,
+	}
+	for name, src := range scripts {
+		if err := third_party.NewScript(-1, src).Load(ctx, client); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func Test_advance_expires_keys(t *testing.T) {
+	server := testutil.NewRedisServer(t)
+	client := newClient(t, server)
+	ctx := context.Background()
+
+	start := server.Now()
+	if _, err := client.SetNXWithEX(ctx, "lock", "token", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Advance(time.Second)
+	if _, err := client.Get(ctx, "lock"); err != nil {
+		t.Fatal("key should not expire before ttl: ", err)
+	}
+
+	server.Advance(time.Second)
+	if _, err := client.Get(ctx, "lock"); !errors.Is(err, redis.ErrNil) {
+		t.Fatal("key should expire after ttl, got: ", err)
+	}
+
+	//TIME命令同样受时钟控制
+	conn, err := client.GetConn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	values, err := redis.Int64s(conn.Do("TIME"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Unix(values[0], values[1]*int64(time.Microsecond)); !got.Equal(start.Add(2 * time.Second).Truncate(time.Microsecond)) {
+		t.Fatalf("TIME should follow the clock, got: %v, want: %v", got, start.Add(2*time.Second))
+	}
+}
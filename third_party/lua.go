@@ -24,3 +24,370 @@ const LuaCheckAndExpireDistributionLock = `
 		return redis.call("expire", localKey, expire)
 	end
 `
+
+// 可重入锁加锁: 锁以hash储存, field为持有者token, value为重入次数.
+// 锁不存在或由当前token持有时重入次数加一并刷新过期时间, 返回重入次数; 被其他token持有时返回0
+const LuaReentrantLock = `
+	local localKey = KEYS[1]
+	local targetToken = ARGV[1]
+	local expire = ARGV[2]
+	if (redis.call("exists", localKey) == 0 or redis.call("hexists", localKey, targetToken) == 1) then
+		local count = redis.call("hincrby", localKey, targetToken, 1)
+		redis.call("expire", localKey, expire)
+		return count
+	end
+	return 0
+`
+
+// 可重入锁解锁: 重入次数减一, 减到0时删除锁并返回0; 锁不由当前token持有时返回-1
+const LuaReentrantUnlock = `
+	local localKey = KEYS[1]
+	local targetToken = ARGV[1]
+	if (redis.call("hexists", localKey, targetToken) == 0) then
+		return -1
+	end
+	local count = redis.call("hincrby", localKey, targetToken, -1)
+	if (count <= 0) then
+		redis.call("del", localKey)
+		return 0
+	end
+	return count
+`
+
+// 刷新可重入锁的过期时间, 锁不由当前token持有时返回0
+const LuaReentrantExpire = `
+	local localKey = KEYS[1]
+	local targetToken = ARGV[1]
+	local expire = ARGV[2]
+	if (redis.call("hexists", localKey, targetToken) == 0) then
+		return 0
+	end
+	return redis.call("expire", localKey, expire)
+`
+
+// 读写锁中清理已过期读者的公共片段: KEYS[2]为读锁(hash, field为读者token, value为重入次数),
+// KEYS[3]为读者过期时间(zset, member为读者token, score为过期时间毫秒戳). 每个读者各自过期,
+// 崩溃的读者不会因其他读者续期而一直占用读锁. 时间以redis服务端为准
+const luaRWLockPruneReaders = `
+	local t = redis.call("time")
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+	local expiredReaders = redis.call("zrangebyscore", KEYS[3], "-inf", now)
+	for _, reader in ipairs(expiredReaders) do
+		redis.call("hdel", KEYS[2], reader)
+	end
+	if (#expiredReaders > 0) then
+		redis.call("zremrangebyscore", KEYS[3], "-inf", now)
+	end
+	local function refreshReaders()
+		local last = redis.call("zrange", KEYS[3], -1, -1, "WITHSCORES")
+		if (#last == 0) then
+			redis.call("del", KEYS[2], KEYS[3])
+			return
+		end
+		local ttl = tonumber(last[2]) - now
+		redis.call("pexpire", KEYS[2], ttl)
+		redis.call("pexpire", KEYS[3], ttl)
+	end
+`
+
+// 读写锁加读锁: KEYS[1]为写锁, KEYS[2]为读锁, KEYS[3]为读者过期时间, KEYS[4]为写者等待标识.
+// 写锁被持有或有写者在等待时返回0(写者优先), 否则刷新当前读者的过期时间并返回其重入次数
+const LuaRWLockReadLock = luaRWLockPruneReaders + `
+	local writeKey = KEYS[1]
+	local readKey = KEYS[2]
+	local readersKey = KEYS[3]
+	local writerWaitKey = KEYS[4]
+	local targetToken = ARGV[1]
+	local expireMillis = tonumber(ARGV[2]) * 1000
+	if (redis.call("exists", writeKey) == 1 or redis.call("exists", writerWaitKey) == 1) then
+		refreshReaders()
+		return 0
+	end
+	local count = redis.call("hincrby", readKey, targetToken, 1)
+	redis.call("zadd", readersKey, now + expireMillis, targetToken)
+	refreshReaders()
+	return count
+`
+
+// 读写锁释放读锁: KEYS同加读锁. 读者重入次数减一并返回剩余次数, 减到0时移除该读者,
+// 没有读者时删除读锁; 读者未持有读锁(或已过期)时返回-1
+const LuaRWLockReadUnlock = luaRWLockPruneReaders + `
+	local readKey = KEYS[2]
+	local readersKey = KEYS[3]
+	local targetToken = ARGV[1]
+	if (redis.call("hexists", readKey, targetToken) == 0) then
+		refreshReaders()
+		return -1
+	end
+	local count = redis.call("hincrby", readKey, targetToken, -1)
+	if (count <= 0) then
+		redis.call("hdel", readKey, targetToken)
+		redis.call("zrem", readersKey, targetToken)
+	end
+	refreshReaders()
+	return count
+`
+
+// 刷新当前读者的过期时间, 不影响其他读者; 读者未持有读锁(或已过期)时返回0
+const LuaRWLockReadExpire = luaRWLockPruneReaders + `
+	local readKey = KEYS[2]
+	local readersKey = KEYS[3]
+	local targetToken = ARGV[1]
+	local expireMillis = tonumber(ARGV[2]) * 1000
+	if (redis.call("hexists", readKey, targetToken) == 0) then
+		refreshReaders()
+		return 0
+	end
+	redis.call("zadd", readersKey, now + expireMillis, targetToken)
+	refreshReaders()
+	return 1
+`
+
+// 读写锁加写锁: KEYS同加读锁. 清理过期读者后没有读者且写锁空闲时取锁并返回1.
+// 取锁失败且ARGV[3]大于0时登记写者等待标识, 阻止新的读者加锁, 返回0
+const LuaRWLockWriteLock = luaRWLockPruneReaders + `
+	local writeKey = KEYS[1]
+	local readersKey = KEYS[3]
+	local writerWaitKey = KEYS[4]
+	local targetToken = ARGV[1]
+	local expire = ARGV[2]
+	local waitExpire = tonumber(ARGV[3])
+	refreshReaders()
+	if (redis.call("zcard", readersKey) == 0 and redis.call("set", writeKey, targetToken, "NX", "EX", expire)) then
+		if (redis.call("get", writerWaitKey) == targetToken) then
+			redis.call("del", writerWaitKey)
+		end
+		return 1
+	end
+	if (waitExpire > 0) then
+		local waiting = redis.call("get", writerWaitKey)
+		if (not waiting or waiting == targetToken) then
+			redis.call("set", writerWaitKey, targetToken, "EX", waitExpire)
+		end
+	end
+	return 0
+`
+
+// 公平锁取锁: KEYS[1]为锁, KEYS[2]为等待队列(list), KEYS[3]为等待者超时时间(zset).
+// 先清理超时的等待者, 锁空闲且当前token位于队首(或队列为空)时取锁并出队, 返回1;
+// 否则当ARGV[3](毫秒)大于0时将token入队(已在队列中则只刷新超时时间), 返回0. 时间以redis服务端为准
+const LuaFairLockAcquire = `
+	local lockKey = KEYS[1]
+	local queueKey = KEYS[2]
+	local timeoutKey = KEYS[3]
+	local targetToken = ARGV[1]
+	local expire = ARGV[2]
+	local waitTimeout = tonumber(ARGV[3])
+	local t = redis.call("time")
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+	local expired = redis.call("zrangebyscore", timeoutKey, "-inf", now)
+	for _, token in ipairs(expired) do
+		redis.call("lrem", queueKey, 0, token)
+		redis.call("zrem", timeoutKey, token)
+	end
+	if (redis.call("exists", lockKey) == 0) then
+		local head = redis.call("lindex", queueKey, 0)
+		if (not head or head == targetToken) then
+			redis.call("set", lockKey, targetToken, "EX", expire)
+			if (head) then
+				redis.call("lpop", queueKey)
+				redis.call("zrem", timeoutKey, targetToken)
+			end
+			return 1
+		end
+	end
+	if (waitTimeout > 0) then
+		if (redis.call("zadd", timeoutKey, now + waitTimeout, targetToken) == 1) then
+			redis.call("rpush", queueKey, targetToken)
+		end
+	end
+	return 0
+`
+
+// 公平锁解锁: 锁由当前token持有时删除锁, 并向队首等待者的唤醒队列(ARGV[2]..队首token)推送通知, 返回1; 否则返回0
+const LuaFairLockRelease = `
+	local lockKey = KEYS[1]
+	local queueKey = KEYS[2]
+	local targetToken = ARGV[1]
+	local notifyPrefix = ARGV[2]
+	local notifyExpire = ARGV[3]
+	if (redis.call("get", lockKey) ~= targetToken) then
+		return 0
+	end
+	redis.call("del", lockKey)
+	local head = redis.call("lindex", queueKey, 0)
+	if (head) then
+		local notifyKey = notifyPrefix .. head
+		redis.call("rpush", notifyKey, 1)
+		redis.call("expire", notifyKey, notifyExpire)
+	end
+	return 1
+`
+
+// 公平锁放弃等待: 将token移出等待队列, 若锁空闲则唤醒新的队首等待者
+const LuaFairLockDequeue = `
+	local lockKey = KEYS[1]
+	local queueKey = KEYS[2]
+	local timeoutKey = KEYS[3]
+	local targetToken = ARGV[1]
+	local notifyPrefix = ARGV[2]
+	local notifyExpire = ARGV[3]
+	redis.call("lrem", queueKey, 0, targetToken)
+	redis.call("zrem", timeoutKey, targetToken)
+	redis.call("del", notifyPrefix .. targetToken)
+	local head = redis.call("lindex", queueKey, 0)
+	if (head and redis.call("exists", lockKey) == 0) then
+		local notifyKey = notifyPrefix .. head
+		redis.call("rpush", notifyKey, 1)
+		redis.call("expire", notifyKey, notifyExpire)
+	end
+	return 1
+`
+
+// 生成fencing token的公共片段: token以redis服务端时间(微秒)为基础, 且大于该锁上一次的token.
+// 同一把锁的token严格递增, 服务端时钟回拨时在上一次的token上加一; 不同锁的token按取锁的先后可比较.
+// 不使用INCR: 同一资源会被不同的锁保护(如全局锁与分片租约提交同一条事务记录), 各自INCR的序列无法比较;
+// fencing key丢失(淘汰或未持久化的主从切换)后INCR从1重新开始, 新持有者的token反而比旧持有者小.
+// token超过lua数字的%.14g精度, 写回redis时需格式化为整数字符串
+const luaNextFencingToken = `
+	local function nextFencingToken(fencingKey)
+		local t = redis.call("time")
+		local token = tonumber(t[1]) * 1000000 + tonumber(t[2])
+		local last = tonumber(redis.call("get", fencingKey))
+		if (last and token <= last) then
+			token = last + 1
+		end
+		redis.call("set", fencingKey, string.format("%.0f", token))
+		return token
+	end
+`
+
+// 加锁并生成fencing token: 加锁成功时为KEYS[2]生成新的token并返回, 加锁失败返回0
+const LuaSetNXWithFencingToken = luaNextFencingToken + `
+	local localKey = KEYS[1]
+	local fencingKey = KEYS[2]
+	local targetToken = ARGV[1]
+	local expire = ARGV[2]
+	if (redis.call("set", localKey, targetToken, "NX", "EX", expire)) then
+		return nextFencingToken(fencingKey)
+	end
+	return 0
+`
+
+// 可重入锁加锁并生成fencing token: 与LuaReentrantLock相同, 首次加锁时生成新的token, 重入时沿用当前token.
+// 返回{重入次数, token}, 被其他token持有时返回{0, 0}
+const LuaReentrantLockWithFencingToken = luaNextFencingToken + `
+	local localKey = KEYS[1]
+	local fencingKey = KEYS[2]
+	local targetToken = ARGV[1]
+	local expire = ARGV[2]
+	if (redis.call("exists", localKey) == 0 or redis.call("hexists", localKey, targetToken) == 1) then
+		local count = redis.call("hincrby", localKey, targetToken, 1)
+		redis.call("expire", localKey, expire)
+		if (count == 1) then
+			return {count, nextFencingToken(fencingKey)}
+		end
+		return {count, tonumber(redis.call("get", fencingKey))}
+	end
+	return {0, 0}
+`
+
+// 携带fencing token写入数据: KEYS[1]为数据, KEYS[2]记录该数据最近一次写入的token.
+// token小于已记录的token时拒绝写入并返回0, 否则写入数据并原样记录token, 返回1.
+// 不能写入tonumber后的token: redis以%.14g转换lua数字, 微秒级的token会被舍入
+const LuaFencedSet = `
+	local dataKey = KEYS[1]
+	local fencingKey = KEYS[2]
+	local token = tonumber(ARGV[1])
+	local value = ARGV[2]
+	local lastToken = tonumber(redis.call("get", fencingKey))
+	if (lastToken and token < lastToken) then
+		return 0
+	end
+	redis.call("set", fencingKey, ARGV[1])
+	redis.call("set", dataKey, value)
+	return 1
+`
+
+// 信号量取许可: KEYS[1]为持有者集合(zset, member为许可token, score为过期时间毫秒戳).
+// 先清理已过期的持有者, 持有者数量小于上限时加入集合并返回1, 否则返回0. 时间以redis服务端为准
+const LuaSemaphoreAcquire = `
+	local semKey = KEYS[1]
+	local targetToken = ARGV[1]
+	local limit = tonumber(ARGV[2])
+	local expireMillis = tonumber(ARGV[3])
+	local t = redis.call("time")
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+	redis.call("zremrangebyscore", semKey, "-inf", now)
+	if (redis.call("zscore", semKey, targetToken) or redis.call("zcard", semKey) < limit) then
+		redis.call("zadd", semKey, now + expireMillis, targetToken)
+		redis.call("pexpire", semKey, expireMillis)
+		return 1
+	end
+	return 0
+`
+
+// 信号量续期: 许可仍被持有时刷新其过期时间并返回1, 否则返回0
+const LuaSemaphoreRenew = `
+	local semKey = KEYS[1]
+	local targetToken = ARGV[1]
+	local expireMillis = tonumber(ARGV[2])
+	local t = redis.call("time")
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+	local score = redis.call("zscore", semKey, targetToken)
+	if (not score or tonumber(score) <= now) then
+		return 0
+	end
+	redis.call("zadd", semKey, now + expireMillis, targetToken)
+	if (redis.call("pttl", semKey) < expireMillis) then
+		redis.call("pexpire", semKey, expireMillis)
+	end
+	return 1
+`
+
+// 信号量释放许可: 移除当前token的许可, 许可不存在(已过期被清理)时返回0
+const LuaSemaphoreRelease = `
+	local semKey = KEYS[1]
+	local targetToken = ARGV[1]
+	return redis.call("zrem", semKey, targetToken)
+`
+
+// 多key加锁: KEYS为所有需要加锁的key, 任一key已被持有时不加锁并返回0, 否则为所有key加锁并返回1
+const LuaMultiLockAcquire = `
+	local targetToken = ARGV[1]
+	local expire = ARGV[2]
+	for _, localKey in ipairs(KEYS) do
+		if (redis.call("exists", localKey) == 1) then
+			return 0
+		end
+	end
+	for _, localKey in ipairs(KEYS) do
+		redis.call("set", localKey, targetToken, "EX", expire)
+	end
+	return 1
+`
+
+// 多key解锁: 删除所有由当前token持有的key, 返回删除的数量
+const LuaMultiLockRelease = `
+	local targetToken = ARGV[1]
+	local released = 0
+	for _, localKey in ipairs(KEYS) do
+		if (redis.call("get", localKey) == targetToken) then
+			released = released + redis.call("del", localKey)
+		end
+	end
+	return released
+`
+
+// 多key续期: 刷新所有由当前token持有的key的过期时间, 返回续期成功的数量
+const LuaMultiLockExpire = `
+	local targetToken = ARGV[1]
+	local expire = ARGV[2]
+	local extended = 0
+	for _, localKey in ipairs(KEYS) do
+		if (redis.call("get", localKey) == targetToken) then
+			extended = extended + redis.call("expire", localKey, expire)
+		end
+	end
+	return extended
+`
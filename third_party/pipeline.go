@@ -0,0 +1,229 @@
+package third_party
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// WATCH的key在EXEC前被修改, 事务未执行
+var ErrTxAborted = errors.New("redis transaction aborted: watched key modified")
+
+// 单条命令的回复, Err为该命令自身的错误(如类型错误), 不影响同批次的其他命令
+type Reply struct {
+	Value interface{}
+	Err   error
+}
+
+// 以下为带类型的解析方法, 回复为nil时返回redis.ErrNil
+
+func (r Reply) Int64() (int64, error) {
+	return redis.Int64(r.Value, r.Err)
+}
+
+func (r Reply) String() (string, error) {
+	return redis.String(r.Value, r.Err)
+}
+
+func (r Reply) Strings() ([]string, error) {
+	return redis.Strings(r.Value, r.Err)
+}
+
+func (r Reply) Bool() (bool, error) {
+	return redis.Bool(r.Value, r.Err)
+}
+
+type command struct {
+	name string
+	args []interface{}
+}
+
+// 管道: 命令先在本地排队, Exec时在同一连接上一次性发送并按顺序取回所有回复
+type Pipeline struct {
+	client *RedisClient
+	cmds   []command
+}
+
+func (c *RedisClient) Pipeline() *Pipeline {
+	return &Pipeline{client: c}
+}
+
+// 将命令加入管道
+func (p *Pipeline) Do(name string, args ...interface{}) *Pipeline {
+	p.cmds = append(p.cmds, command{name: name, args: args})
+	return p
+}
+
+// 发送管道中的所有命令, 回复与命令一一对应; 只有连接错误会通过error返回
+func (p *Pipeline) Exec(ctx context.Context) ([]Reply, error) {
+	if len(p.cmds) == 0 {
+		return nil, nil
+	}
+
+	conn, err := p.client.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for _, cmd := range p.cmds {
+		if err = conn.Send(cmd.name, cmd.args...); err != nil {
+			return nil, fmt.Errorf("pipeline send %s: %w", cmd.name, err)
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return nil, fmt.Errorf("pipeline flush: %w", err)
+	}
+
+	replies := make([]Reply, len(p.cmds))
+	for i := range p.cmds {
+		replies[i], err = receive(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// MULTI/EXEC事务, 由RedisClient.Transaction创建, 只在回调内有效.
+// 回调内通过Do读取数据、Queue排队写命令, 回调返回后排队的命令在MULTI/EXEC中原子执行
+type Tx struct {
+	ctx  context.Context
+	conn redis.Conn
+	//已发送但尚未读取回复的命令数
+	pending int
+	cmds    []command
+}
+
+// 在事务连接上WATCH更多的key, 与下一次Do一同发送
+func (tx *Tx) Watch(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := tx.conn.Send("WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+		return fmt.Errorf("watch: %w", err)
+	}
+	tx.pending++
+	return nil
+}
+
+// 立即执行命令并返回回复, 用于在MULTI之前读取被WATCH的key; 连接错误同样放入Reply.Err
+func (tx *Tx) Do(name string, args ...interface{}) Reply {
+	if err := tx.conn.Send(name, args...); err != nil {
+		return Reply{Err: err}
+	}
+	pendingErr := tx.flushPending()
+	if tx.conn.Err() != nil {
+		return Reply{Err: tx.conn.Err()}
+	}
+	reply, err := receive(tx.ctx, tx.conn)
+	if err != nil {
+		return Reply{Err: err}
+	}
+	if pendingErr != nil {
+		return Reply{Err: pendingErr}
+	}
+	return reply
+}
+
+// 将写命令加入事务, 在回调返回后执行
+func (tx *Tx) Queue(name string, args ...interface{}) {
+	tx.cmds = append(tx.cmds, command{name: name, args: args})
+}
+
+// 发送缓冲区中的命令并读取此前未读取的回复, 返回第一个错误
+func (tx *Tx) flushPending() error {
+	if err := tx.conn.Flush(); err != nil {
+		return err
+	}
+	var firstErr error
+	for ; tx.pending > 0; tx.pending-- {
+		reply, err := receive(tx.ctx, tx.conn)
+		if err != nil {
+			//连接错误时后续回复已无法读取
+			tx.pending = 0
+			return err
+		}
+		if firstErr == nil {
+			firstErr = reply.Err
+		}
+	}
+	return firstErr
+}
+
+// 在同一连接上执行事务: 先WATCH watchKeys, 再执行回调, 最后以MULTI/EXEC原子执行回调中排队的命令.
+// 回调返回错误时放弃事务; WATCH的key被修改时返回ErrTxAborted, 调用方可重试
+func (c *RedisClient) Transaction(ctx context.Context, fn func(tx *Tx) error, watchKeys ...string) ([]Reply, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	tx := &Tx{ctx: ctx, conn: conn}
+	if err = tx.Watch(watchKeys...); err != nil {
+		return nil, err
+	}
+
+	if err = fn(tx); err != nil || len(tx.cmds) == 0 {
+		_ = tx.conn.Send("UNWATCH")
+		tx.pending++
+		if flushErr := tx.flushPending(); err == nil {
+			err = flushErr
+		}
+		return nil, err
+	}
+
+	_ = conn.Send("MULTI")
+	for _, cmd := range tx.cmds {
+		_ = conn.Send(cmd.name, cmd.args...)
+	}
+	if err = conn.Send("EXEC"); err != nil {
+		return nil, fmt.Errorf("transaction send: %w", err)
+	}
+	//MULTI与排队的命令只返回OK/QUEUED, 真正的回复在EXEC中
+	tx.pending += len(tx.cmds) + 1
+	if err = tx.flushPending(); err != nil {
+		return nil, fmt.Errorf("transaction queue: %w", err)
+	}
+
+	reply, err := receive(ctx, conn)
+	if err == nil {
+		err = reply.Err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("transaction exec: %w", err)
+	}
+	if reply.Value == nil {
+		return nil, ErrTxAborted
+	}
+
+	values, err := redis.Values(reply.Value, nil)
+	if err != nil {
+		return nil, fmt.Errorf("transaction exec: %w", err)
+	}
+	replies := make([]Reply, len(values))
+	for i, value := range values {
+		if e, ok := value.(redis.Error); ok {
+			replies[i] = Reply{Err: e}
+			continue
+		}
+		replies[i] = Reply{Value: value}
+	}
+	return replies, nil
+}
+
+// 读取一条回复, redis返回的命令错误放入Reply.Err, 连接错误通过error返回
+func receive(ctx context.Context, conn redis.Conn) (Reply, error) {
+	value, err := redis.ReceiveContext(conn, ctx)
+	var replyErr redis.Error
+	if errors.As(err, &replyErr) {
+		return Reply{Err: replyErr}, nil
+	}
+	if err != nil {
+		return Reply{}, err
+	}
+	return Reply{Value: value}, nil
+}
@@ -0,0 +1,97 @@
+package third_party
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func Test_pipeline(t *testing.T) {
+	client, server := newMiniClient(t)
+	ctx := context.Background()
+
+	if err := server.Set("str", "v"); err != nil {
+		t.Fatal(err)
+	}
+	replies, err := client.Pipeline().
+		Do("GET", "str").
+		Do("INCR", "counter").
+		Do("INCR", "str").
+		Do("GET", "missing").
+		Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := replies[0].String(); err != nil || v != "v" {
+		t.Fatalf("unexpected GET reply: %v, %v", v, err)
+	}
+	if v, err := replies[1].Int64(); err != nil || v != 1 {
+		t.Fatalf("unexpected INCR reply: %v, %v", v, err)
+	}
+	//单条命令的错误不影响其他命令
+	if replies[2].Err == nil {
+		t.Fatal("INCR on non-integer should fail")
+	}
+	if _, err := replies[3].String(); !errors.Is(err, redis.ErrNil) {
+		t.Fatal("GET missing key should be redis.ErrNil, got: ", err)
+	}
+}
+
+func Test_transaction(t *testing.T) {
+	client, server := newMiniClient(t)
+	ctx := context.Background()
+
+	if err := server.Set("balance", "10"); err != nil {
+		t.Fatal(err)
+	}
+	replies, err := client.Transaction(ctx, func(tx *Tx) error {
+		balance, err := tx.Do("GET", "balance").Int64()
+		if err != nil {
+			return err
+		}
+		tx.Queue("SET", "balance", balance-3)
+		tx.Queue("INCRBY", "frozen", 3)
+		return nil
+	}, "balance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := replies[1].Int64(); v != 3 {
+		t.Fatalf("unexpected INCRBY reply: %v", replies[1])
+	}
+	if got, _ := server.Get("balance"); got != "7" {
+		t.Fatalf("balance should be 7, got: %s", got)
+	}
+
+	//WATCH的key在EXEC前被修改时事务不执行
+	_, err = client.Transaction(ctx, func(tx *Tx) error {
+		if _, err := tx.Do("GET", "balance").Int64(); err != nil {
+			return err
+		}
+		if _, err := client.Set(ctx, "balance", "100"); err != nil {
+			return err
+		}
+		tx.Queue("SET", "balance", 0)
+		return nil
+	}, "balance")
+	if !errors.Is(err, ErrTxAborted) {
+		t.Fatal("transaction should abort when watched key modified, got: ", err)
+	}
+	if got, _ := server.Get("balance"); got != "100" {
+		t.Fatalf("aborted transaction should not write, got: %s", got)
+	}
+
+	//回调返回错误时放弃事务, 连接可继续使用
+	bizErr := errors.New("insufficient balance")
+	if _, err = client.Transaction(ctx, func(tx *Tx) error {
+		tx.Queue("SET", "balance", 0)
+		return bizErr
+	}, "balance"); !errors.Is(err, bizErr) {
+		t.Fatal("callback error should be returned, got: ", err)
+	}
+	if got, _ := client.Get(ctx, "balance"); got != "100" {
+		t.Fatalf("abandoned transaction should not write, got: %s", got)
+	}
+}
@@ -3,8 +3,11 @@ package third_party
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/gomodule/redigo/redis"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,12 +16,24 @@ type LockClient interface {
 	Eval(ctx context.Context, src string, keyCount int, keyAndArgs []interface{}) (interface{}, error)
 }
 
+// 公平锁需要阻塞等待唤醒通知, 要求客户端支持BLPOP
+type BlockingLockClient interface {
+	LockClient
+	BLPop(ctx context.Context, key string, timeoutSeconds int64) (string, error)
+}
+
 type RedisClient struct {
 	ClientOptions
 	pool *redis.Pool
+	//按源码缓存的lua脚本
+	scripts sync.Map
+	//建立连接失败的次数
+	dialErrors atomic.Int64
 }
 
-func NewClient(network, address, password string, opts ...ClientOption) *RedisClient {
+// 连接address上的单个redis节点. 不支持Sentinel的主节点发现与Cluster的slot路由,
+// 高可用部署需由address指向的代理或VIP完成故障切换; 多key的lua脚本所需的hash tag见pkg.WithHashTag
+func NewClient(network, address, password string, opts ...ClientOption) (*RedisClient, error) {
 	client := &RedisClient{
 		ClientOptions: ClientOptions{
 			network:  network,
@@ -33,24 +48,22 @@ func NewClient(network, address, password string, opts ...ClientOption) *RedisCl
 
 	repairClientOpt(&client.ClientOptions)
 
-	return &RedisClient{
-		pool: client.getRedisPool(),
+	if err := validateClientOpt(&client.ClientOptions); err != nil {
+		return nil, err
 	}
+
+	client.pool = client.getRedisPool()
+	return client, nil
 }
 
 func (c *RedisClient) getRedisPool() *redis.Pool {
 	return &redis.Pool{
 		MaxIdle:     c.maxIdle,
 		IdleTimeout: time.Duration(c.idleTimeoutSeconds) * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := c.getRedisConn()
-			if err != nil {
-				return nil, err
-			}
-			return c, nil
-		},
-		MaxActive: c.maxConnection,
-		Wait:      c.wait,
+		//从连接池取连接时按调用方的ctx建立新连接
+		DialContext: c.getRedisConn,
+		MaxActive:   c.maxConnection,
+		Wait:        c.wait,
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
 			return err
@@ -58,30 +71,71 @@ func (c *RedisClient) getRedisPool() *redis.Pool {
 	}
 }
 
-func (c *RedisClient) getRedisConn() (redis.Conn, error) {
-	if c.address == "" {
-		panic("Failure: Get redis address from config failed")
-	}
-
+func (c *RedisClient) getRedisConn(ctx context.Context) (redis.Conn, error) {
 	var dialOpts []redis.DialOption
 	if len(c.password) > 0 {
 		dialOpts = append(dialOpts, redis.DialPassword(c.password)) //将password变成额外参数
 	}
+	if len(c.username) > 0 {
+		dialOpts = append(dialOpts, redis.DialUsername(c.username))
+	}
+	if c.db > 0 {
+		dialOpts = append(dialOpts, redis.DialDatabase(c.db))
+	}
+	if c.tlsConfig != nil {
+		dialOpts = append(dialOpts, redis.DialUseTLS(true), redis.DialTLSConfig(c.tlsConfig))
+	}
+	if c.connectTimeout > 0 {
+		dialOpts = append(dialOpts, redis.DialConnectTimeout(c.connectTimeout))
+	}
+	if c.readTimeout > 0 {
+		dialOpts = append(dialOpts, redis.DialReadTimeout(c.readTimeout))
+	}
+	if c.writeTimeout > 0 {
+		dialOpts = append(dialOpts, redis.DialWriteTimeout(c.writeTimeout))
+	}
 
-	conn, err := redis.DialContext(context.Background(), c.network, c.address, dialOpts...)
+	conn, err := redis.DialContext(ctx, c.network, c.address, dialOpts...)
 	if err != nil {
-		return nil, err
+		c.dialErrors.Add(1)
+		return nil, fmt.Errorf("dial redis %s: %w", c.address, err)
 	}
 	return conn, nil
 }
 
+// key为空时返回的错误
+var ErrEmptyKey = errors.New("redis key can't be empty")
+
+// 校验命令的key, 任一key为空时返回包装了ErrEmptyKey的错误
+func checkKeys(cmd string, keys ...string) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: %w", cmd, ErrEmptyKey)
+	}
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("%s: %w", cmd, ErrEmptyKey)
+		}
+	}
+	return nil
+}
+
+// 在连接池中取连接执行单条命令
+func (c *RedisClient) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return redis.DoContext(conn, ctx, cmd, args...)
+}
+
 func (c *RedisClient) GetConn(ctx context.Context) (redis.Conn, error) {
 	return c.pool.GetContext(ctx)
 }
 
 func (c *RedisClient) Get(ctx context.Context, key string) (string, error) {
-	if key == "" {
-		return "", errors.New("GET: redis key can't be empty")
+	if err := checkKeys("GET", key); err != nil {
+		return "", err
 	}
 
 	conn, err := c.pool.GetContext(ctx)
@@ -89,12 +143,15 @@ func (c *RedisClient) Get(ctx context.Context, key string) (string, error) {
 		return "", err
 	}
 	defer conn.Close()
-	return redis.String(conn.Do("GET", key))
+	return redis.String(redis.DoContext(conn, ctx, "GET", key))
 }
 
 func (c *RedisClient) Set(ctx context.Context, key string, value string) (int64, error) {
-	if key == "" || value == "" {
-		return -1, errors.New("SET: redis key or value can't be empty")
+	if err := checkKeys("SET", key); err != nil {
+		return -1, err
+	}
+	if value == "" {
+		return -1, errors.New("SET: redis value can't be empty")
 	}
 
 	conn, err := c.pool.GetContext(ctx)
@@ -103,7 +160,7 @@ func (c *RedisClient) Set(ctx context.Context, key string, value string) (int64,
 	}
 	defer conn.Close()
 
-	resp, err := conn.Do("SET", key, value)
+	resp, err := redis.DoContext(conn, ctx, "SET", key, value)
 
 	if respStr, ok := resp.(string); ok && strings.ToLower(respStr) == "ok" {
 		return 1, nil
@@ -113,18 +170,25 @@ func (c *RedisClient) Set(ctx context.Context, key string, value string) (int64,
 }
 
 func (c *RedisClient) SetNXWithEX(ctx context.Context, key, value string, expirationSeconds int64) (int64, error) {
-	if key == "" || value == "" {
-		return -1, errors.New("SETNXWithEX: redis key or value can't be empty")
+	if err := checkKeys("SETNXWithEX", key); err != nil {
+		return -1, err
+	}
+	if value == "" {
+		return -1, errors.New("SETNXWithEX: redis value can't be empty")
 	}
 	conn, err := c.pool.GetContext(ctx)
 	if err != nil {
 		return -1, err
 	}
 	defer conn.Close()
-	resp, err := conn.Do("SET", key, value, "EX", expirationSeconds, "NX")
+	resp, err := redis.DoContext(conn, ctx, "SET", key, value, "EX", expirationSeconds, "NX")
 	if err != nil {
 		return -1, err
 	}
+	//key已存在时SET NX返回nil
+	if resp == nil {
+		return 0, nil
+	}
 
 	if respStr, ok := resp.(string); ok && strings.ToLower(respStr) == "ok" {
 		return 1, nil
@@ -134,8 +198,11 @@ func (c *RedisClient) SetNXWithEX(ctx context.Context, key, value string, expira
 }
 
 func (c *RedisClient) SetNX(ctx context.Context, key, value string) (int64, error) {
-	if key == "" || value == "" {
-		return -1, errors.New("SETNX: redis key or value can't be empty")
+	if err := checkKeys("SETNX", key); err != nil {
+		return -1, err
+	}
+	if value == "" {
+		return -1, errors.New("SETNX: redis value can't be empty")
 	}
 
 	conn, err := c.pool.GetContext(ctx)
@@ -144,7 +211,10 @@ func (c *RedisClient) SetNX(ctx context.Context, key, value string) (int64, erro
 	}
 	defer conn.Close()
 
-	resp, err := conn.Do("SET", key, value, "NX")
+	resp, err := redis.DoContext(conn, ctx, "SET", key, value, "NX")
+	if err == nil && resp == nil {
+		return 0, nil
+	}
 	if respStr, ok := resp.(string); ok && strings.ToLower(respStr) == "ok" {
 		return 1, nil
 	}
@@ -153,8 +223,8 @@ func (c *RedisClient) SetNX(ctx context.Context, key, value string) (int64, erro
 }
 
 func (c *RedisClient) Del(ctx context.Context, key string) error {
-	if key == "" {
-		return errors.New("DEL: redis key can't be empty")
+	if err := checkKeys("DEL", key); err != nil {
+		return err
 	}
 
 	conn, err := c.pool.GetContext(ctx)
@@ -163,34 +233,55 @@ func (c *RedisClient) Del(ctx context.Context, key string) error {
 	}
 	defer conn.Close()
 
-	_, err = conn.Do("DEL", key)
+	_, err = redis.DoContext(conn, ctx, "DEL", key)
 	return err
 }
 
 func (c *RedisClient) Incr(ctx context.Context, key string) (int64, error) {
-	if key == "" {
-		return -1, errors.New("DEL: redis key can't be empty")
+	if err := checkKeys("INCR", key); err != nil {
+		return -1, err
 	}
 	conn, err := c.pool.GetContext(ctx)
 	if err != nil {
 		return -1, err
 	}
 	defer conn.Close()
-	return redis.Int64(conn.Do("INCR", key))
+	return redis.Int64(redis.DoContext(conn, ctx, "INCR", key))
 }
 
+// 执行lua脚本, 脚本按源码缓存为Script, 以EVALSHA执行并在服务端未缓存时回退到EVAL
 func (c *RedisClient) Eval(ctx context.Context, src string, keyCount int, keyAndArgs []interface{}) (interface{}, error) {
-	args := make([]interface{}, len(keyAndArgs)+2)
-	args[0] = src
-	args[1] = keyCount
+	args := make([]interface{}, len(keyAndArgs)+1)
+	args[0] = keyCount
+	copy(args[1:], keyAndArgs)
+
+	return c.script(src).Do(ctx, c, args...)
+}
 
-	copy(args[2:], keyAndArgs)
+// 获取源码对应的Script, key的数量由调用方在每次执行时传入
+func (c *RedisClient) script(src string) *Script {
+	if script, ok := c.scripts.Load(src); ok {
+		return script.(*Script)
+	}
+	script, _ := c.scripts.LoadOrStore(src, NewScript(-1, src))
+	return script.(*Script)
+}
 
+// 阻塞弹出列表的第一个元素, 超时返回redis.ErrNil
+func (c *RedisClient) BLPop(ctx context.Context, key string, timeoutSeconds int64) (string, error) {
+	if err := checkKeys("BLPOP", key); err != nil {
+		return "", err
+	}
 	conn, err := c.pool.GetContext(ctx)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer conn.Close()
 
-	return conn.Do("ECHO", args...)
+	values, err := redis.Strings(redis.DoContext(conn, ctx, "BLPOP", key, timeoutSeconds))
+	if err != nil {
+		return "", err
+	}
+	//BLPOP返回[key, value]
+	return values[1], nil
 }
@@ -0,0 +1,182 @@
+package third_party
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func Test_hash_commands(t *testing.T) {
+	client, _ := newMiniClient(t)
+	ctx := context.Background()
+
+	added, err := client.HSet(ctx, "h", map[string]string{"a": "1", "b": "2"})
+	if err != nil || added != 2 {
+		t.Fatalf("unexpected HSET reply: %d, %v", added, err)
+	}
+	if v, err := client.HGet(ctx, "h", "a"); err != nil || v != "1" {
+		t.Fatalf("unexpected HGET reply: %s, %v", v, err)
+	}
+	if _, err := client.HGet(ctx, "h", "missing"); !errors.Is(err, redis.ErrNil) {
+		t.Fatal("HGET missing field should be redis.ErrNil, got: ", err)
+	}
+
+	values, err := client.HMGet(ctx, "h", "a", "missing", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values["a"] != "1" || values["b"] != "2" {
+		t.Fatalf("unexpected HMGET reply: %v", values)
+	}
+
+	if deleted, err := client.HDel(ctx, "h", "a", "missing"); err != nil || deleted != 1 {
+		t.Fatalf("unexpected HDEL reply: %d, %v", deleted, err)
+	}
+}
+
+func Test_zset_commands(t *testing.T) {
+	client, _ := newMiniClient(t)
+	ctx := context.Background()
+
+	if _, err := client.ZAdd(ctx, "z", ZMember{"tx1", 1}, ZMember{"tx2", 2}, ZMember{"tx3", 3.5}); err != nil {
+		t.Fatal(err)
+	}
+	members, err := client.ZRangeByScore(ctx, "z", ZRangeBy{Min: "(1", Max: "+inf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[0] != (ZMember{"tx2", 2}) || members[1] != (ZMember{"tx3", 3.5}) {
+		t.Fatalf("unexpected ZRANGEBYSCORE reply: %v", members)
+	}
+
+	members, err = client.ZRangeByScore(ctx, "z", ZRangeBy{Min: "-inf", Max: "+inf", Offset: 1, Count: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Member != "tx2" {
+		t.Fatalf("unexpected paged ZRANGEBYSCORE reply: %v", members)
+	}
+
+	if removed, err := client.ZRem(ctx, "z", "tx1", "missing"); err != nil || removed != 1 {
+		t.Fatalf("unexpected ZREM reply: %d, %v", removed, err)
+	}
+}
+
+func Test_set_with_options_and_ttl(t *testing.T) {
+	client, server := newMiniClient(t)
+	ctx := context.Background()
+
+	if ok, err := client.SetWithOptions(ctx, "k", "v1", WithSetXX()); err != nil || ok {
+		t.Fatalf("SET XX on missing key should not set: %v, %v", ok, err)
+	}
+	if ok, err := client.SetWithOptions(ctx, "k", "v1", WithSetNX(), WithSetTTL(10*time.Second)); err != nil || !ok {
+		t.Fatalf("SET NX EX should set: %v, %v", ok, err)
+	}
+	if ttl, err := client.TTL(ctx, "k"); err != nil || ttl != 10*time.Second {
+		t.Fatalf("unexpected TTL: %v, %v", ttl, err)
+	}
+	if ok, err := client.SetWithOptions(ctx, "k", "v2", WithSetXX(), WithSetTTL(1500*time.Millisecond)); err != nil || !ok {
+		t.Fatalf("SET XX PX should set: %v, %v", ok, err)
+	}
+	if ttl, _ := client.TTL(ctx, "k"); ttl != 1500*time.Millisecond {
+		t.Fatalf("unexpected TTL after PX: %v", ttl)
+	}
+	if _, err := client.SetWithOptions(ctx, "k", "v3", WithSetNX(), WithSetXX()); err == nil {
+		t.Fatal("NX with XX should be rejected")
+	}
+
+	if ok, err := client.Expire(ctx, "k", time.Minute); err != nil || !ok {
+		t.Fatalf("EXPIRE should succeed: %v, %v", ok, err)
+	}
+	server.Advance(time.Minute)
+	if _, err := client.TTL(ctx, "k"); !errors.Is(err, redis.ErrNil) {
+		t.Fatal("TTL of expired key should be redis.ErrNil, got: ", err)
+	}
+	if ok, _ := client.Expire(ctx, "k", time.Minute); ok {
+		t.Fatal("EXPIRE on missing key should return false")
+	}
+
+	if _, err := client.Set(ctx, "persist", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := client.TTL(ctx, "persist"); ttl != TTLNoExpire {
+		t.Fatalf("TTL without expire should be TTLNoExpire, got: %v", ttl)
+	}
+
+	//不足1ms的ttl被拒绝, key不会被删除
+	for _, ttl := range []time.Duration{0, -time.Second, time.Microsecond} {
+		if _, err := client.Expire(ctx, "persist", ttl); err == nil {
+			t.Fatalf("EXPIRE with ttl %v should be rejected", ttl)
+		}
+	}
+	if !server.Exists("persist") {
+		t.Fatal("rejected EXPIRE should not delete the key")
+	}
+	if _, err := client.SetWithOptions(ctx, "k", "v", WithSetTTL(time.Microsecond)); err == nil {
+		t.Fatal("SET with sub-millisecond ttl should be rejected")
+	}
+	if _, err := client.SetWithOptions(ctx, "k", ""); err == nil {
+		t.Fatal("SET with empty value should be rejected like Set")
+	}
+}
+
+func Test_scan_iterator(t *testing.T) {
+	client, server := newMiniClient(t)
+	ctx := context.Background()
+
+	want := []string{"tx:1", "tx:2", "tx:3", "tx:4", "tx:5"}
+	for _, key := range want {
+		if err := server.Set(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Set("other", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	iter := client.Scan("tx:*", 2)
+	for iter.Next(ctx) {
+		got = append(got, iter.Key())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if len(got) != len(want) {
+		t.Fatalf("unexpected scanned keys: %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("unexpected scanned keys: %v", got)
+		}
+	}
+}
+
+func Test_empty_key_validation(t *testing.T) {
+	client, _ := newMiniClient(t)
+	ctx := context.Background()
+
+	checks := map[string]error{}
+	_, checks["GET"] = client.Get(ctx, "")
+	checks["DEL"] = client.Del(ctx, "")
+	_, checks["HGET"] = client.HGet(ctx, "", "f")
+	_, checks["HSET"] = client.HSet(ctx, "", map[string]string{"f": "v"})
+	_, checks["HMGET"] = client.HMGet(ctx, "", "f")
+	_, checks["HDEL"] = client.HDel(ctx, "", "f")
+	_, checks["ZADD"] = client.ZAdd(ctx, "", ZMember{"m", 1})
+	_, checks["ZRANGEBYSCORE"] = client.ZRangeByScore(ctx, "", ZRangeBy{Min: "-inf", Max: "+inf"})
+	_, checks["ZREM"] = client.ZRem(ctx, "", "m")
+	_, checks["SET"] = client.SetWithOptions(ctx, "", "v")
+	_, checks["EXPIRE"] = client.Expire(ctx, "", time.Second)
+	_, checks["TTL"] = client.TTL(ctx, "")
+	for cmd, err := range checks {
+		if !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("%s with empty key should return ErrEmptyKey, got: %v", cmd, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package third_party
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 获取hash中field的值, field不存在时返回redis.ErrNil
+func (c *RedisClient) HGet(ctx context.Context, key, field string) (string, error) {
+	if err := checkKeys("HGET", key); err != nil {
+		return "", err
+	}
+	return redis.String(c.do(ctx, "HGET", key, field))
+}
+
+// 设置hash中的多个field, 返回新增的field数量
+func (c *RedisClient) HSet(ctx context.Context, key string, fieldValues map[string]string) (int64, error) {
+	if err := checkKeys("HSET", key); err != nil {
+		return -1, err
+	}
+	if len(fieldValues) == 0 {
+		return -1, fmt.Errorf("HSET: field values can't be empty")
+	}
+	return redis.Int64(c.do(ctx, "HSET", redis.Args{key}.AddFlat(fieldValues)...))
+}
+
+// 获取hash中多个field的值, 返回结果中只包含存在的field
+func (c *RedisClient) HMGet(ctx context.Context, key string, fields ...string) (map[string]string, error) {
+	if err := checkKeys("HMGET", key); err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return map[string]string{}, nil
+	}
+
+	values, err := redis.Values(c.do(ctx, "HMGET", redis.Args{key}.AddFlat(fields)...))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(fields))
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		if result[fields[i]], err = redis.String(value, nil); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// 删除hash中的field, 返回实际删除的数量
+func (c *RedisClient) HDel(ctx context.Context, key string, fields ...string) (int64, error) {
+	if err := checkKeys("HDEL", key); err != nil {
+		return -1, err
+	}
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	return redis.Int64(c.do(ctx, "HDEL", redis.Args{key}.AddFlat(fields)...))
+}
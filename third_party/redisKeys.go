@@ -0,0 +1,187 @@
+package third_party
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// key存在但未设置过期时间时TTL返回的值
+const TTLNoExpire time.Duration = -1
+
+type SetOptions struct {
+	ttl time.Duration
+	nx  bool
+	xx  bool
+}
+
+type SetOption func(c *SetOptions)
+
+// 设置过期时间, 整秒时使用EX, 否则使用PX
+func WithSetTTL(ttl time.Duration) SetOption {
+	return func(c *SetOptions) {
+		c.ttl = ttl
+	}
+}
+
+// 仅在key不存在时设置
+func WithSetNX() SetOption {
+	return func(c *SetOptions) {
+		c.nx = true
+	}
+}
+
+// 仅在key已存在时设置
+func WithSetXX() SetOption {
+	return func(c *SetOptions) {
+		c.xx = true
+	}
+}
+
+// 带选项的SET, 返回是否设置成功; NX/XX条件不满足时返回false. 与Set相同, value不能为空
+func (c *RedisClient) SetWithOptions(ctx context.Context, key, value string, opts ...SetOption) (bool, error) {
+	if err := checkKeys("SET", key); err != nil {
+		return false, err
+	}
+	if value == "" {
+		return false, errors.New("SET: redis value can't be empty")
+	}
+
+	var setOpts SetOptions
+	for _, opt := range opts {
+		opt(&setOpts)
+	}
+	if setOpts.nx && setOpts.xx {
+		return false, errors.New("SET: NX and XX can't be used together")
+	}
+	//不足1ms的ttl会以PX 0发送, redis拒绝该过期时间
+	if setOpts.ttl < 0 || (setOpts.ttl > 0 && setOpts.ttl < time.Millisecond) {
+		return false, fmt.Errorf("SET: invalid ttl: %v", setOpts.ttl)
+	}
+
+	args := redis.Args{key, value}
+	switch {
+	case setOpts.ttl == 0:
+	case setOpts.ttl%time.Second == 0:
+		args = args.Add("EX", int64(setOpts.ttl/time.Second))
+	default:
+		args = args.Add("PX", setOpts.ttl.Milliseconds())
+	}
+	if setOpts.nx {
+		args = args.Add("NX")
+	}
+	if setOpts.xx {
+		args = args.Add("XX")
+	}
+
+	resp, err := c.do(ctx, "SET", args...)
+	if err != nil {
+		return false, err
+	}
+	//NX/XX条件不满足时返回nil
+	return resp != nil, nil
+}
+
+// 设置key的过期时间, 精确到毫秒; key不存在时返回false.
+// ttl不足1ms时返回错误, 避免以PEXPIRE 0直接删除key
+func (c *RedisClient) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	if err := checkKeys("EXPIRE", key); err != nil {
+		return false, err
+	}
+	if ttl < time.Millisecond {
+		return false, fmt.Errorf("EXPIRE: invalid ttl: %v", ttl)
+	}
+	return redis.Bool(c.do(ctx, "PEXPIRE", key, ttl.Milliseconds()))
+}
+
+// 获取key的剩余存活时间, key不存在时返回redis.ErrNil, 未设置过期时间时返回TTLNoExpire
+func (c *RedisClient) TTL(ctx context.Context, key string) (time.Duration, error) {
+	if err := checkKeys("TTL", key); err != nil {
+		return 0, err
+	}
+	ttl, err := redis.Int64(c.do(ctx, "PTTL", key))
+	if err != nil {
+		return 0, err
+	}
+	switch ttl {
+	case -2:
+		return 0, redis.ErrNil
+	case -1:
+		return TTLNoExpire, nil
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+// SCAN迭代器, 由RedisClient.Scan创建:
+//
+//	iter := client.Scan("prefix*", 100)
+//	for iter.Next(ctx) {
+//		key := iter.Key()
+//	}
+//	err := iter.Err()
+//
+// 与SCAN命令相同, 迭代期间被修改的key可能重复返回或被遗漏
+type ScanIterator struct {
+	client *RedisClient
+	match  string
+	count  int64
+
+	cursor int64
+	//当前批次中尚未返回的key
+	keys []string
+	key  string
+	done bool
+	err  error
+}
+
+// 创建SCAN迭代器, match为空时匹配所有key, count为每批次的建议数量, 不大于0时使用redis的默认值
+func (c *RedisClient) Scan(match string, count int64) *ScanIterator {
+	return &ScanIterator{client: c, match: match, count: count}
+}
+
+// 移动到下一个key, 迭代完成或出错时返回false
+func (it *ScanIterator) Next(ctx context.Context) bool {
+	for len(it.keys) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		it.fetch(ctx)
+	}
+	it.key, it.keys = it.keys[0], it.keys[1:]
+	return true
+}
+
+func (it *ScanIterator) fetch(ctx context.Context) {
+	args := redis.Args{it.cursor}
+	if it.match != "" {
+		args = args.Add("MATCH", it.match)
+	}
+	if it.count > 0 {
+		args = args.Add("COUNT", it.count)
+	}
+
+	values, err := redis.Values(it.client.do(ctx, "SCAN", args...))
+	if err != nil {
+		it.err = fmt.Errorf("SCAN: %w", err)
+		return
+	}
+	//SCAN返回[cursor, [key...]]
+	if _, err = redis.Scan(values, &it.cursor, &it.keys); err != nil {
+		it.err = fmt.Errorf("SCAN: %w", err)
+		return
+	}
+	it.done = it.cursor == 0
+}
+
+// 当前的key
+func (it *ScanIterator) Key() string {
+	return it.key
+}
+
+// 迭代过程中出现的错误
+func (it *ScanIterator) Err() error {
+	return it.err
+}
@@ -1,5 +1,12 @@
 package third_party
 
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+)
+
 const (
 	// 默认连接数超过10s后释放连接
 	DefaultIdleTimeoutSeconds = 10
@@ -9,6 +16,8 @@ const (
 	DefaultMaxIdleConnection = 20
 )
 
+var ErrInvalidClientOption = errors.New("invalid redis client option")
+
 type ClientOptions struct {
 	//基本参数
 	network  string
@@ -20,6 +29,14 @@ type ClientOptions struct {
 	idleTimeoutSeconds int
 	maxConnection      int
 	wait               bool
+
+	//连接参数
+	username       string
+	db             int
+	tlsConfig      *tls.Config
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
 }
 
 type ClientOption func(c *ClientOptions)
@@ -48,6 +65,72 @@ func WithWaitMode() ClientOption {
 	}
 }
 
+// ACL用户名, 需与password同时使用
+func WithUsername(username string) ClientOption {
+	return func(c *ClientOptions) {
+		c.username = username
+	}
+}
+
+// 连接建立后通过SELECT切换到的数据库
+func WithDB(db int) ClientOption {
+	return func(c *ClientOptions) {
+		c.db = db
+	}
+}
+
+// 使用TLS连接, config为nil时使用默认配置
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return func(c *ClientOptions) {
+		if config == nil {
+			config = &tls.Config{}
+		}
+		c.tlsConfig = config
+	}
+}
+
+// 建立连接的超时时间, 同时受调用方ctx的约束
+func WithConnectTimeout(timeout time.Duration) ClientOption {
+	return func(c *ClientOptions) {
+		c.connectTimeout = timeout
+	}
+}
+
+func WithReadTimeout(timeout time.Duration) ClientOption {
+	return func(c *ClientOptions) {
+		c.readTimeout = timeout
+	}
+}
+
+func WithWriteTimeout(timeout time.Duration) ClientOption {
+	return func(c *ClientOptions) {
+		c.writeTimeout = timeout
+	}
+}
+
+// 校验客户端参数, 参数不合法时返回ErrInvalidClientOption
+func validateClientOpt(c *ClientOptions) error {
+	if c.address == "" {
+		return fmt.Errorf("%w: address can't be empty", ErrInvalidClientOption)
+	}
+	if c.network != "tcp" && c.network != "unix" {
+		return fmt.Errorf("%w: unsupported network %q", ErrInvalidClientOption, c.network)
+	}
+	if c.username != "" && c.password == "" {
+		return fmt.Errorf("%w: username %q requires a password", ErrInvalidClientOption, c.username)
+	}
+	if c.db < 0 {
+		return fmt.Errorf("%w: db index %d can't be negative", ErrInvalidClientOption, c.db)
+	}
+	if c.connectTimeout < 0 || c.readTimeout < 0 || c.writeTimeout < 0 {
+		return fmt.Errorf("%w: timeouts can't be negative", ErrInvalidClientOption)
+	}
+	if c.maxConnection > 0 && c.maxIdle > c.maxConnection {
+		return fmt.Errorf("%w: max idle %d exceeds max connection %d", ErrInvalidClientOption, c.maxIdle, c.maxConnection)
+	}
+	return nil
+}
+
 func repairClientOpt(c *ClientOptions) {
 	if c.maxIdle < 0 {
 		c.maxIdle = DefaultMaxIdleConnection
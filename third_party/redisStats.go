@@ -0,0 +1,61 @@
+package third_party
+
+import (
+	"TCC/metrics"
+	"context"
+	"fmt"
+	"time"
+)
+
+// 健康检查未设置超时时间时的默认超时
+const DefaultHealthCheckTimeout = 2 * time.Second
+
+// 连接池的统计信息, 用于判断取锁超时等问题是否由连接池耗尽引起
+type PoolStats struct {
+	//使用中与空闲的连接数之和
+	ActiveCount int
+	//空闲的连接数
+	IdleCount int
+	//等待可用连接的总次数, 只在等待模式下增长
+	WaitCount int64
+	//等待可用连接的总时长
+	WaitDuration time.Duration
+	//建立连接失败的总次数
+	DialErrors int64
+}
+
+func (c *RedisClient) Stats() PoolStats {
+	stats := c.pool.Stats()
+	return PoolStats{
+		ActiveCount:  stats.ActiveCount,
+		IdleCount:    stats.IdleCount,
+		WaitCount:    stats.WaitCount,
+		WaitDuration: stats.WaitDuration,
+		DialErrors:   c.dialErrors.Load(),
+	}
+}
+
+func (c *RedisClient) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, "PING")
+	return err
+}
+
+// 检查redis是否可用, ctx未设置超时时间时使用DefaultHealthCheckTimeout
+func (c *RedisClient) HealthCheck(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultHealthCheckTimeout)
+		defer cancel()
+	}
+	if err := c.Ping(ctx); err != nil {
+		return fmt.Errorf("redis %s unhealthy: %w", c.address, err)
+	}
+	return nil
+}
+
+// 将连接池的统计信息发布到metrics, 指标名为"redis.<name>"
+func (c *RedisClient) PublishMetrics(name string) {
+	metrics.Publish("redis."+name, func() interface{} {
+		return c.Stats()
+	})
+}
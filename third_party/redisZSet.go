@@ -0,0 +1,80 @@
+package third_party
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 有序集合的成员及分数
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// ZRANGEBYSCORE的查询范围, Min/Max支持"-inf"、"+inf"及"("开头的开区间写法; Count大于0时分页
+type ZRangeBy struct {
+	Min    string
+	Max    string
+	Offset int64
+	Count  int64
+}
+
+// 添加或更新有序集合成员, 返回新增的成员数量
+func (c *RedisClient) ZAdd(ctx context.Context, key string, members ...ZMember) (int64, error) {
+	if err := checkKeys("ZADD", key); err != nil {
+		return -1, err
+	}
+	if len(members) == 0 {
+		return -1, fmt.Errorf("ZADD: members can't be empty")
+	}
+
+	args := redis.Args{key}
+	for _, member := range members {
+		args = args.Add(member.Score, member.Member)
+	}
+	return redis.Int64(c.do(ctx, "ZADD", args...))
+}
+
+// 按分数从小到大返回范围内的成员及分数
+func (c *RedisClient) ZRangeByScore(ctx context.Context, key string, by ZRangeBy) ([]ZMember, error) {
+	if err := checkKeys("ZRANGEBYSCORE", key); err != nil {
+		return nil, err
+	}
+	if by.Min == "" || by.Max == "" {
+		return nil, fmt.Errorf("ZRANGEBYSCORE: min and max can't be empty")
+	}
+
+	args := redis.Args{key, by.Min, by.Max, "WITHSCORES"}
+	if by.Count > 0 {
+		args = args.Add("LIMIT", by.Offset, by.Count)
+	}
+	values, err := redis.Strings(c.do(ctx, "ZRANGEBYSCORE", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	//WITHSCORES返回[member, score, member, score...]
+	members := make([]ZMember, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("ZRANGEBYSCORE: invalid score %q: %w", values[i+1], err)
+		}
+		members = append(members, ZMember{Member: values[i], Score: score})
+	}
+	return members, nil
+}
+
+// 删除有序集合成员, 返回实际删除的数量
+func (c *RedisClient) ZRem(ctx context.Context, key string, members ...string) (int64, error) {
+	if err := checkKeys("ZREM", key); err != nil {
+		return -1, err
+	}
+	if len(members) == 0 {
+		return 0, nil
+	}
+	return redis.Int64(c.do(ctx, "ZREM", redis.Args{key}.AddFlat(members)...))
+}
@@ -0,0 +1,110 @@
+package third_party
+
+import (
+	"TCC/metrics"
+	"TCC/testutil"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 连接进程内redis的客户端, 测试时无需启动真实的redis
+func newMiniClient(t *testing.T) (*RedisClient, *testutil.RedisServer) {
+	server := testutil.NewRedisServer(t)
+	client, err := NewClient("tcp", server.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func Test_client_option_validation(t *testing.T) {
+	cases := []struct {
+		name    string
+		network string
+		address string
+		opts    []ClientOption
+	}{
+		{name: "empty address", network: "tcp"},
+		{name: "unsupported network", network: "udp", address: "127.0.0.1:6379"},
+		{name: "username without password", network: "tcp", address: "127.0.0.1:6379", opts: []ClientOption{WithUsername("tcc")}},
+		{name: "negative db", network: "tcp", address: "127.0.0.1:6379", opts: []ClientOption{WithDB(-1)}},
+		{name: "negative timeout", network: "tcp", address: "127.0.0.1:6379", opts: []ClientOption{WithReadTimeout(-time.Second)}},
+		{name: "idle exceeds max", network: "tcp", address: "127.0.0.1:6379", opts: []ClientOption{WithMaxIdle(10), WithMaxConnection(5)}},
+	}
+	for _, c := range cases {
+		if _, err := NewClient(c.network, c.address, "", c.opts...); !errors.Is(err, ErrInvalidClientOption) {
+			t.Errorf("%s: expect ErrInvalidClientOption, got: %v", c.name, err)
+		}
+	}
+}
+
+func Test_client_acl_and_db(t *testing.T) {
+	server := testutil.NewRedisServer(t)
+	server.RequireUserAuth("tcc", "secret")
+	ctx := context.Background()
+
+	client, err := NewClient("tcp", server.Addr(), "secret",
+		WithUsername("tcc"), WithDB(2), WithConnectTimeout(time.Second), WithReadTimeout(time.Second), WithWriteTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Set(ctx, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := server.DB(2).Get("k"); got != "v" {
+		t.Fatalf("key should be written to db 2, got: %q", got)
+	}
+
+	wrong, err := NewClient("tcp", server.Addr(), "wrong", WithUsername("tcc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wrong.Get(ctx, "k"); err == nil {
+		t.Fatal("dial with wrong password should fail")
+	}
+}
+
+func Test_client_dial_honours_ctx(t *testing.T) {
+	client, _ := newMiniClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Get(ctx, "k"); !errors.Is(err, context.Canceled) {
+		t.Fatal("dial should fail with canceled ctx, got: ", err)
+	}
+}
+
+func Test_client_stats_and_health_check(t *testing.T) {
+	server := testutil.NewRedisServer(t)
+	//保留空闲连接, 以便统计健康检查归还的连接
+	client, err := NewClient("tcp", server.Addr(), "", WithMaxIdle(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := client.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stats := client.Stats()
+	if stats.ActiveCount != 1 || stats.IdleCount != 1 || stats.DialErrors != 0 {
+		t.Fatalf("unexpected stats after ping: %+v", stats)
+	}
+
+	client.PublishMetrics("test")
+	if v := metrics.Get("redis.test"); v == nil || !strings.Contains(v.String(), `"DialErrors":0`) {
+		t.Fatalf("stats should be published, got: %v", v)
+	}
+
+	//redis不可达时健康检查失败并记录建立连接失败的次数
+	server.Close()
+	if err := client.HealthCheck(ctx); err == nil {
+		t.Fatal("health check should fail when redis is unreachable")
+	}
+	if stats := client.Stats(); stats.DialErrors == 0 {
+		t.Fatalf("dial errors should be recorded: %+v", stats)
+	}
+}
@@ -0,0 +1,74 @@
+package third_party
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// lua脚本: 优先以EVALSHA执行, 服务端未缓存脚本(NOSCRIPT)时回退到EVAL, EVAL执行后脚本即被服务端缓存.
+// keyCount为负数时由调用方在keysAndArgs的首位传入key的数量
+type Script struct {
+	src    string
+	script *redis.Script
+}
+
+func NewScript(keyCount int, src string) *Script {
+	return &Script{
+		src:    src,
+		script: redis.NewScript(keyCount, src),
+	}
+}
+
+// 脚本的sha1摘要, 即EVALSHA使用的hash
+func (s *Script) Hash() string {
+	return s.script.Hash()
+}
+
+// 通过SCRIPT LOAD预先将脚本加载到服务端
+func (s *Script) Load(ctx context.Context, c *RedisClient) error {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = redis.DoContext(conn, ctx, "SCRIPT", "LOAD", s.src); err != nil {
+		return fmt.Errorf("script load %s: %w", s.Hash(), err)
+	}
+	return nil
+}
+
+// 执行脚本并返回原始回复: 整数为int64, 字符串为[]byte, 数组为[]interface{}, nil回复为nil
+func (s *Script) Do(ctx context.Context, c *RedisClient, keysAndArgs ...interface{}) (interface{}, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return s.script.DoContext(ctx, conn, keysAndArgs...)
+}
+
+// 以下为带类型的执行方法, 脚本返回nil时返回redis.ErrNil
+
+func (s *Script) Int64(ctx context.Context, c *RedisClient, keysAndArgs ...interface{}) (int64, error) {
+	return redis.Int64(s.Do(ctx, c, keysAndArgs...))
+}
+
+func (s *Script) Int64s(ctx context.Context, c *RedisClient, keysAndArgs ...interface{}) ([]int64, error) {
+	return redis.Int64s(s.Do(ctx, c, keysAndArgs...))
+}
+
+func (s *Script) String(ctx context.Context, c *RedisClient, keysAndArgs ...interface{}) (string, error) {
+	return redis.String(s.Do(ctx, c, keysAndArgs...))
+}
+
+func (s *Script) Strings(ctx context.Context, c *RedisClient, keysAndArgs ...interface{}) ([]string, error) {
+	return redis.Strings(s.Do(ctx, c, keysAndArgs...))
+}
+
+func (s *Script) Bool(ctx context.Context, c *RedisClient, keysAndArgs ...interface{}) (bool, error) {
+	return redis.Bool(s.Do(ctx, c, keysAndArgs...))
+}
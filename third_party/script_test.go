@@ -0,0 +1,80 @@
+package third_party
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func Test_eval_runs_script(t *testing.T) {
+	client, server := newMiniClient(t)
+	ctx := context.Background()
+
+	if err := server.Set("lock", "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := client.Eval(ctx, LuaCheckAndDeleteDistributionLock, 1, []interface{}{"lock", "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != int64(0) {
+		t.Fatalf("unlock by other token should return 0, got: %v", reply)
+	}
+
+	reply, err = client.Eval(ctx, LuaCheckAndDeleteDistributionLock, 1, []interface{}{"lock", "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != int64(1) || server.Exists("lock") {
+		t.Fatalf("unlock by holder should delete the key, got: %v", reply)
+	}
+}
+
+func Test_script_load_and_fallback(t *testing.T) {
+	client, server := newMiniClient(t)
+	ctx := context.Background()
+
+	script := NewScript(1, `
+		redis.call("set", KEYS[1], ARGV[1])
+		return {KEYS[1], redis.call("get", KEYS[1])}
+	`)
+	if err := script.Load(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := script.Strings(ctx, client, "k", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != "k" || values[1] != "v1" {
+		t.Fatalf("unexpected reply: %v", values)
+	}
+
+	//服务端清空脚本缓存后回退到EVAL
+	server.FlushAll()
+	conn, err := client.GetConn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Do("SCRIPT", "FLUSH"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	values, err = script.Strings(ctx, client, "k", "v2")
+	if err != nil {
+		t.Fatal("script should fall back to EVAL on NOSCRIPT: ", err)
+	}
+	if values[1] != "v2" {
+		t.Fatalf("unexpected reply: %v", values)
+	}
+
+	//脚本返回nil时带类型的方法返回redis.ErrNil
+	nilScript := NewScript(0, `return nil`)
+	if _, err = nilScript.Int64(ctx, client); !errors.Is(err, redis.ErrNil) {
+		t.Fatal("nil reply should be redis.ErrNil, got: ", err)
+	}
+}